@@ -1,89 +1,356 @@
 package ali_payment
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"pay_service/module/bill"
 	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/poller"
+	"pay_service/module/store"
 	"sort"
-	"utils/alipay"
 	"utils/crypto"
 	"utils/data_conv/json_lib"
-	"utils/data_conv/number_lib"
 	"utils/gin_check"
 	"utils/http_lib"
 )
 
-var aliPay alipay.AliPayLib
-
 //支付码交易返回
 type RetAliPayMicroPay struct {
 	ErrCode       int    `json:"err_code"`
 	ErrMsg        string `json:"err_msg"`
+	Retryable     bool   `json:"retryable"`      //可用相同参数重试
 	TradeNo       string `json:"trade_no"`       //支付宝订单号
 	OutTradeNo    string `json:"out_trade_no"`   //商户订单号
 	BuyerLogonId  string `json:"buyer_logon_id"` //买家支付定账号
-	TotalAmount   string `json:"total_amount"`   //订单交易总金额
-	ReceiptAmount string `json:"receipt_amount"` //实收金额
+	TotalAmount   Money  `json:"total_amount"`   //订单交易总金额(分)
+	ReceiptAmount Money  `json:"receipt_amount"` //实收金额(分)
 	EndTime       string `json:"gmt_payment"`    //交易支付时间
 }
 
+//支付宝预下单返回
+type RetAliPayPreCreate struct {
+	ErrCode    int    `json:"err_code"`
+	ErrMsg     string `json:"err_msg"`
+	Retryable  bool   `json:"retryable"`    //可用相同参数重试
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	QrCode     string `json:"qr_code"`      //二维码链接,用户用支付宝扫码支付
+}
+
+//支付宝APP支付返回
+type RetAliPayAppPay struct {
+	ErrCode    int    `json:"err_code"`
+	ErrMsg     string `json:"err_msg"`
+	Retryable  bool   `json:"retryable"`    //可用相同参数重试
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	OrderStr   string `json:"order_str"`    //签名后的订单信息,APP调起支付宝时使用
+}
+
 //支付宝退款信息
 type RetAliPayRefund struct {
-	ErrCode    int     `json:"err_code"`
-	ErrMsg     string  `json:"err_msg"`
-	TradeNo    string  `json:"trade_no"`     //支付宝订单号
-	OutTradeNo string  `json:"out_trade_no"` //商户订单号
-	RefundFee  float64 `json:"refund_fee"`   //退款金额
-	EndTime    string  `json:"gmt_payment"`  //退款支付时间
+	ErrCode    int    `json:"err_code"`
+	ErrMsg     string `json:"err_msg"`
+	Retryable  bool   `json:"retryable"`    //可用相同参数重试
+	TradeNo    string `json:"trade_no"`     //支付宝订单号
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	RefundFee  Money  `json:"refund_fee"`   //退款总金额(分)
+	EndTime    string `json:"gmt_payment"`  //退款支付时间
 }
 
 //支付宝查询退款信息返回
 type RetAliPayQueryRefund struct {
-	ErrCode      int     `json:"err_code"`
-	ErrMsg       string  `json:"err_msg"`
-	TradeNo      string  `json:"trade_no"`      //支付宝订单号
-	OutTradeNo   string  `json:"out_trade_no"`  //商户订单号
-	TotalAmount  float64 `json:"total_amount"`  //该笔退款所对应的交易的订单金额
-	RefundAmount float64 `json:"refund_amount"` //本次退款请求，对应的退款金额
+	ErrCode      int    `json:"err_code"`
+	ErrMsg       string `json:"err_msg"`
+	Retryable    bool   `json:"retryable"`     //可用相同参数重试
+	TradeNo      string `json:"trade_no"`      //支付宝订单号
+	OutTradeNo   string `json:"out_trade_no"`  //商户订单号
+	TotalAmount  Money  `json:"total_amount"`  //该笔退款所对应的交易的订单金额(分)
+	RefundAmount Money  `json:"refund_amount"` //本次退款请求，对应的退款金额(分)
+}
+
+//支付宝查询订单返回,字段与微信查询订单返回一致
+type RetAliPayQueryTrade struct {
+	ErrCode        int    `json:"err_code"`
+	ErrMsg         string `json:"err_msg"`
+	Retryable      bool   `json:"retryable"`        //可用相同参数重试
+	BuyerLogonId   string `json:"buyer_logon_id"`   //买家支付宝账号
+	BuyerUserId    string `json:"buyer_user_id"`    //买家支付宝用户号
+	TradeStatus    string `json:"trade_state"`      //交易状态(CREATED,USERPAYING,PAID,CLOSED等统一订单状态)
+	AliTradeStatus string `json:"ali_trade_status"` //支付宝交易状态(WAIT_BUYER_PAY,TRADE_CLOSED,TRADE_SUCCESS,TRADE_FINISHED)
+	TransactionId  string `json:"transaction_id"`   //支付宝交易号
+	OutTradeNo     string `json:"out_trade_no"`     //商户订单号
+	TimeEnd        string `json:"time_end"`         //支付完成时间
+	TotalFee       Money  `json:"total_fee"`        //订单金额(分)
+	CashFee        Money  `json:"cash_fee"`         //买家实付金额(分)
+}
+
+//支付宝撤销订单返回
+type RetAliPayCancel struct {
+	ErrCode    int    `json:"err_code"`
+	ErrMsg     string `json:"err_msg"`
+	Retryable  bool   `json:"retryable"`    //可用相同参数重试
+	TradeNo    string `json:"trade_no"`     //支付宝交易号
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	RetryFlag  string `json:"retry_flag"`   //是否需要重试(Y,N)
+	Action     string `json:"action"`       //撤销触发的动作(close-关闭交易,refund-产生了退款)
+}
+
+//支付宝关闭订单返回
+type RetAliPayClose struct {
+	ErrCode    int    `json:"err_code"`
+	ErrMsg     string `json:"err_msg"`
+	Retryable  bool   `json:"retryable"`    //可用相同参数重试
+	TradeNo    string `json:"trade_no"`     //支付宝交易号
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+}
+
+//下载对账单返回
+type RetDownloadBill struct {
+	ErrCode   int    `json:"err_code"`
+	ErrMsg    string `json:"err_msg"`
+	Retryable bool   `json:"retryable"` //可用相同参数重试
+	BillType  string `json:"bill_type"` //账单类型
+	BillDate  string `json:"bill_date"` //账单日期
+	Count     int    `json:"count"`     //记录数
 }
 
 //交易异步通知
 type NotifyInfo struct {
-	ErrCode       int     `json:"err_code"`
-	ErrMsg        string  `json:"err_msg"`
-	NotifyTime    string  `json:"notify_time"`    //通知时间
-	NotifyType    string  `json:"notify_type"`    //通知类型
-	NotifyId      string  `json:"notify_id"`      //通知校验ID
-	TradeNo       string  `json:"trade_no"`       //支付宝交易号
-	AppId         string  `json:"app_id"`         //开发者的app_id
-	OutTradeNo    string  `json:"out_trade_no"`   //商户订单号
-	BuyerLogonId  string  `json:"buyer_logon_id"` //买家支付宝账号
-	TradeStatus   string  `json:"trade_status"`   //交易状态(WAIT_BUYER_PAY-交易创建,TRADE_CLOSED-关闭,TRADE_SUCCESS-完成,TRADE_FINISHED-交易结束,不可退款)
-	TotalAmount   float64 `json:"total_amount"`   //订单金额
-	ReceiptAmount float64 `json:"receipt_amount"` //实收金额
-	RefundFee     float64 `json:"refund_fee,omitempty"`
+	ErrCode       int    `json:"err_code"`
+	ErrMsg        string `json:"err_msg"`
+	Retryable     bool   `json:"retryable"`           //可用相同参数重试
+	NotifyTime    string `json:"notify_time"`         //通知时间
+	NotifyType    string `json:"notify_type"`         //通知类型
+	NotifyId      string `json:"notify_id"`           //通知校验ID
+	TradeNo       string `json:"trade_no"`            //支付宝交易号
+	AppId         string `json:"app_id"`              //开发者的app_id
+	SellerId      string `json:"seller_id"`           //卖家支付宝用户号
+	OutTradeNo    string `json:"out_trade_no"`        //商户订单号
+	BuyerLogonId  string `json:"buyer_logon_id"`      //买家支付宝账号
+	TradeStatus   string `json:"trade_status"`        //交易状态(WAIT_BUYER_PAY-交易创建,TRADE_CLOSED-关闭,TRADE_SUCCESS-完成,TRADE_FINISHED-交易结束,不可退款)
+	TotalAmount   Money  `json:"total_amount"`        //订单金额(分)
+	ReceiptAmount Money  `json:"receipt_amount"`      //实收金额(分)
+	RefundFee     Money  `json:"refund_fee"`          //退款金额(分),退款通知时使用
+	Duplicate     bool   `json:"duplicate,omitempty"` //重复通知,已处理过
 }
 
-var aliPayPublicKey string //支付宝平台公钥。是用签验平台返回和回调数据
+var (
+	aliClients  = make(map[string]*AliPayGateway)         //商户的支付宝支付渠道
+	aliGateways = make(map[string]gateway.PaymentGateway) //商户记录订单的支付宝支付渠道
+)
+
+//初始化商户的支付宝支付渠道,merchantId为空时为默认商户.appAuthToken不为空时以第三方应用身份代商户调用接口,
+//sellerId不为空时校验异步通知的卖家
+func Init(merchantId, appId, privateKey, publicKey, appAuthToken, sellerId string) {
+	if sellerId == EMPTY {
+		fmt.Println("alipay merchant", merchantId, "aliPaySellerId not configured, notifies will be rejected")
+	}
+	aliClients[merchantId] = NewGateway(appId, privateKey, publicKey, appAuthToken, sellerId)
+	aliGateways[merchantId] = store.Track(merchantId, gateway.ALIPAY, aliClients[merchantId])
+	bill.Register(merchantId, gateway.ALIPAY, aliClients[merchantId])
+}
+
+//获取商户的支付宝支付渠道
+func Gateway(merchantId string) (g gateway.PaymentGateway, ok bool) {
+	g, ok = aliGateways[merchantId]
+	return
+}
 
-func Init(appId, privateKey, publicKey string) {
-	aliPay = alipay.AliPayLib{AppId: appId, PrivateKey: privateKey, PublicKey: publicKey}
-	aliPayPublicKey = publicKey
+//获取商户记录订单的支付宝支付渠道,商户不存在时返回错误
+func gatewayOf(merchantId string, c *gin.Context) (g gateway.PaymentGateway, ok bool) {
+	if g, ok = aliGateways[merchantId]; !ok {
+		gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+	}
+	return
 }
 
 //支付宝支付码交易
 func AliPayMicroPay(c *gin.Context) {
-	if jsonData, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, AUTH_CODE, TOTAL_FEE); err == nil {
-		var reqData alipay.ScanDealInfo
-		json_lib.JsonToObject(string(jsonData), &reqData)
-		reqData.Subject = reqData.Body
-		reqData.TotalFee = mapData[TOTAL_FEE].(float64) / float64(100)
-		if info, err := aliPay.ScanCodePay(reqData); err == nil {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, AUTH_CODE, TOTAL_FEE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[TOTAL_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_MICRO, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			AuthCode: mapData[AUTH_CODE].(string), TotalFee: totalFee}
+		info, err := g.CreateOrder(req)
+		poller.AfterMicroPay(merchantId, gateway.ALIPAY, req.TradeNo, info, err)
+		if err == nil {
 			var retInfo RetAliPayMicroPay
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = aliPay.AnalysisReturn(info.RetAliPayBase)
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.ErrCode, retInfo.ErrMsg, retInfo.Retryable = info.ErrCode, info.ErrMsg, info.Retryable
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//支付宝预下单,返回商户展示的支付二维码.可选参数timeout_express
+func AliPayPreCreate(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, TOTAL_FEE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[TOTAL_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_NATIVE, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		if info, err := g.CreateOrder(req); err == nil {
+			retInfo := RetAliPayPreCreate{ErrCode: info.ErrCode, ErrMsg: info.ErrMsg, Retryable: info.Retryable, OutTradeNo: req.TradeNo, QrCode: info.CodeUrl}
 			c.JSON(HTTP_SUCCESS, retInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//支付宝APP支付,返回签名后的订单信息.可选参数timeout_express,passback_params
+func AliPayAppPay(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, TOTAL_FEE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		req, err := payRequestOf(gateway.TRADE_APP, mapData)
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		if info, err := g.CreateOrder(req); err == nil {
+			orderStr, _ := info.PayParams.(string)
+			c.JSON(HTTP_SUCCESS, RetAliPayAppPay{ErrCode: info.ErrCode, ErrMsg: info.ErrMsg, Retryable: info.Retryable, OutTradeNo: req.TradeNo, OrderStr: orderStr})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//支付宝电脑网站支付,返回自动提交的支付表单页面.可选参数timeout_express,passback_params,return_url
+func AliPayPagePay(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, TOTAL_FEE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		req, err := payRequestOf(gateway.TRADE_PAGE, mapData)
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		if info, err := g.CreateOrder(req); err == nil {
+			c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(info.PayPage))
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//APP支付,电脑网站支付请求,金额不是非负整数时返回ErrMoney
+func payRequestOf(tradeType string, mapData map[string]interface{}) (req gateway.OrderRequest, err error) {
+	var totalFee Money
+	if totalFee, err = ParseMoney(mapData[TOTAL_FEE]); err != nil {
+		return
+	}
+	req = gateway.OrderRequest{TradeType: tradeType, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+		NotifyUrl: mapData[NOTIFY_URL].(string), TotalFee: totalFee}
+	req.Timeout, _ = mapData[TIMEOUT].(string)
+	req.Passback, _ = mapData[PASSBACK].(string)
+	req.ReturnUrl, _ = mapData[RETURN_URL].(string)
+	return
+}
+
+//支付宝查询订单,out_trade_no为商户订单号,trade_no为支付宝交易号,至少传一个
+func AliPayQueryTrade(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		outTradeNo, _ := mapData[OUT_TRADE_NO].(string)
+		aliTradeNo, _ := mapData[TRADE_NO].(string)
+		var info gateway.QueryResult
+		switch {
+		case outTradeNo != EMPTY:
+			info, err = g.Query(outTradeNo)
+		case aliTradeNo != EMPTY:
+			//只有支付宝交易号时先查出商户订单号,再按商户订单号经过订单记录查询
+			if info, err = aliClients[merchantId].queryTrade(aliTradeNo, EMPTY); err == nil && info.ErrCode == 0 && info.TradeNo != EMPTY {
+				info, err = g.Query(info.TradeNo)
+			}
+		default:
+			gateway.ReturnError(ERR_LACK_PARAM, "缺少参数:"+OUT_TRADE_NO+" 或 "+TRADE_NO, c)
+			return
+		}
+		if err == nil {
+			retInfo := RetAliPayQueryTrade{ErrCode: info.ErrCode, ErrMsg: info.ErrMsg, Retryable: info.Retryable, OutTradeNo: info.TradeNo,
+				TransactionId: info.TransactionId, TradeStatus: gateway.StatusOf(info.TradeState), AliTradeStatus: info.TradeState,
+				TotalFee: info.TotalFee}
+			if raw, ok := info.Raw.(aliTradeQuery); ok {
+				retInfo.BuyerLogonId = raw.BuyerLogonId
+				retInfo.BuyerUserId = raw.BuyerUserId
+				retInfo.TimeEnd = raw.SendPayDate
+				if retInfo.CashFee, err = feeOf(raw.BuyerPayAmount); err != nil {
+					gateway.ReturnGatewayError(err, c)
+					return
+				}
+			}
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//支付宝撤销订单,用于超时未确认的付款码订单
+func AliPayCancel(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, OUT_TRADE_NO); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		if info, err := g.Reverse(mapData[OUT_TRADE_NO].(string)); err == nil {
+			var retInfo RetAliPayCancel
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.ErrCode, retInfo.ErrMsg, retInfo.Retryable = info.ErrCode, info.ErrMsg, info.Retryable
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//支付宝关闭订单,用于未付款的扫码,手机网页订单
+func AliPayClose(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, OUT_TRADE_NO); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		if info, err := g.Close(mapData[OUT_TRADE_NO].(string)); err == nil {
+			var retInfo RetAliPayClose
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.ErrCode, retInfo.ErrMsg, retInfo.Retryable = info.ErrCode, info.ErrMsg, info.Retryable
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
@@ -91,53 +358,99 @@ func AliPayMicroPay(c *gin.Context) {
 //支付宝退款
 func AliPayRefund(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO, OUT_REFUND_NO, REFUND_FEE); err == nil {
-		if info, err := aliPay.Refund(mapData[TRADE_NO].(string), mapData[OUT_REFUND_NO].(string), mapData[REFUND_FEE].(float64)/100); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		refundFee, err := ParseMoney(mapData[REFUND_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.RefundRequest{TradeNo: mapData[TRADE_NO].(string), OutRefundNo: mapData[OUT_REFUND_NO].(string),
+			RefundFee: refundFee}
+		if info, err := g.Refund(req); err == nil {
 			var retInfo RetAliPayRefund
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = aliPay.AnalysisReturn(info.RetAliPayBase)
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.ErrCode, retInfo.ErrMsg, retInfo.Retryable = info.ErrCode, info.ErrMsg, info.Retryable
 			c.JSON(HTTP_SUCCESS, retInfo)
 			return
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
 
-func AliH5Payment(dealInfo alipay.DealBaseInfo) (respBody string, err error) {
-	respBody, err = aliPay.H5Pay(dealInfo)
-	return
-}
-
 //支付宝退款查询
 func AliPayQueryRefund(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO, OUT_REFUND_NO); err == nil {
-		if info, err := aliPay.QueryRefund(mapData[TRADE_NO].(string), mapData[OUT_REFUND_NO].(string)); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		g, ok := gatewayOf(merchantId, c)
+		if !ok {
+			return
+		}
+		if info, err := g.QueryRefund(mapData[TRADE_NO].(string), mapData[OUT_REFUND_NO].(string)); err == nil {
 			var retInfo RetAliPayQueryRefund
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = aliPay.AnalysisReturn(info.RetAliPayBase)
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.ErrCode, retInfo.ErrMsg, retInfo.Retryable = info.ErrCode, info.ErrMsg, info.Retryable
 			c.JSON(HTTP_SUCCESS, retInfo)
 			return
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//下载支付宝对账单并保存,bill_type为trade或signcustomer,bill_date为yyyy-MM-dd或yyyy-MM
+func AliPayDownloadBill(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BILL_TYPE, BILL_DATE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		if _, ok := gatewayOf(merchantId, c); !ok {
+			return
+		}
+		billType, billDate := mapData[BILL_TYPE].(string), mapData[BILL_DATE].(string)
+		if bills, err := bill.Download(merchantId, gateway.ALIPAY, billType, billDate); err == nil {
+			c.JSON(HTTP_SUCCESS, RetDownloadBill{BillType: billType, BillDate: billDate, Count: len(bills)})
+		} else {
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
 
-//支付宝验签
+//支付宝验签,商户由url参数merchant_id指定
 func AliPayVerifySign(c *gin.Context) {
+	g, ok := gatewayOf(c.Query(MERCHANT_ID), c)
+	if !ok {
+		return
+	}
 	if body, err := c.GetRawData(); err == nil {
-		if b, notifyInfo := VerifySign(string(body)); b {
+		if info, err := g.VerifyNotify(string(body)); err == nil {
+			notifyInfo, _ := info.Raw.(NotifyInfo)
+			notifyInfo.Duplicate = info.Duplicate
 			c.JSON(HTTP_SUCCESS, notifyInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_VERIFY_SIGN, MSG_VERIFY_SIGN, c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	} else {
-		gin_check.SimpleReturn(ERR_INVALID_PARAM, MSG_IVALID_PARAM, c)
+		gateway.ReturnError(ERR_INVALID_PARAM, MSG_IVALID_PARAM, c)
+	}
+}
+
+//商户的支付宝异步通知验签,同时检查金额和商户并更新本地订单,重复通知的Duplicate为true
+func VerifySign(merchantId, body string) (ret bool, notifyInfo NotifyInfo) {
+	if g, ok := aliGateways[merchantId]; ok {
+		if info, err := g.VerifyNotify(body); err == nil {
+			notifyInfo, _ = info.Raw.(NotifyInfo)
+			notifyInfo.Duplicate = info.Duplicate
+			ret = true
+		}
 	}
+	return
 }
 
 //支付宝异步通知验签
-func VerifySign(body string) (ret bool, notifyInfo NotifyInfo) {
+func (g *AliPayGateway) verifySign(body string) (ret bool, notifyInfo NotifyInfo) {
 	data, err := http_lib.GetUrlParams("http://127.0.0.1?" + body)
 	if err == nil {
 		sign := data["sign"]
@@ -147,20 +460,29 @@ func VerifySign(body string) (ret bool, notifyInfo NotifyInfo) {
 		for k := range data {
 			keys = append(keys, k)
 		}
+		if len(keys) == 0 {
+			//只有签名没有通知内容
+			return
+		}
 		sort.Strings(keys)
 		var waitSign = ""
 		for i := 0; i < len(keys); i++ {
 			waitSign += keys[i] + "=" + data[keys[i]] + "&"
 		}
 		waitSign = waitSign[0 : len(waitSign)-1]
-		ret, err = crypto.VerifyRas2Sign(waitSign, sign, aliPayPublicKey)
+		ret, err = crypto.VerifyRas2Sign(waitSign, sign, g.publicKey)
 		if ret {
-			json_lib.ObjectToObject(&notifyInfo, data)
-			number_lib.StrToFloat(data["total_amount"], &notifyInfo.TotalAmount)
-			number_lib.StrToFloat(data["receipt_amount"], &notifyInfo.ReceiptAmount)
-			if data["refund_fee"] != "" {
-				number_lib.StrToFloat(data["refund_fee"], &notifyInfo.RefundFee)
+			//金额为元,单独按十进制转为分,格式错误的通知不接受
+			fees, e := feesOf(data["total_amount"], data["receipt_amount"], data["refund_fee"])
+			if e != nil {
+				ret = false
+				return
+			}
+			for _, k := range []string{"total_amount", "receipt_amount", "refund_fee"} {
+				delete(data, k)
 			}
+			json_lib.ObjectToObject(&notifyInfo, data)
+			notifyInfo.TotalAmount, notifyInfo.ReceiptAmount, notifyInfo.RefundFee = fees[0], fees[1], fees[2]
 		}
 	}
 	return
@@ -0,0 +1,252 @@
+package ali_payment
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"pay_service/module/bill"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"strings"
+)
+
+//支付宝账单类型
+const (
+	BILL_TRADE        = "trade"        //业务明细,商户基于支付宝交易收单的业务账单
+	BILL_SIGNCUSTOMER = "signcustomer" //账务明细,基于商户支付宝余额收入及支出等资金变动的账务账单
+)
+
+var (
+	errBillType  = errors.New("无效的参数:" + BILL_TYPE)
+	errBillEmpty = errors.New("alipay bill detail file not found")
+)
+
+//支付宝业务明细记录
+type AliTradeBill struct {
+	TradeNo      string `json:"trade_no"`      //支付宝交易号
+	OutTradeNo   string `json:"out_trade_no"`  //商户订单号
+	BizType      string `json:"biz_type"`      //业务类型(交易,退款)
+	Subject      string `json:"subject"`       //商品名称
+	CreateTime   string `json:"create_time"`   //创建时间
+	FinishTime   string `json:"finish_time"`   //完成时间
+	StoreId      string `json:"store_id"`      //门店编号
+	StoreName    string `json:"store_name"`    //门店名称
+	Operator     string `json:"operator"`      //操作员
+	TerminalId   string `json:"terminal_id"`   //终端号
+	BuyerAccount string `json:"buyer_account"` //对方账户
+	TotalFee     Money  `json:"total_fee"`     //订单金额(分)
+	ReceiptFee   Money  `json:"receipt_fee"`   //商家实收(分)
+	RefundNo     string `json:"refund_no"`     //退款批次号/请求号
+	ServiceFee   Money  `json:"service_fee"`   //服务费(分)
+	Remark       string `json:"remark"`        //备注
+}
+
+//支付宝账务明细记录
+type AliAccountBill struct {
+	AccountSeq  string `json:"account_seq"`  //账务流水号
+	BizSeq      string `json:"biz_seq"`      //业务流水号
+	OutTradeNo  string `json:"out_trade_no"` //商户订单号
+	Subject     string `json:"subject"`      //商品名称
+	OccurTime   string `json:"occur_time"`   //发生时间
+	PeerAccount string `json:"peer_account"` //对方账号
+	Income      Money  `json:"income"`       //收入金额(分)
+	Outcome     Money  `json:"outcome"`      //支出金额(分)
+	Balance     Money  `json:"balance"`      //账户余额(分)
+	TradeChan   string `json:"trade_chan"`   //交易渠道
+	BizType     string `json:"biz_type"`     //业务类型
+	Remark      string `json:"remark"`       //备注
+}
+
+//账单下载地址查询返回
+type aliBillDownloadUrl struct {
+	openapiResponse
+	BillDownloadUrl string `json:"bill_download_url"` //账单下载地址,30秒内有效
+}
+
+//下载并解析对账单,billType为trade或signcustomer,billDate为yyyy-MM-dd(日账单)或yyyy-MM(月账单)
+func (g *AliPayGateway) DownloadBill(billType, billDate string) (bills []store.Bill, err error) {
+	if billType != BILL_TRADE && billType != BILL_SIGNCUSTOMER {
+		err = errBillType
+		return
+	}
+	var info aliBillDownloadUrl
+	if err = g.execute("alipay.data.dataservice.bill.downloadurl.query",
+		map[string]string{"bill_type": billType, "bill_date": billDate}, nil, &info); err != nil {
+		return
+	}
+	if r := g.analysis(info.openapiResponse); r.ErrCode != 0 {
+		err = gateway.NewError(r.ErrCode, r.ErrMsg)
+		return
+	}
+	var content []byte
+	if content, err = downloadBillDetail(info.BillDownloadUrl); err != nil {
+		return
+	}
+	if billType == BILL_TRADE {
+		var list []AliTradeBill
+		if list, err = ParseTradeBill(content); err == nil {
+			for _, r := range list {
+				bills = append(bills, r.bill())
+			}
+		}
+	} else {
+		var list []AliAccountBill
+		if list, err = ParseAccountBill(content); err == nil {
+			for _, r := range list {
+				bills = append(bills, r.bill())
+			}
+		}
+	}
+	return
+}
+
+//下载zip账单,返回GBK转码后的明细文件内容(不含汇总文件)
+func downloadBillDetail(url string) (content []byte, err error) {
+	var resp *http.Response
+	if resp, err = openapiClient.Get(url); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var buff []byte
+	if buff, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	var reader *zip.Reader
+	if reader, err = zip.NewReader(bytes.NewReader(buff), int64(len(buff))); err != nil {
+		return
+	}
+	for _, f := range reader.File {
+		name := f.Name
+		if f.NonUTF8 {
+			name, _ = simplifiedchinese.GBK.NewDecoder().String(name)
+		}
+		if strings.Contains(name, "汇总") || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		var rc io.ReadCloser
+		if rc, err = f.Open(); err != nil {
+			return
+		}
+		buff, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return
+		}
+		content, err = simplifiedchinese.GBK.NewDecoder().Bytes(buff)
+		return
+	}
+	err = errBillEmpty
+	return
+}
+
+//解析业务明细,content为转码后的明细文件内容
+func ParseTradeBill(content []byte) (list []AliTradeBill, err error) {
+	var t bill.Table
+	if t, err = parseBillTable(content); err != nil {
+		return
+	}
+	for i, row := range t.Rows {
+		var fees []Money
+		if fees, err = t.Fees(row, "订单金额", "商家实收", "服务费"); err != nil {
+			err = fmt.Errorf("alipay trade bill line %d: %v", i+1, err)
+			return
+		}
+		list = append(list, AliTradeBill{
+			TradeNo:      t.Get(row, "支付宝交易号"),
+			OutTradeNo:   t.Get(row, "商户订单号"),
+			BizType:      t.Get(row, "业务类型"),
+			Subject:      t.Get(row, "商品名称"),
+			CreateTime:   t.Get(row, "创建时间"),
+			FinishTime:   t.Get(row, "完成时间"),
+			StoreId:      t.Get(row, "门店编号"),
+			StoreName:    t.Get(row, "门店名称"),
+			Operator:     t.Get(row, "操作员"),
+			TerminalId:   t.Get(row, "终端号"),
+			BuyerAccount: t.Get(row, "对方账户"),
+			TotalFee:     fees[0],
+			ReceiptFee:   fees[1],
+			RefundNo:     t.Get(row, "退款批次号"),
+			ServiceFee:   fees[2],
+			Remark:       t.Get(row, "备注"),
+		})
+	}
+	return
+}
+
+//解析账务明细,content为转码后的明细文件内容
+func ParseAccountBill(content []byte) (list []AliAccountBill, err error) {
+	var t bill.Table
+	if t, err = parseBillTable(content); err != nil {
+		return
+	}
+	for i, row := range t.Rows {
+		var fees []Money
+		if fees, err = t.Fees(row, "收入金额", "支出金额", "账户余额"); err != nil {
+			err = fmt.Errorf("alipay account bill line %d: %v", i+1, err)
+			return
+		}
+		list = append(list, AliAccountBill{
+			AccountSeq:  t.Get(row, "账务流水号"),
+			BizSeq:      t.Get(row, "业务流水号"),
+			OutTradeNo:  t.Get(row, "商户订单号"),
+			Subject:     t.Get(row, "商品名称"),
+			OccurTime:   t.Get(row, "发生时间"),
+			PeerAccount: t.Get(row, "对方账号"),
+			Income:      fees[0],
+			Outcome:     fees[1],
+			Balance:     fees[2],
+			TradeChan:   t.Get(row, "交易渠道"),
+			BizType:     t.Get(row, "业务类型"),
+			Remark:      t.Get(row, "备注"),
+		})
+	}
+	return
+}
+
+//业务明细转为对账单记录,退款记录的金额取退款金额
+func (r AliTradeBill) bill() (b store.Bill) {
+	b = store.Bill{TradeNo: r.OutTradeNo, TransactionId: r.TradeNo, Kind: r.BizType, Amount: r.TotalFee, Fee: r.ServiceFee,
+		TradeTime: r.FinishTime}
+	switch r.BizType {
+	case "交易":
+		b.Kind = BILL_PAY
+	case "退款":
+		b.Kind = BILL_REFUND
+		b.OutRefundNo = r.RefundNo
+		//退款记录的订单金额和商家实收为负数,订单金额不为负数时取商家实收
+		if b.Amount = Fen(-r.TotalFee.Amount); b.Amount.Amount <= 0 {
+			b.Amount = Fen(-r.ReceiptFee.Amount)
+		}
+	}
+	raw, _ := json.Marshal(r)
+	b.Raw = string(raw)
+	return
+}
+
+//账务明细转为对账单记录,金额为收入减支出.支出金额列为负数,按绝对值扣减
+func (r AliAccountBill) bill() (b store.Bill) {
+	outcome := r.Outcome.Amount
+	if outcome < 0 {
+		outcome = -outcome
+	}
+	b = store.Bill{TradeNo: r.OutTradeNo, TransactionId: r.BizSeq, Kind: r.BizType, Amount: Fen(r.Income.Amount - outcome), TradeTime: r.OccurTime}
+	raw, _ := json.Marshal(r)
+	b.Raw = string(raw)
+	return
+}
+
+//解析明细文件,#开头的行为说明和汇总,第一个非#行为表头
+func parseBillTable(content []byte) (t bill.Table, err error) {
+	var tables []bill.Table
+	if tables, err = bill.ParseTables(content, EMPTY); err == nil && len(tables) > 0 {
+		t = tables[0]
+	}
+	return
+}
@@ -0,0 +1,63 @@
+package ali_payment
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "pay_service/module/comm"
+	"testing"
+)
+
+func TestParseTradeBill(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/trade_bill.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := ParseTradeBill(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d records, want 2", len(list))
+	}
+	r := list[0]
+	if r.TradeNo != "2019010122001400000001" || r.OutTradeNo != "T001" || r.BizType != "交易" || r.FinishTime != "2019-01-01 10:00:05" ||
+		r.TotalFee.Amount != 100 || r.ReceiptFee.Amount != 100 || r.ServiceFee.Amount != -1 {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if r := list[1]; r.RefundNo != "R001" || r.TotalFee.Amount != -50 {
+		t.Errorf("record 1 = %+v", r)
+	}
+	if b := list[0].bill(); b.Kind != BILL_PAY || b.TradeNo != "T001" || b.TransactionId != r.TradeNo || b.Amount.Amount != 100 {
+		t.Errorf("pay bill = %+v", b)
+	}
+	if b := list[1].bill(); b.Kind != BILL_REFUND || b.OutRefundNo != "R001" || b.Amount.Amount != 50 {
+		t.Errorf("refund bill = %+v", b)
+	}
+	if _, err = ParseTradeBill(bytes.Replace(content, []byte(",1.00\t,1.00"), []byte(",1.001\t,1.00"), 1)); err == nil {
+		t.Error("invalid amount: want error")
+	}
+}
+
+func TestParseAccountBill(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/account_bill.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := ParseAccountBill(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d records, want 2", len(list))
+	}
+	if r := list[0]; r.AccountSeq != "20190101001" || r.OutTradeNo != "T001" || r.Income.Amount != 100 || r.Balance.Amount != 100 ||
+		r.BizType != "在线支付" {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if b := list[0].bill(); b.Amount.Amount != 100 {
+		t.Errorf("income bill = %+v", b)
+	}
+	if b := list[1].bill(); b.Amount.Amount != -1 || b.Kind != "交易服务费" {
+		t.Errorf("outcome bill = %+v", b)
+	}
+}
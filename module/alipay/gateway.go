@@ -0,0 +1,313 @@
+package ali_payment
+
+import (
+	"encoding/json"
+	"net/url"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"utils/alipay"
+	"utils/data_conv/json_lib"
+)
+
+//支付宝支付渠道,实现gateway.PaymentGateway
+type AliPayGateway struct {
+	pay        alipay.AliPayLib //支付宝支付对像
+	appId      string           //支付宝appId
+	privateKey string           //商户私钥,用于签名开放平台请求
+	publicKey  string           //支付宝平台公钥,用于验签平台返回和回调数据
+	authToken  string           //第三方应用授权令牌(app_auth_token),代子商户调用接口
+	sellerId   string           //卖家账号ID(PID),校验异步通知的seller_id
+}
+
+//appAuthToken不为空时为第三方应用模式,appId和密钥为第三方应用的配置
+func NewGateway(appId, privateKey, publicKey, appAuthToken, sellerId string) *AliPayGateway {
+	return &AliPayGateway{
+		pay:        alipay.AliPayLib{AppId: appId, PrivateKey: privateKey, PublicKey: publicKey},
+		appId:      appId,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		authToken:  appAuthToken,
+		sellerId:   sellerId,
+	}
+}
+
+//支付宝交易查询返回
+type aliTradeQuery struct {
+	openapiResponse
+	TradeNo        string `json:"trade_no"`         //支付宝交易号
+	OutTradeNo     string `json:"out_trade_no"`     //商户订单号
+	BuyerLogonId   string `json:"buyer_logon_id"`   //买家支付宝账号
+	BuyerUserId    string `json:"buyer_user_id"`    //买家支付宝用户号
+	TradeStatus    string `json:"trade_status"`     //交易状态(WAIT_BUYER_PAY,TRADE_CLOSED,TRADE_SUCCESS,TRADE_FINISHED)
+	TotalAmount    string `json:"total_amount"`     //订单金额(元)
+	ReceiptAmount  string `json:"receipt_amount"`   //实收金额(元)
+	BuyerPayAmount string `json:"buyer_pay_amount"` //买家实付金额(元)
+	SendPayDate    string `json:"send_pay_date"`    //打款给卖家的时间
+}
+
+//支付宝预下单返回
+type aliTradePreCreate struct {
+	openapiResponse
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	QrCode     string `json:"qr_code"`      //二维码链接
+}
+
+//支付宝撤销交易返回
+type aliTradeCancel struct {
+	openapiResponse
+	TradeNo    string `json:"trade_no"`     //支付宝交易号
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	RetryFlag  string `json:"retry_flag"`   //是否需要重试(Y,N)
+	Action     string `json:"action"`       //撤销触发的动作(close-关闭交易,refund-产生了退款)
+}
+
+//支付宝关闭交易返回
+type aliTradeClose struct {
+	openapiResponse
+	TradeNo    string `json:"trade_no"`     //支付宝交易号
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+}
+
+//支付库退款,退款查询返回,支付库中金额为数字(元)
+type aliLibRefund struct {
+	openapiResponse
+	TradeNo      string      `json:"trade_no"`      //支付宝交易号
+	RefundFee    json.Number `json:"refund_fee"`    //退款总金额(元)
+	EndTime      string      `json:"gmt_payment"`   //退款支付时间
+	TotalAmount  json.Number `json:"total_amount"`  //交易金额(元)
+	RefundAmount json.Number `json:"refund_amount"` //本次退款金额(元)
+}
+
+//支付宝返回码
+const (
+	CODE_SUCCESS           = "10000" //接口调用成功
+	CODE_WAIT_USER_PAY     = "10003" //等待用户付款
+	CODE_UNAVAILABLE       = "20000" //服务不可用
+	CODE_INSUFFICIENT_AUTH = "20001" //授权权限不足
+	CODE_MISSING_PARAM     = "40001" //缺少必选参数
+	CODE_INVALID_PARAM     = "40002" //非法的参数
+	CODE_NO_PERMISSION     = "40006" //权限不足
+)
+
+//下单,第三方应用模式下付款码和手机网页支付调用开放平台接口.支付库的手机网页支付不支持有效时间,指定了有效时间时也调用开放平台接口
+func (g *AliPayGateway) CreateOrder(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	if req.TradeType == gateway.TRADE_MICRO && g.authToken != EMPTY {
+		return g.tradePay(req)
+	}
+	if req.TradeType == gateway.TRADE_H5 && (g.authToken != EMPTY || req.Timeout != EMPTY) {
+		return g.wapPay(req)
+	}
+	param := map[string]interface{}{BODY: req.Body, TRADE_NO: req.TradeNo, AUTH_CODE: req.AuthCode}
+	switch req.TradeType {
+	case gateway.TRADE_MICRO:
+		var reqData alipay.ScanDealInfo
+		json_lib.ObjectToObject(&reqData, param)
+		reqData.Subject = reqData.Body
+		reqData.TotalFee = float64(req.TotalFee.Amount) / float64(100)
+		if info, e := g.pay.ScanCodePay(reqData); e == nil {
+			var micro aliTradePay
+			json_lib.ObjectToObject(&micro, info)
+			ret.Result = g.analysis(micro.openapiResponse)
+			ret.TransactionId = micro.TradeNo
+			switch micro.Code {
+			case CODE_SUCCESS:
+				ret.TradeState = "TRADE_SUCCESS"
+			case CODE_WAIT_USER_PAY:
+				ret.TradeState = "WAIT_BUYER_PAY"
+			}
+			var fees []Money
+			if fees, err = feesOf(micro.TotalAmount, micro.ReceiptAmount); err != nil {
+				return
+			}
+			ret.Raw = RetAliPayMicroPay{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: micro.TradeNo,
+				OutTradeNo: req.TradeNo, BuyerLogonId: micro.BuyerLogonId, TotalAmount: fees[0], ReceiptAmount: fees[1],
+				EndTime: micro.GmtPayment}
+		} else {
+			err = e
+		}
+	case gateway.TRADE_NATIVE:
+		var info aliTradePreCreate
+		biz := map[string]string{"out_trade_no": req.TradeNo, "total_amount": req.TotalFee.Yuan(), "subject": req.Body,
+			"body": req.Body}
+		if req.Timeout != EMPTY {
+			biz["timeout_express"] = req.Timeout
+		}
+		if err = g.execute("alipay.trade.precreate", biz, map[string]string{"notify_url": req.NotifyUrl}, &info); err == nil {
+			ret.Result = g.analysis(info.openapiResponse)
+			ret.CodeUrl = info.QrCode
+			ret.Raw = info
+		}
+	case gateway.TRADE_APP:
+		var values url.Values
+		if values, err = g.signedParams("alipay.trade.app.pay", payBizOf(req, "QUICK_MSECURITY_PAY"),
+			map[string]string{"notify_url": req.NotifyUrl}); err == nil {
+			ret.PayParams = values.Encode()
+			ret.Raw = ret.PayParams
+		}
+	case gateway.TRADE_PAGE:
+		var values url.Values
+		if values, err = g.signedParams("alipay.trade.page.pay", payBizOf(req, "FAST_INSTANT_TRADE_PAY"),
+			map[string]string{"notify_url": req.NotifyUrl, "return_url": req.ReturnUrl}); err == nil {
+			ret.PayPage = submitFormOf(values)
+			ret.Raw = ret.PayPage
+		}
+	case gateway.TRADE_H5:
+		var dealInfo alipay.DealBaseInfo
+		json_lib.ObjectToObject(&dealInfo, param)
+		dealInfo.Subject = dealInfo.Body
+		dealInfo.TotalFee = float64(req.TotalFee.Amount) / float64(100)
+		dealInfo.NotifyUrl = req.NotifyUrl
+		if ret.PayPage, err = g.pay.H5Pay(dealInfo); err == nil {
+			ret.Raw = ret.PayPage
+		}
+	default:
+		err = gateway.ErrNotSupport
+	}
+	return
+}
+
+//APP支付,电脑网站支付的业务参数
+func payBizOf(req gateway.OrderRequest, productCode string) (biz map[string]string) {
+	biz = map[string]string{"out_trade_no": req.TradeNo, "total_amount": req.TotalFee.Yuan(), "subject": req.Body,
+		"body": req.Body, "product_code": productCode}
+	if req.Timeout != EMPTY {
+		biz["timeout_express"] = req.Timeout
+	}
+	if req.Passback != EMPTY {
+		biz["passback_params"] = url.QueryEscape(req.Passback)
+	}
+	return
+}
+
+//查询订单
+func (g *AliPayGateway) Query(tradeNo string) (ret gateway.QueryResult, err error) {
+	return g.queryTrade(EMPTY, tradeNo)
+}
+
+//查询交易(alipay.trade.query),支付宝交易号和商户订单号至少传一个
+func (g *AliPayGateway) queryTrade(aliTradeNo, outTradeNo string) (ret gateway.QueryResult, err error) {
+	var info aliTradeQuery
+	biz := map[string]string{}
+	if aliTradeNo != EMPTY {
+		biz["trade_no"] = aliTradeNo
+	}
+	if outTradeNo != EMPTY {
+		biz["out_trade_no"] = outTradeNo
+	}
+	if err = g.execute("alipay.trade.query", biz, nil, &info); err != nil {
+		return
+	}
+	ret.Result = g.analysis(info.openapiResponse)
+	ret.TradeNo = info.OutTradeNo
+	if ret.TradeNo == EMPTY {
+		ret.TradeNo = outTradeNo
+	}
+	ret.TransactionId = info.TradeNo
+	ret.TradeState = info.TradeStatus
+	if ret.TotalFee, err = feeOf(info.TotalAmount); err != nil {
+		return
+	}
+	ret.Raw = info
+	return
+}
+
+//退款
+func (g *AliPayGateway) Refund(req gateway.RefundRequest) (ret gateway.RefundResult, err error) {
+	if g.authToken != EMPTY {
+		return g.tradeRefund(req)
+	}
+	if info, e := g.pay.Refund(req.TradeNo, req.OutRefundNo, float64(req.RefundFee.Amount)/100); e == nil {
+		var refund aliLibRefund
+		json_lib.ObjectToObject(&refund, info)
+		ret.Result = g.analysis(refund.openapiResponse)
+		ret.TradeNo = req.TradeNo
+		ret.OutRefundNo = req.OutRefundNo
+		ret.RefundFee = req.RefundFee
+		if ret.ErrCode == 0 {
+			ret.RefundStatus = REFUND_SUCCESS
+		}
+		var refundFee Money
+		if refundFee, err = feeOf(refund.RefundFee.String()); err != nil {
+			return
+		}
+		ret.Raw = RetAliPayRefund{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: refund.TradeNo,
+			OutTradeNo: req.TradeNo, RefundFee: refundFee, EndTime: refund.EndTime}
+	} else {
+		err = e
+	}
+	return
+}
+
+//查询退款
+func (g *AliPayGateway) QueryRefund(tradeNo, outRefundNo string) (ret gateway.RefundResult, err error) {
+	if g.authToken != EMPTY {
+		return g.refundQuery(tradeNo, outRefundNo)
+	}
+	if info, e := g.pay.QueryRefund(tradeNo, outRefundNo); e == nil {
+		var refund aliLibRefund
+		json_lib.ObjectToObject(&refund, info)
+		ret.Result = g.analysis(refund.openapiResponse)
+		ret.TradeNo = tradeNo
+		ret.OutRefundNo = outRefundNo
+		var fees []Money
+		if fees, err = feesOf(refund.RefundAmount.String(), refund.TotalAmount.String()); err != nil {
+			return
+		}
+		ret.RefundFee = fees[0]
+		ret.Raw = RetAliPayQueryRefund{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: refund.TradeNo,
+			OutTradeNo: tradeNo, TotalAmount: fees[1], RefundAmount: ret.RefundFee}
+	} else {
+		err = e
+	}
+	return
+}
+
+//关闭订单(alipay.trade.close),用于未付款的扫码,手机网页订单
+func (g *AliPayGateway) Close(tradeNo string) (ret gateway.Result, err error) {
+	var info aliTradeClose
+	if err = g.execute("alipay.trade.close", map[string]string{"out_trade_no": tradeNo}, nil, &info); err == nil {
+		ret = g.analysis(info.openapiResponse)
+		ret.Raw = info
+	}
+	return
+}
+
+//撤销订单(alipay.trade.cancel),用于超时的付款码订单,已付款时支付宝原路退款
+func (g *AliPayGateway) Reverse(tradeNo string) (ret gateway.Result, err error) {
+	var info aliTradeCancel
+	if err = g.execute("alipay.trade.cancel", map[string]string{"out_trade_no": tradeNo}, nil, &info); err == nil {
+		ret = g.analysis(info.openapiResponse)
+		ret.Raw = info
+	}
+	return
+}
+
+//异步通知验签,app_id不是本商户返回ErrNotifyAppId,seller_id不是本商户卖家账号ID返回ErrNotifySeller,
+//未配置卖家账号ID时不接受异步通知
+func (g *AliPayGateway) VerifyNotify(body string) (ret gateway.NotifyResult, err error) {
+	if b, info := g.verifySign(body); b {
+		if info.AppId != g.appId {
+			err = gateway.ErrNotifyAppId
+			return
+		}
+		if g.sellerId == EMPTY || info.SellerId != g.sellerId {
+			err = gateway.ErrNotifySeller
+			return
+		}
+		ret.NotifyType = gateway.NOTIFY_PAYMENT
+		ret.NotifyId = info.NotifyId
+		if info.RefundFee.Amount > 0 {
+			ret.NotifyType = gateway.NOTIFY_REFUND
+		}
+		ret.TradeNo = info.OutTradeNo
+		ret.TransactionId = info.TradeNo
+		ret.TradeState = info.TradeStatus
+		ret.TotalFee = info.TotalAmount
+		ret.RefundFee = info.RefundFee
+		ret.Raw = info
+	} else {
+		err = gateway.ErrVerifySign
+	}
+	return
+}
@@ -0,0 +1,278 @@
+package ali_payment
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"sort"
+	"strings"
+	"time"
+	"utils/alipay"
+	alicrypto "utils/crypto"
+	"utils/data_conv/json_lib"
+)
+
+//支付宝开放平台网关
+const OPENAPI_URL = "https://openapi.alipay.com/gateway.do"
+
+var (
+	errPrivateKey   = errors.New("invalid alipay private key")
+	errResponse     = errors.New("invalid alipay response")
+	errResponseSign = errors.New("alipay response verify sign fail")
+	openapiClient   = &http.Client{Timeout: 15 * time.Second}
+)
+
+//按开放平台公共参数签名后的请求参数,第三方应用模式下带上app_auth_token
+func (g *AliPayGateway) signedParams(method string, bizContent interface{}, extra map[string]string) (values url.Values, err error) {
+	var biz []byte
+	if biz, err = json.Marshal(bizContent); err != nil {
+		return
+	}
+	params := map[string]string{
+		"app_id":         g.appId,
+		"method":         method,
+		"format":         "JSON",
+		"charset":        "utf-8",
+		"sign_type":      "RSA2",
+		"timestamp":      time.Now().In(gateway.ChannelZone).Format("2006-01-02 15:04:05"), //开放平台按北京时间校验
+		"version":        "1.0",
+		"app_auth_token": g.authToken,
+		"biz_content":    string(biz),
+	}
+	for k, v := range extra {
+		if v != EMPTY {
+			params[k] = v
+		}
+	}
+	var sign string
+	if sign, err = rsa2Sign(waitSignOf(params), g.privateKey); err != nil {
+		return
+	}
+	values = url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	values.Set("sign", sign)
+	return
+}
+
+//调用开放平台接口,extra为notify_url等公共请求参数,验证返回签名后把接口返回内容解析到resp
+func (g *AliPayGateway) execute(method string, bizContent interface{}, extra map[string]string, resp interface{}) (err error) {
+	var values url.Values
+	if values, err = g.signedParams(method, bizContent, extra); err != nil {
+		return
+	}
+	var httpResp *http.Response
+	if httpResp, err = openapiClient.PostForm(OPENAPI_URL, values); err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	var body []byte
+	if body, err = ioutil.ReadAll(httpResp.Body); err != nil {
+		return
+	}
+	var data map[string]json.RawMessage
+	if err = json.Unmarshal(body, &data); err != nil {
+		return
+	}
+	node, ok := data[strings.Replace(method, ".", "_", -1)+"_response"]
+	errorResponse := !ok
+	if errorResponse {
+		if node, ok = data["error_response"]; !ok {
+			err = errResponse
+			return
+		}
+	}
+	//接口调用成功时返回内容带签名,只有网关错误可以不带签名
+	var sign string
+	json.Unmarshal(data["sign"], &sign)
+	if sign == EMPTY {
+		var base openapiResponse
+		if json.Unmarshal(node, &base) != nil || !unsignedAllowed(errorResponse, base.Code) {
+			err = errResponseSign
+			return
+		}
+	} else if b, _ := alicrypto.VerifyRas2Sign(string(node), sign, g.publicKey); !b {
+		err = errResponseSign
+		return
+	}
+	err = json.Unmarshal(node, resp)
+	return
+}
+
+//不带签名的返回只接受error_response和公共错误码,调用成功的返回码必须带签名
+func unsignedAllowed(errorResponse bool, code string) bool {
+	switch code {
+	case CODE_SUCCESS, CODE_WAIT_USER_PAY:
+		return false
+	case CODE_UNAVAILABLE, CODE_INSUFFICIENT_AUTH, CODE_MISSING_PARAM, CODE_INVALID_PARAM, CODE_NO_PERMISSION:
+		return true
+	}
+	return errorResponse
+}
+
+//自动提交到开放平台的表单页面,电脑网站支付时返回给浏览器
+func submitFormOf(values url.Values) string {
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	form := `<form id="alipaysubmit" name="alipaysubmit" action="` + OPENAPI_URL + `?charset=utf-8" method="POST">`
+	for _, k := range keys {
+		form += `<input type="hidden" name="` + html.EscapeString(k) + `" value="` + html.EscapeString(values.Get(k)) + `"/>`
+	}
+	form += `<input type="submit" value="ok" style="display:none;"/></form><script>document.forms['alipaysubmit'].submit();</script>`
+	return form
+}
+
+//待签名字符串,参数按名称排序后以key=value&key=value拼接,不含sign
+func waitSignOf(params map[string]string) string {
+	var keys []string
+	for k, v := range params {
+		if k != "sign" && v != EMPTY {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+params[k])
+	}
+	return strings.Join(pairs, "&")
+}
+
+//SHA256WithRSA签名,私钥支持PEM格式和不带头尾的base64格式(PKCS1,PKCS8)
+func rsa2Sign(data, privateKey string) (sign string, err error) {
+	var key *rsa.PrivateKey
+	if key, err = parsePrivateKey(privateKey); err != nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(data))
+	var b []byte
+	if b, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:]); err == nil {
+		sign = base64.StdEncoding.EncodeToString(b)
+	}
+	return
+}
+
+func parsePrivateKey(privateKey string) (key *rsa.PrivateKey, err error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(privateKey)); block != nil {
+		der = block.Bytes
+	} else if der, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(privateKey), EMPTY)); err != nil {
+		err = errPrivateKey
+		return
+	}
+	if key, err = x509.ParsePKCS1PrivateKey(der); err == nil {
+		return
+	}
+	var k interface{}
+	if k, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+		err = errPrivateKey
+		return
+	}
+	var ok bool
+	if key, ok = k.(*rsa.PrivateKey); !ok {
+		err = errPrivateKey
+	}
+	return
+}
+
+//开放平台接口返回公共信息
+type openapiResponse struct {
+	Code    string `json:"code"`     //网关返回码
+	Msg     string `json:"msg"`      //网关返回码描述
+	SubCode string `json:"sub_code"` //业务返回码
+	SubMsg  string `json:"sub_msg"`  //业务返回码描述
+}
+
+//返回码对应的统一错误码和错误信息,错误信息与支付库的接口返回解析一致
+func (g *AliPayGateway) analysis(r openapiResponse) (ret gateway.Result) {
+	var base alipay.RetAliPayBase
+	json_lib.ObjectToObject(&base, r)
+	if errCode, errMsg := g.pay.AnalysisReturn(base); errCode != 0 {
+		ret = gateway.ResultOf(errorCodeOf(r.Code, r.SubCode), errMsg)
+	}
+	return
+}
+
+//支付宝sub_code对应的统一错误码
+var aliErrorCodes = map[string]int{
+	"ACQ.SYSTEM_ERROR":                           ERR_SYSTEM,
+	"aop.ACQ.SYSTEM_ERROR":                       ERR_SYSTEM,
+	"isp.unknow-error":                           ERR_SYSTEM,
+	"ACQ.BUYER_BALANCE_NOT_ENOUGH":               ERR_BALANCE,
+	"ACQ.BUYER_BANKCARD_BALANCE_NOT_ENOUGH":      ERR_BALANCE,
+	"ACQ.SELLER_BALANCE_NOT_ENOUGH":              ERR_BALANCE,
+	"ACQ.TRADE_HAS_CLOSE":                        ERR_ORDER_CLOSED,
+	"ACQ.TRADE_HAS_SUCCESS":                      ERR_ORDER_PAID,
+	"ACQ.CONTEXT_INCONSISTENT":                   ERR_DUPLICATE_ORDER,
+	"ACQ.TRADE_NOT_EXIST":                        ERR_TRADE_NOT_EXIST,
+	"ACQ.TRADE_STATUS_ERROR":                     ERR_ORDER_STATE,
+	"ACQ.TRADE_HAS_FINISHED":                     ERR_ORDER_STATE,
+	"ACQ.TRADE_NOT_ALLOW_REFUND":                 ERR_ORDER_STATE,
+	"ACQ.REFUND_AMT_NOT_EQUAL_TOTAL":             ERR_REFUND_EXCEED,
+	"ACQ.PAYMENT_AUTH_CODE_INVALID":              ERR_AUTH_CODE,
+	"ACQ.BUYER_ENABLE_STATUS_FORBID":             ERR_BUYER,
+	"ACQ.BUYER_PAYMENT_AMOUNT_DAY_LIMIT_ERROR":   ERR_BUYER,
+	"ACQ.BUYER_PAYMENT_AMOUNT_MONTH_LIMIT_ERROR": ERR_BUYER,
+	"ACQ.ERROR_BUYER_CERTIFY_LEVEL_LIMIT":        ERR_BUYER,
+	"isv.invalid-signature":                      ERR_SIGN,
+	"ACQ.ACCESS_FORBIDDEN":                       ERR_PERMISSION,
+	"isv.insufficient-isv-permissions":           ERR_PERMISSION,
+	"isv.invalid-app-id":                         ERR_PERMISSION,
+	"aop.invalid-app-auth-token":                 ERR_PERMISSION,
+	"ACQ.INVALID_PARAMETER":                      ERR_INVALID_PARAM,
+	"ACQ.TOTAL_FEE_EXCEED":                       ERR_INVALID_PARAM,
+}
+
+//支付宝返回码对应的统一错误码,未知的sub_code按网关返回码归类
+func errorCodeOf(code, subCode string) int {
+	if errCode, ok := aliErrorCodes[subCode]; ok {
+		return errCode
+	}
+	switch {
+	case code == CODE_WAIT_USER_PAY:
+		return ERR_USER_PAYING
+	case code == CODE_UNAVAILABLE:
+		return ERR_SYSTEM
+	case code == CODE_INSUFFICIENT_AUTH || code == CODE_NO_PERMISSION:
+		return ERR_PERMISSION
+	case code == CODE_MISSING_PARAM || code == CODE_INVALID_PARAM || strings.HasPrefix(subCode, "isv.missing-") ||
+		strings.HasPrefix(subCode, "isv.invalid-"):
+		return ERR_INVALID_PARAM
+	}
+	return ERR_CALL_PARMENT
+}
+
+//金额(元)转为分,支持负数,按十进制精确转换,为空时为0,格式错误时返回ErrYuan
+func feeOf(amount string) (fee Money, err error) {
+	if amount != EMPTY {
+		fee, err = ParseYuan(amount)
+	}
+	return
+}
+
+//依次转换多个金额(元),任一格式错误时返回错误
+func feesOf(amounts ...string) (fees []Money, err error) {
+	fees = make([]Money, len(amounts))
+	for i, amount := range amounts {
+		if fees[i], err = feeOf(amount); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package ali_payment
+
+import (
+	"net/url"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+)
+
+//支付宝统一收单交易支付返回
+type aliTradePay struct {
+	openapiResponse
+	TradeNo       string `json:"trade_no"`       //支付宝交易号
+	OutTradeNo    string `json:"out_trade_no"`   //商户订单号
+	BuyerLogonId  string `json:"buyer_logon_id"` //买家支付宝账号
+	TotalAmount   string `json:"total_amount"`   //订单金额(元)
+	ReceiptAmount string `json:"receipt_amount"` //实收金额(元)
+	GmtPayment    string `json:"gmt_payment"`    //交易支付时间
+}
+
+//支付宝退款返回
+type aliTradeRefund struct {
+	openapiResponse
+	TradeNo      string `json:"trade_no"`       //支付宝交易号
+	OutTradeNo   string `json:"out_trade_no"`   //商户订单号
+	RefundFee    string `json:"refund_fee"`     //退款总金额(元)
+	GmtRefundPay string `json:"gmt_refund_pay"` //退款支付时间
+}
+
+//支付宝退款查询返回
+type aliRefundQuery struct {
+	openapiResponse
+	TradeNo      string `json:"trade_no"`       //支付宝交易号
+	OutTradeNo   string `json:"out_trade_no"`   //商户订单号
+	OutRequestNo string `json:"out_request_no"` //退款请求号
+	TotalAmount  string `json:"total_amount"`   //交易金额(元)
+	RefundAmount string `json:"refund_amount"`  //本次退款金额(元)
+	RefundStatus string `json:"refund_status"`  //退款状态,为空或REFUND_SUCCESS时退款成功
+}
+
+//付款码支付(alipay.trade.pay),第三方应用模式下代子商户收款
+func (g *AliPayGateway) tradePay(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	biz := map[string]string{"out_trade_no": req.TradeNo, "scene": "bar_code", "auth_code": req.AuthCode, "subject": req.Body,
+		"body": req.Body, "total_amount": req.TotalFee.Yuan()}
+	var info aliTradePay
+	if err = g.execute("alipay.trade.pay", biz, map[string]string{"notify_url": req.NotifyUrl}, &info); err != nil {
+		return
+	}
+	ret.Result = g.analysis(info.openapiResponse)
+	ret.TransactionId = info.TradeNo
+	switch info.Code {
+	case CODE_SUCCESS:
+		ret.TradeState = "TRADE_SUCCESS"
+	case CODE_WAIT_USER_PAY:
+		ret.TradeState = "WAIT_BUYER_PAY"
+	}
+	var fees []Money
+	if fees, err = feesOf(info.TotalAmount, info.ReceiptAmount); err != nil {
+		return
+	}
+	ret.Raw = RetAliPayMicroPay{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: info.TradeNo, OutTradeNo: req.TradeNo,
+		BuyerLogonId: info.BuyerLogonId, TotalAmount: fees[0], ReceiptAmount: fees[1], EndTime: info.GmtPayment}
+	return
+}
+
+//手机网站支付(alipay.trade.wap.pay),返回自动提交的表单页面
+func (g *AliPayGateway) wapPay(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	var values url.Values
+	if values, err = g.signedParams("alipay.trade.wap.pay", payBizOf(req, "QUICK_WAP_WAY"),
+		map[string]string{"notify_url": req.NotifyUrl, "return_url": req.ReturnUrl}); err == nil {
+		ret.PayPage = submitFormOf(values)
+		ret.Raw = ret.PayPage
+	}
+	return
+}
+
+//退款(alipay.trade.refund),退款单号作为out_request_no,支持部分退款
+func (g *AliPayGateway) tradeRefund(req gateway.RefundRequest) (ret gateway.RefundResult, err error) {
+	biz := map[string]string{"out_trade_no": req.TradeNo, "out_request_no": req.OutRefundNo, "refund_amount": req.RefundFee.Yuan()}
+	var info aliTradeRefund
+	if err = g.execute("alipay.trade.refund", biz, nil, &info); err != nil {
+		return
+	}
+	ret.Result = g.analysis(info.openapiResponse)
+	ret.TradeNo = req.TradeNo
+	ret.OutRefundNo = req.OutRefundNo
+	ret.RefundFee = req.RefundFee
+	if ret.ErrCode == 0 {
+		ret.RefundStatus = REFUND_SUCCESS
+	}
+	var refundFee Money
+	if refundFee, err = feeOf(info.RefundFee); err != nil {
+		return
+	}
+	ret.Raw = RetAliPayRefund{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: info.TradeNo, OutTradeNo: req.TradeNo,
+		RefundFee: refundFee, EndTime: info.GmtRefundPay}
+	return
+}
+
+//退款查询(alipay.trade.fastpay.refund.query),未查到退款时退款金额为空
+func (g *AliPayGateway) refundQuery(tradeNo, outRefundNo string) (ret gateway.RefundResult, err error) {
+	biz := map[string]string{"out_trade_no": tradeNo, "out_request_no": outRefundNo}
+	var info aliRefundQuery
+	if err = g.execute("alipay.trade.fastpay.refund.query", biz, nil, &info); err != nil {
+		return
+	}
+	ret.Result = g.analysis(info.openapiResponse)
+	ret.TradeNo = tradeNo
+	ret.OutRefundNo = outRefundNo
+	var fees []Money
+	if fees, err = feesOf(info.RefundAmount, info.TotalAmount); err != nil {
+		return
+	}
+	ret.RefundFee = fees[0]
+	if ret.ErrCode == 0 && info.RefundAmount != EMPTY && (info.RefundStatus == EMPTY || info.RefundStatus == "REFUND_SUCCESS") {
+		ret.RefundStatus = REFUND_SUCCESS
+	}
+	ret.Raw = RetAliPayQueryRefund{ErrCode: ret.ErrCode, ErrMsg: ret.ErrMsg, Retryable: ret.Retryable, TradeNo: info.TradeNo, OutTradeNo: tradeNo,
+		TotalAmount: fees[1], RefundAmount: ret.RefundFee}
+	return
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//权限范围
+const (
+	SCOPE_PAY           = "pay"           //下单,支付
+	SCOPE_REFUND        = "refund"        //退款,撤销
+	SCOPE_QUERY         = "query"         //查询订单,退款
+	SCOPE_NOTIFY_VERIFY = "notify-verify" //异步通知验签,解密
+	SCOPE_ADMIN         = "admin"         //管理接口
+)
+
+//签名请求头,签名为HMAC-SHA256(密钥, 请求方法+"\n"+请求路径+"\n"+时间戳+"\n"+随机串+"\n"+SHA256(请求内容))的十六进制
+const (
+	HEADER_KEY       = "X-Pay-Key"       //调用方标识
+	HEADER_TIMESTAMP = "X-Pay-Timestamp" //时间戳(秒)
+	HEADER_NONCE     = "X-Pay-Nonce"     //随机串,有效期内不能重复使用
+	HEADER_SIGNATURE = "X-Pay-Signature" //签名
+)
+
+const TIMESTAMP_WINDOW = 300 //时间戳允许的误差(秒)
+
+//调用方
+type Client struct {
+	Id       string       //调用方标识
+	Secret   string       //签名密钥
+	Scopes   []string     //权限范围
+	AllowIps []*net.IPNet //IP白名单,为空时不限制
+}
+
+var (
+	clients = make(map[string]Client) //调用方,为空时拒绝全部请求
+	nonces  = make(map[string]int64)  //已使用的随机串及过期时间
+	nonceMu sync.Mutex
+)
+
+//初始化调用方
+func Init(list []Client) {
+	clients = make(map[string]Client)
+	for _, c := range list {
+		clients[c.Id] = c
+	}
+}
+
+//解析IP白名单,支持单个IP和CIDR,逗号分隔
+func ParseAllowIps(s string) (list []*net.IPNet, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == EMPTY {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		var ipNet *net.IPNet
+		if _, ipNet, err = net.ParseCIDR(item); err != nil {
+			return
+		}
+		list = append(list, ipNet)
+	}
+	return
+}
+
+//请求签名
+func Sign(secret, method, path, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//调用方鉴权中间件,校验签名,时间戳,随机串,权限范围和IP白名单.未配置调用方时拒绝全部请求.
+//客户端IP只在请求来自配置的反向代理时取X-Forwarded-For,见gin.Engine.SetTrustedProxies
+func Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := clients[c.GetHeader(HEADER_KEY)]
+		if !ok {
+			reject(c, ERR_UNAUTHORIZED, MSG_UNAUTHORIZED+":"+HEADER_KEY)
+			return
+		}
+		if !allowIp(client, c.ClientIP()) {
+			reject(c, ERR_FORBIDDEN, MSG_FORBIDDEN+":ip")
+			return
+		}
+		if !hasScope(client, scope) {
+			reject(c, ERR_FORBIDDEN, MSG_FORBIDDEN+":"+scope)
+			return
+		}
+		timestamp := c.GetHeader(HEADER_TIMESTAMP)
+		nonce := c.GetHeader(HEADER_NONCE)
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		now := time.Now().Unix()
+		if err != nil || ts < now-TIMESTAMP_WINDOW || ts > now+TIMESTAMP_WINDOW {
+			reject(c, ERR_UNAUTHORIZED, MSG_UNAUTHORIZED+":"+HEADER_TIMESTAMP)
+			return
+		}
+		if nonce == EMPTY {
+			reject(c, ERR_UNAUTHORIZED, MSG_UNAUTHORIZED+":"+HEADER_NONCE)
+			return
+		}
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			reject(c, ERR_INVALID_PARAM, MSG_IVALID_PARAM)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		sign := Sign(client.Secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body)
+		if !hmac.Equal([]byte(sign), []byte(strings.ToLower(c.GetHeader(HEADER_SIGNATURE)))) {
+			reject(c, ERR_UNAUTHORIZED, MSG_UNAUTHORIZED+":"+HEADER_SIGNATURE)
+			return
+		}
+		if !useNonce(client.Id+":"+nonce, now) {
+			reject(c, ERR_UNAUTHORIZED, MSG_UNAUTHORIZED+":"+HEADER_NONCE)
+			return
+		}
+		c.Set(HEADER_KEY, client.Id)
+	}
+}
+
+func reject(c *gin.Context, code int, msg string) {
+	gateway.ReturnError(code, msg, c)
+	c.Abort()
+}
+
+func hasScope(client Client, scope string) bool {
+	for _, s := range client.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func allowIp(client Client, ip string) bool {
+	if len(client.AllowIps) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipNet := range client.AllowIps {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//记录随机串,有效期内重复使用返回false
+func useNonce(key string, now int64) bool {
+	nonceMu.Lock()
+	defer nonceMu.Unlock()
+	for k, expire := range nonces {
+		if expire < now {
+			delete(nonces, k)
+		}
+	}
+	if _, ok := nonces[key]; ok {
+		return false
+	}
+	nonces[key] = now + 2*TIMESTAMP_WINDOW
+	return true
+}
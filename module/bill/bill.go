@@ -0,0 +1,87 @@
+package bill
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"time"
+)
+
+//渠道对账单下载,微信和支付宝模块分别实现
+type Downloader interface {
+	DownloadBill(billType, billDate string) (bills []store.Bill, err error) //下载并解析对账单
+}
+
+//已注册对账单下载的商户渠道
+type Target struct {
+	MerchantId string //商户标识
+	Channel    string //支付渠道
+}
+
+var (
+	downloaders = make(map[string]Downloader) //商户标识+支付渠道对应的对账单下载
+	targets     []Target                      //按注册顺序的商户渠道
+)
+
+//注册商户的对账单下载,merchantId为空时为默认商户
+func Register(merchantId, channel string, d Downloader) {
+	key := merchantId + ":" + channel
+	if _, ok := downloaders[key]; !ok {
+		targets = append(targets, Target{MerchantId: merchantId, Channel: channel})
+	}
+	downloaders[key] = d
+}
+
+//已注册对账单下载的全部商户渠道
+func Targets() []Target {
+	return targets
+}
+
+//下载商户的渠道对账单并保存,同一账单重复下载时覆盖已保存的记录
+func Download(merchantId, channel, billType, billDate string) (bills []store.Bill, err error) {
+	d, ok := downloaders[merchantId+":"+channel]
+	if !ok {
+		err = gateway.ErrMerchant
+		return
+	}
+	s := store.Default()
+	if s == nil {
+		err = gateway.ErrNotSupport
+		return
+	}
+	if bills, err = d.DownloadBill(billType, billDate); err != nil {
+		return
+	}
+	for i := range bills {
+		bills[i].Channel = channel
+		bills[i].MerchantId = merchantId
+		bills[i].BillType = billType
+		bills[i].BillDate = billDate
+	}
+	err = s.SaveBills(channel, merchantId, billType, billDate, bills)
+	return
+}
+
+//命令行下载对账单,如: pay_service bill -channel alipay -type trade -date 2019-01-01
+func RunCommand(args []string) (err error) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	flags := flag.NewFlagSet("bill", flag.ContinueOnError)
+	channel := flags.String("channel", gateway.ALIPAY, "支付渠道(wechat,alipay)")
+	merchantId := flags.String("merchant", "", "商户标识,为空时为默认商户")
+	billType := flags.String("type", "", "账单类型,支付宝为trade,signcustomer,微信为ALL,SUCCESS,REFUND,FUNDFLOW_BASIC,FUNDFLOW_OPERATION,FUNDFLOW_FEES")
+	billDate := flags.String("date", yesterday, "账单日期")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if *billType == "" {
+		err = errors.New("缺少参数:-type")
+		return
+	}
+	var bills []store.Bill
+	if bills, err = Download(*merchantId, *channel, *billType, *billDate); err == nil {
+		fmt.Printf("download %s %s bill %s: %d records\n", *channel, *billType, *billDate, len(bills))
+	}
+	return
+}
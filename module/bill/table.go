@@ -0,0 +1,95 @@
+package bill
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	. "pay_service/module/comm"
+	"strings"
+)
+
+var errHeader = errors.New("bill header not found")
+
+//账单表格,Header为列名对应的列序号
+type Table struct {
+	Header map[string]int
+	Rows   [][]string
+}
+
+//解析csv格式的账单内容,跳过空行和#开头的说明行.
+//rowPrefix为空时第一行为表头,其余为明细行;不为空时以rowPrefix开头的行为明细行(去掉每个字段的rowPrefix),其余行为新表格的表头,如微信账单的明细表和汇总表
+func ParseTables(content []byte, rowPrefix string) (tables []Table, err error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\ufeff"))))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	var records [][]string
+	if records, err = reader.ReadAll(); err != nil {
+		return
+	}
+	for i, record := range records {
+		for j := range record {
+			record[j] = strings.TrimSpace(record[j])
+		}
+		header := i == 0
+		if rowPrefix != EMPTY {
+			header = len(record) > 0 && !strings.HasPrefix(record[0], rowPrefix)
+		}
+		if header {
+			t := Table{Header: make(map[string]int)}
+			for j, name := range record {
+				t.Header[name] = j
+			}
+			tables = append(tables, t)
+			continue
+		}
+		if len(tables) == 0 {
+			err = errHeader
+			return
+		}
+		for j := range record {
+			record[j] = strings.TrimSpace(strings.TrimPrefix(record[j], rowPrefix))
+		}
+		tables[len(tables)-1].Rows = append(tables[len(tables)-1].Rows, record)
+	}
+	return
+}
+
+//按列名取值,没有该列时匹配带单位或别名的列,如"订单金额"匹配"订单金额（元）","退款批次号"匹配"退款批次号/请求号"
+func (t Table) Get(row []string, name string) (value string) {
+	i, ok := t.Header[name]
+	if !ok {
+		i = -1
+		for h, idx := range t.Header {
+			if strings.HasPrefix(h, name+"（") || strings.HasPrefix(h, name+"(") || strings.HasPrefix(h, name+"/") {
+				i = idx
+				break
+			}
+		}
+	}
+	if i >= 0 && i < len(row) {
+		value = row[i]
+	}
+	return
+}
+
+//是否有该列
+func (t Table) Has(name string) bool {
+	_, ok := t.Header[name]
+	return ok
+}
+
+//按列名取金额(元)转为分,为空时为0,任一列格式错误时返回错误
+func (t Table) Fees(row []string, names ...string) (fees []Money, err error) {
+	fees = make([]Money, len(names))
+	for i, name := range names {
+		if value := t.Get(row, name); value != EMPTY {
+			if fees[i], err = ParseYuan(value); err != nil {
+				err = fmt.Errorf("%s %q: %v", name, value, err)
+				return
+			}
+		}
+	}
+	return
+}
@@ -7,26 +7,98 @@ const (
 	ERR_INVALID_PARAM = 1002       //参数无效
 	ERR_CALL_PARMENT  = 1003       //调用失败
 	ERR_VERIFY_SIGN   = 1004       //验签失败
+	ERR_NOT_SUPPORT   = 1005       //渠道不支持
+	ERR_ORDER_STATE   = 1006       //订单状态错误
+	ERR_IDEMPOTENT    = 1007       //幂等键冲突
+	ERR_PROCESSING    = 1008       //请求处理中
+	ERR_REFUND_EXCEED = 1009       //退款金额超限
+	ERR_PAY_STATE     = 1010       //支付链接无效
+	ERR_UNAUTHORIZED  = 1011       //调用方鉴权失败
+	ERR_FORBIDDEN     = 1012       //调用方无权限
+	ERR_MERCHANT      = 1013       //商户不存在
+	ERR_INTERNAL      = 1014       //本服务内部错误
 	MSG_IVALID_PARAM  = "无效的参数"
 	MSG_VERIFY_SIGN   = "验签失败"
+	MSG_NOT_SUPPORT   = "渠道不支持该操作"
+	MSG_ORDER_STATE   = "订单状态不允许该操作"
+	MSG_IDEMPOTENT    = "幂等键已使用,请求内容不一致"
+	MSG_PROCESSING    = "相同请求正在处理中"
+	MSG_REFUND_EXCEED = "累计退款金额超过订单金额"
+	MSG_PAY_STATE     = "支付链接无效"
+	MSG_UNAUTHORIZED  = "调用方鉴权失败"
+	MSG_FORBIDDEN     = "调用方无权限"
+	MSG_MERCHANT      = "商户不存在或未开通该支付渠道"
+	MSG_INTERNAL      = "服务内部错误,请稍后重试"
+)
+
+//订单状态
+const (
+	STATUS_CREATED            = "CREATED"            //已创建
+	STATUS_USERPAYING         = "USERPAYING"         //用户支付中
+	STATUS_PAID               = "PAID"               //已支付
+	STATUS_CLOSED             = "CLOSED"             //已关闭
+	STATUS_REVERSED           = "REVERSED"           //已撤销
+	STATUS_PARTIALLY_REFUNDED = "PARTIALLY_REFUNDED" //部分退款
+	STATUS_REFUNDED           = "REFUNDED"           //全额退款
+)
+
+//商户通知投递状态
+const (
+	DELIVERY_PENDING = "PENDING" //待投递
+	DELIVERY_SUCCESS = "SUCCESS" //投递成功
+	DELIVERY_FAILED  = "FAILED"  //重试次数用完,投递失败
+)
+
+//付款码订单轮询状态
+const (
+	POLL_PENDING  = "PENDING"  //轮询中
+	POLL_DONE     = "DONE"     //已得到最终交易状态
+	POLL_REVERSED = "REVERSED" //超时已撤销
+	POLL_FAILED   = "FAILED"   //超时撤销失败或渠道不支持查询
+)
+
+//对账单记录类型
+const (
+	BILL_PAY    = "PAY"    //支付
+	BILL_REFUND = "REFUND" //退款
+)
+
+//退款状态
+const (
+	REFUND_PROCESSING = "PROCESSING" //退款处理中
+	REFUND_SUCCESS    = "SUCCESS"    //退款成功
+	REFUND_FAIL       = "FAIL"       //退款失败
 )
 
 const (
 	EMPTY         = ""   //aa
 	OK            = "OK" //aa
 	TEXT_HTML     = "text/html"
-	BODY          = "body"          //订单标题
-	TRADE_NO      = "trade_no"      //商户订单号
-	NOTIFY_URL    = "notify_url"    //回调地址
-	CLIENT_IP     = "clientIp"      //客户端IP
-	FEE           = "fee"           //付款金额
-	CODE          = "code"          //
-	USER_AGENT    = "User-Agent"    //
-	STATE         = "state"         //状态
-	AUTH_CODE     = "auth_code"     //授权码
-	OUT_REFUND_NO = "out_refund_no" //退款订单号
-	REFUND_FEE    = "refund_fee"    //退款金额
-	TOTAL_FEE     = "total_fee"     //标价总金额
-	NOTIFY_INFO   = "notify_info"   //通步通知信息
-	HTTP_SUCCESS  = 200             //
+	BODY          = "body"            //订单标题
+	TRADE_NO      = "trade_no"        //商户订单号
+	NOTIFY_URL    = "notify_url"      //回调地址
+	CLIENT_IP     = "clientIp"        //客户端IP
+	FEE           = "fee"             //付款金额
+	CODE          = "code"            //
+	USER_AGENT    = "User-Agent"      //
+	IDEMPOTENCY   = "Idempotency-Key" //幂等键
+	STATE         = "state"           //状态
+	AUTH_CODE     = "auth_code"       //授权码
+	OUT_REFUND_NO = "out_refund_no"   //退款订单号
+	REFUND_FEE    = "refund_fee"      //退款金额
+	TOTAL_FEE     = "total_fee"       //标价总金额
+	NOTIFY_INFO   = "notify_info"     //通步通知信息
+	CHANNEL       = "channel"         //支付渠道
+	OUT_TRADE_NO  = "out_trade_no"    //商户订单号
+	MERCHANT_ID   = "merchant_id"     //商户标识,为空时使用默认商户
+	TIMEOUT       = "timeout_express" //订单有效时间,如30m
+	PASSBACK      = "passback_params" //公共回传参数,异步通知时原样返回
+	RETURN_URL    = "return_url"      //支付完成后跳转地址
+	BILL_TYPE     = "bill_type"       //账单类型
+	BILL_DATE     = "bill_date"       //账单日期
+	SCENE_INFO    = "scene_info"      //场景信息(json)
+	WAP_URL       = "wap_url"         //WAP网站URL地址
+	WAP_NAME      = "wap_name"        //WAP网站名
+	PAY_CHANNEL   = "pay_channel"     //用户选择的支付渠道(wechat,alipay)
+	HTTP_SUCCESS  = 200               //
 )
@@ -0,0 +1,118 @@
+package comm
+
+import "sort"
+
+//渠道业务错误码,微信err_code和支付宝sub_code统一映射到以下错误码
+const (
+	ERR_SYSTEM          = 2001 //渠道系统繁忙
+	ERR_BALANCE         = 2002 //余额不足
+	ERR_USER_PAYING     = 2003 //用户支付中
+	ERR_ORDER_CLOSED    = 2004 //订单已关闭
+	ERR_ORDER_PAID      = 2005 //订单已支付
+	ERR_ORDER_REVERSED  = 2006 //订单已撤销
+	ERR_DUPLICATE_ORDER = 2007 //商户订单号重复
+	ERR_TRADE_NOT_EXIST = 2008 //交易不存在
+	ERR_AUTH_CODE       = 2009 //付款码无效
+	ERR_BUYER           = 2010 //买家账户异常或支付受限
+	ERR_SIGN            = 2011 //请求签名错误
+	ERR_CERT            = 2012 //商户证书缺失
+	ERR_PERMISSION      = 2013 //商户无权限或渠道配置错误
+	ERR_FREQUENCY       = 2014 //请求频率超限
+	ERR_NOTIFY_MISMATCH = 2015 //异步通知与本地订单不一致
+	ERR_NOTIFY_APPID    = 2016 //异步通知的应用ID不属于本商户
+	ERR_NOTIFY_MCHID    = 2017 //异步通知的商户号不属于本商户
+	ERR_NOTIFY_SELLER   = 2018 //异步通知的卖家不是本商户
+	ERR_NOTIFY_AMOUNT   = 2019 //异步通知的金额与订单不一致
+	ERR_NOTIFY_UNKNOWN  = 2020 //异步通知的订单或退款不是本服务创建的
+	MSG_LACK_PARAM      = "缺少参数"
+	MSG_CALL_PARMENT    = "调用渠道失败"
+	MSG_SYSTEM          = "渠道系统繁忙,请稍后重试"
+	MSG_BALANCE         = "余额不足"
+	MSG_USER_PAYING     = "用户支付中,需要输入密码"
+	MSG_ORDER_CLOSED    = "订单已关闭"
+	MSG_ORDER_PAID      = "订单已支付"
+	MSG_ORDER_REVERSED  = "订单已撤销"
+	MSG_DUPLICATE_ORDER = "商户订单号重复"
+	MSG_TRADE_NOT_EXIST = "交易不存在"
+	MSG_AUTH_CODE       = "付款码无效或已过期"
+	MSG_BUYER           = "买家账户异常或支付受限"
+	MSG_SIGN            = "请求签名错误,请检查商户密钥"
+	MSG_CERT            = "商户证书缺失"
+	MSG_PERMISSION      = "商户无权限或渠道配置错误"
+	MSG_FREQUENCY       = "请求频率超限"
+	MSG_NOTIFY_MISMATCH = "异步通知与本地订单不一致"
+	MSG_NOTIFY_APPID    = "异步通知的应用ID不属于本商户"
+	MSG_NOTIFY_MCHID    = "异步通知的商户号不属于本商户"
+	MSG_NOTIFY_SELLER   = "异步通知的卖家不是本商户"
+	MSG_NOTIFY_AMOUNT   = "异步通知的金额与订单不一致"
+	MSG_NOTIFY_UNKNOWN  = "异步通知的订单或退款不存在"
+)
+
+//错误码说明
+type ErrorInfo struct {
+	Code      int    `json:"err_code"`
+	Msg       string `json:"err_msg"`
+	Retryable bool   `json:"retryable"` //可用相同参数重试,为false时不能直接重试,需要修改请求,查询确认或人工处理
+}
+
+//错误码目录
+var errorCatalogue = map[int]ErrorInfo{
+	ERR_LACK_PARAM:      {ERR_LACK_PARAM, MSG_LACK_PARAM, false},
+	ERR_INVALID_PARAM:   {ERR_INVALID_PARAM, MSG_IVALID_PARAM, false},
+	ERR_CALL_PARMENT:    {ERR_CALL_PARMENT, MSG_CALL_PARMENT, false}, //渠道处理结果未知,先查询订单或退款再决定是否重试
+	ERR_VERIFY_SIGN:     {ERR_VERIFY_SIGN, MSG_VERIFY_SIGN, false},
+	ERR_NOT_SUPPORT:     {ERR_NOT_SUPPORT, MSG_NOT_SUPPORT, false},
+	ERR_ORDER_STATE:     {ERR_ORDER_STATE, MSG_ORDER_STATE, false},
+	ERR_IDEMPOTENT:      {ERR_IDEMPOTENT, MSG_IDEMPOTENT, false},
+	ERR_PROCESSING:      {ERR_PROCESSING, MSG_PROCESSING, true},
+	ERR_REFUND_EXCEED:   {ERR_REFUND_EXCEED, MSG_REFUND_EXCEED, false},
+	ERR_PAY_STATE:       {ERR_PAY_STATE, MSG_PAY_STATE, false},
+	ERR_UNAUTHORIZED:    {ERR_UNAUTHORIZED, MSG_UNAUTHORIZED, false},
+	ERR_FORBIDDEN:       {ERR_FORBIDDEN, MSG_FORBIDDEN, false},
+	ERR_MERCHANT:        {ERR_MERCHANT, MSG_MERCHANT, false},
+	ERR_INTERNAL:        {ERR_INTERNAL, MSG_INTERNAL, true},
+	ERR_SYSTEM:          {ERR_SYSTEM, MSG_SYSTEM, true},
+	ERR_BALANCE:         {ERR_BALANCE, MSG_BALANCE, false},
+	ERR_USER_PAYING:     {ERR_USER_PAYING, MSG_USER_PAYING, true},
+	ERR_ORDER_CLOSED:    {ERR_ORDER_CLOSED, MSG_ORDER_CLOSED, false},
+	ERR_ORDER_PAID:      {ERR_ORDER_PAID, MSG_ORDER_PAID, false},
+	ERR_ORDER_REVERSED:  {ERR_ORDER_REVERSED, MSG_ORDER_REVERSED, false},
+	ERR_DUPLICATE_ORDER: {ERR_DUPLICATE_ORDER, MSG_DUPLICATE_ORDER, false},
+	ERR_TRADE_NOT_EXIST: {ERR_TRADE_NOT_EXIST, MSG_TRADE_NOT_EXIST, false},
+	ERR_AUTH_CODE:       {ERR_AUTH_CODE, MSG_AUTH_CODE, false},
+	ERR_BUYER:           {ERR_BUYER, MSG_BUYER, false},
+	ERR_SIGN:            {ERR_SIGN, MSG_SIGN, false},
+	ERR_CERT:            {ERR_CERT, MSG_CERT, false},
+	ERR_PERMISSION:      {ERR_PERMISSION, MSG_PERMISSION, false},
+	ERR_FREQUENCY:       {ERR_FREQUENCY, MSG_FREQUENCY, true},
+	ERR_NOTIFY_MISMATCH: {ERR_NOTIFY_MISMATCH, MSG_NOTIFY_MISMATCH, false},
+	ERR_NOTIFY_APPID:    {ERR_NOTIFY_APPID, MSG_NOTIFY_APPID, false},
+	ERR_NOTIFY_MCHID:    {ERR_NOTIFY_MCHID, MSG_NOTIFY_MCHID, false},
+	ERR_NOTIFY_SELLER:   {ERR_NOTIFY_SELLER, MSG_NOTIFY_SELLER, false},
+	ERR_NOTIFY_AMOUNT:   {ERR_NOTIFY_AMOUNT, MSG_NOTIFY_AMOUNT, false},
+	ERR_NOTIFY_UNKNOWN:  {ERR_NOTIFY_UNKNOWN, MSG_NOTIFY_UNKNOWN, false},
+}
+
+//错误码的说明,未知错误码按调用失败处理,不可直接重试
+func ErrorInfoOf(code int) (info ErrorInfo) {
+	var ok bool
+	if info, ok = errorCatalogue[code]; !ok {
+		info = errorCatalogue[ERR_CALL_PARMENT]
+		info.Code = code
+	}
+	return
+}
+
+//错误码是否可重试,0为成功,不可重试
+func Retryable(code int) bool {
+	return code != 0 && ErrorInfoOf(code).Retryable
+}
+
+//全部错误码说明,按错误码排序
+func ErrorCatalogue() (list []ErrorInfo) {
+	for _, info := range errorCatalogue {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return
+}
@@ -0,0 +1,178 @@
+package comm
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//币种
+const CURRENCY_CNY = "CNY" //人民币,最小单位为分
+
+//金额错误
+var (
+	ErrMoney = errors.New(MSG_IVALID_PARAM + ":金额必须为非负整数(分)") //金额不是非负整数
+	ErrYuan  = errors.New(MSG_IVALID_PARAM + ":金额格式错误(元)")    //元金额格式错误
+)
+
+//金额,以最小货币单位(分)保存,不使用浮点数.json中为整数分,币种为空时为人民币
+type Money struct {
+	Amount   int64  //金额(分)
+	Currency string //币种
+}
+
+//整数分的人民币金额
+func Fen(amount int64) Money {
+	return Money{Amount: amount, Currency: CURRENCY_CNY}
+}
+
+//解析请求参数中的金额,支持json数字和数字字符串,小数,负数和超出精度的数字返回ErrMoney
+func ParseMoney(v interface{}) (m Money, err error) {
+	switch n := v.(type) {
+	case float64:
+		//json数字解析为float64,超过2^53时不能精确表示
+		if n < 0 || n != math.Trunc(n) || n > 1<<53 {
+			err = ErrMoney
+			return
+		}
+		m = Fen(int64(n))
+	case int:
+		m = Fen(int64(n))
+	case int64:
+		m = Fen(n)
+	case json.Number:
+		m, err = ParseMoney(string(n))
+		return
+	case string:
+		var amount int64
+		if n == EMPTY || strings.TrimLeft(n, "0123456789") != EMPTY {
+			err = ErrMoney
+			return
+		}
+		if amount, err = strconv.ParseInt(n, 10, 64); err != nil {
+			err = ErrMoney
+			return
+		}
+		m = Fen(amount)
+	default:
+		err = ErrMoney
+		return
+	}
+	if m.Amount < 0 {
+		m, err = Money{}, ErrMoney
+	}
+	return
+}
+
+//请求参数中的金额,参数不存在时返回0,用于可选的金额参数
+func MoneyOf(mapData map[string]interface{}, key string) (m Money, err error) {
+	if v, ok := mapData[key]; ok && v != nil {
+		m, err = ParseMoney(v)
+	}
+	return
+}
+
+//解析以元为单位的金额字符串,如支付宝返回的"0.01",最多两位小数,支持负数(账单中的退款)
+func ParseYuan(s string) (m Money, err error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+	integer, fraction := s, EMPTY
+	if i := strings.Index(s, "."); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+	}
+	if integer == EMPTY || strings.HasSuffix(s, ".") || len(fraction) > 2 || strings.TrimLeft(integer+fraction, "0123456789") != EMPTY {
+		err = ErrYuan
+		return
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+	var amount int64
+	if amount, err = strconv.ParseInt(integer+fraction, 10, 64); err != nil {
+		err = ErrYuan
+		return
+	}
+	if negative {
+		amount = -amount
+	}
+	m = Fen(amount)
+	return
+}
+
+//相加,币种取不为空的一方
+func (m Money) Add(o Money) Money {
+	if m.Currency == EMPTY {
+		m.Currency = o.Currency
+	}
+	m.Amount += o.Amount
+	return m
+}
+
+//以元为单位的两位小数字符串,如1.05
+func (m Money) Yuan() string {
+	amount, sign := m.Amount, EMPTY
+	if amount < 0 {
+		amount, sign = -amount, "-"
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+//整数分,用于以int表示金额的支付库
+func (m Money) Int() int {
+	return int(m.Amount)
+}
+
+//整数分字符串,用于微信支付接口参数
+func (m Money) String() string {
+	return strconv.FormatInt(m.Amount, 10)
+}
+
+//json中为整数分
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+//json中为整数分或整数分字符串,不接受小数和负数
+func (m *Money) UnmarshalJSON(b []byte) (err error) {
+	s := string(b)
+	if s == "null" {
+		return
+	}
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		s = s[1 : len(s)-1]
+	}
+	*m, err = ParseMoney(s)
+	return
+}
+
+//xml等文本中为整数分
+func (m *Money) UnmarshalText(b []byte) (err error) {
+	if len(b) == 0 {
+		return
+	}
+	*m, err = ParseMoney(string(b))
+	return
+}
+
+//数据库中以整数分保存
+func (m Money) Value() (driver.Value, error) {
+	return m.Amount, nil
+}
+
+//读取数据库中的整数分
+func (m *Money) Scan(src interface{}) (err error) {
+	switch v := src.(type) {
+	case int64:
+		*m = Fen(v)
+	case nil:
+		*m = Money{}
+	default:
+		err = fmt.Errorf("money: cannot scan %T", src)
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package comm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want int64
+		err  bool
+	}{
+		{float64(100), 100, false},
+		{float64(0), 0, false},
+		{float64(1.5), 0, true},
+		{float64(-1), 0, true},
+		{float64(1<<53 + 2), 0, true},
+		{1, 1, false},
+		{-1, 0, true},
+		{int64(9007199254740993), 9007199254740993, false},
+		{json.Number("12"), 12, false},
+		{json.Number("1.2"), 0, true},
+		{"100", 100, false},
+		{"007", 7, false},
+		{"1.00", 0, true},
+		{"-1", 0, true},
+		{"+1", 0, true},
+		{" 1", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"99999999999999999999", 0, true},
+		{nil, 0, true},
+		{true, 0, true},
+	}
+	for _, c := range cases {
+		m, err := ParseMoney(c.in)
+		if (err != nil) != c.err || m.Amount != c.want {
+			t.Errorf("ParseMoney(%#v) = %d, %v, want %d, err %v", c.in, m.Amount, err, c.want, c.err)
+		}
+		if err != nil && err != ErrMoney {
+			t.Errorf("ParseMoney(%#v) error %v, want ErrMoney", c.in, err)
+		}
+		if err == nil && m.Currency != CURRENCY_CNY {
+			t.Errorf("ParseMoney(%#v) currency %q, want %s", c.in, m.Currency, CURRENCY_CNY)
+		}
+	}
+}
+
+func TestParseYuan(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"0.01", 1, false},
+		{"1", 100, false},
+		{"1.5", 150, false},
+		{"1.05", 105, false},
+		{"0.1", 10, false},
+		{"-2.30", -230, false},
+		{" 3.21 ", 321, false},
+		{"1000000.00", 100000000, false},
+		{"1.005", 0, true},
+		{"0.015", 0, true},
+		{"", 0, true},
+		{".5", 0, true},
+		{"-", 0, true},
+		{"+1.00", 0, true},
+		{"1,000.00", 0, true},
+		{"1.0.0", 0, true},
+		{"1.", 0, true},
+		{"-1.", 0, true},
+		{"1e2", 0, true},
+		{"abc", 0, true},
+	}
+	for _, c := range cases {
+		m, err := ParseYuan(c.in)
+		if (err != nil) != c.err || m.Amount != c.want {
+			t.Errorf("ParseYuan(%q) = %d, %v, want %d, err %v", c.in, m.Amount, err, c.want, c.err)
+		}
+		if err != nil && err != ErrYuan {
+			t.Errorf("ParseYuan(%q) error %v, want ErrYuan", c.in, err)
+		}
+	}
+}
+
+func TestYuan(t *testing.T) {
+	cases := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{10, "0.10"},
+		{105, "1.05"},
+		{100000, "1000.00"},
+		{-1, "-0.01"},
+		{-230, "-2.30"},
+	}
+	for _, c := range cases {
+		if got := Fen(c.in).Yuan(); got != c.want {
+			t.Errorf("Fen(%d).Yuan() = %q, want %q", c.in, got, c.want)
+		}
+		if m, err := ParseYuan(Fen(c.in).Yuan()); err != nil || m.Amount != c.in {
+			t.Errorf("ParseYuan(Fen(%d).Yuan()) = %d, %v", c.in, m.Amount, err)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var v struct {
+		Fee Money `json:"fee"`
+	}
+	for in, want := range map[string]int64{`{"fee":100}`: 100, `{"fee":"100"}`: 100, `{"fee":null}`: 0} {
+		v.Fee = Money{}
+		if err := json.Unmarshal([]byte(in), &v); err != nil || v.Fee.Amount != want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", in, v.Fee.Amount, err, want)
+		}
+	}
+	for _, in := range []string{`{"fee":1.5}`, `{"fee":-1}`, `{"fee":"0.01"}`} {
+		if err := json.Unmarshal([]byte(in), &v); err == nil {
+			t.Errorf("Unmarshal(%s) accepted %d", in, v.Fee.Amount)
+		}
+	}
+	//引号必须成对
+	for _, in := range []string{`"100`, `100"`, `""100""`, `"`} {
+		var m Money
+		if err := m.UnmarshalJSON([]byte(in)); err == nil {
+			t.Errorf("UnmarshalJSON(%s) accepted %d", in, m.Amount)
+		}
+	}
+	if b, _ := json.Marshal(struct {
+		Fee Money `json:"fee"`
+	}{Fen(105)}); string(b) != `{"fee":105}` {
+		t.Errorf("Marshal = %s", b)
+	}
+}
@@ -0,0 +1,325 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	. "pay_service/module/comm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//支付渠道
+const (
+	WECHAT = "wechat" //微信
+	ALIPAY = "alipay" //支付宝
+)
+
+//交易类型
+const (
+	TRADE_NATIVE = "NATIVE" //扫码支付(商户展示二维码)
+	TRADE_JSAPI  = "JSAPI"  //公众号支付
+	TRADE_APP    = "APP"    //APP支付
+	TRADE_MINI   = "MINI"   //小程序支付
+	TRADE_MICRO  = "MICRO"  //付款码支付
+	TRADE_H5     = "H5"     //手机网页支付
+	TRADE_PAGE   = "PAGE"   //电脑网站支付
+)
+
+//异步通知类型
+const (
+	NOTIFY_PAYMENT = "PAYMENT" //支付通知
+	NOTIFY_REFUND  = "REFUND"  //退款通知
+)
+
+var (
+	ErrNotSupport     = errors.New(MSG_NOT_SUPPORT)                  //渠道不支持该操作
+	ErrVerifySign     = errors.New(MSG_VERIFY_SIGN)                  //验签失败
+	ErrOrderState     = errors.New(MSG_ORDER_STATE)                  //订单状态不允许该操作
+	ErrRefundFee      = errors.New(MSG_REFUND_EXCEED)                //累计退款金额超过订单金额
+	ErrTotalFee       = errors.New("缺少参数:" + TOTAL_FEE)              //缺少订单金额
+	ErrMerchant       = errors.New(MSG_MERCHANT)                     //商户不存在或未开通该支付渠道
+	ErrTimeout        = errors.New(MSG_IVALID_PARAM + ":" + TIMEOUT) //订单有效时间格式错误
+	ErrCert           = errors.New(MSG_CERT)                         //商户证书缺失
+	ErrNotifyMismatch = errors.New(MSG_NOTIFY_MISMATCH)              //异步通知与本地订单不一致
+	ErrNotifyAppId    = errors.New(MSG_NOTIFY_APPID)                 //异步通知的应用ID不属于本商户
+	ErrNotifyMchId    = errors.New(MSG_NOTIFY_MCHID)                 //异步通知的商户号不属于本商户
+	ErrNotifySeller   = errors.New(MSG_NOTIFY_SELLER)                //异步通知的卖家不是本商户
+	ErrNotifyAmount   = errors.New(MSG_NOTIFY_AMOUNT)                //异步通知的金额与订单不一致
+	ErrNotifyUnknown  = errors.New(MSG_NOTIFY_UNKNOWN)               //异步通知的订单或退款不是本服务创建的
+)
+
+//带错误码的渠道错误,渠道返回的错误映射为统一错误码
+type Error struct {
+	Code int    //错误码
+	Msg  string //错误信息
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+//带错误码的错误,msg为空时使用错误码说明
+func NewError(code int, msg string) error {
+	if msg == EMPTY {
+		msg = ErrorInfoOf(code).Msg
+	}
+	return &Error{Code: code, Msg: msg}
+}
+
+//渠道返回公共信息
+type Result struct {
+	ErrCode   int         `json:"err_code"`
+	ErrMsg    string      `json:"err_msg"`
+	Retryable bool        `json:"retryable"` //可用相同参数重试
+	Raw       interface{} `json:"-"`         //渠道原始返回
+}
+
+//错误码对应的渠道返回公共信息,msg为空时使用错误码说明
+func ResultOf(code int, msg string) (ret Result) {
+	if code != 0 && msg == EMPTY {
+		msg = ErrorInfoOf(code).Msg
+	}
+	ret.ErrCode, ret.ErrMsg, ret.Retryable = code, msg, Retryable(code)
+	return
+}
+
+//下单请求
+type OrderRequest struct {
+	TradeType string //交易类型
+	Body      string //订单标题
+	TradeNo   string //商户订单号
+	NotifyUrl string //回调地址
+	ClientIp  string //客户端IP
+	AuthCode  string //付款码,付款码支付时使用
+	Code      string //oauth2授权码,公众号和小程序支付时使用
+	TotalFee  Money  //订单金额(分)
+	Timeout   string //订单有效时间,如30m,为空时使用默认有效时间
+	Passback  string //公共回传参数,异步通知时原样返回
+	ReturnUrl string //支付完成后跳转地址,网页支付时使用
+	SceneInfo string //场景信息(json),微信H5支付时使用
+}
+
+//下单返回
+type OrderResult struct {
+	Result
+	TradeNo       string      `json:"trade_no"`                 //商户订单号
+	TransactionId string      `json:"transaction_id,omitempty"` //渠道订单号,支付完成前为空
+	PrepayId      string      `json:"prepay_id,omitempty"`      //预支付交易会话ID
+	TradeState    string      `json:"trade_state,omitempty"`    //交易状态
+	CodeUrl       string      `json:"code_url,omitempty"`       //二维码链接
+	PayPage       string      `json:"pay_page,omitempty"`       //支付页面
+	PayUrl        string      `json:"pay_url,omitempty"`        //支付跳转链接
+	PayParams     interface{} `json:"pay_params,omitempty"`     //调起支付参数
+}
+
+//查询订单返回
+type QueryResult struct {
+	Result
+	TradeNo       string `json:"trade_no"`       //商户订单号
+	TransactionId string `json:"transaction_id"` //渠道订单号
+	TradeState    string `json:"trade_state"`    //交易状态
+	TotalFee      Money  `json:"total_fee"`      //订单金额(分)
+}
+
+//退款请求
+type RefundRequest struct {
+	TradeNo     string //商户订单号
+	OutRefundNo string //商户退款单号
+	NotifyUrl   string //退款回调地址
+	TotalFee    Money  //订单金额(分),为0时取本地订单金额
+	RefundFee   Money  //退款金额(分)
+}
+
+//退款返回
+type RefundResult struct {
+	Result
+	TradeNo      string `json:"trade_no"`                //商户订单号
+	OutRefundNo  string `json:"out_refund_no"`           //商户退款单号
+	RefundId     string `json:"refund_id"`               //渠道退款单号
+	RefundFee    Money  `json:"refund_fee"`              //退款金额(分)
+	RefundStatus string `json:"refund_status,omitempty"` //退款状态
+}
+
+//异步通知验签返回
+type NotifyResult struct {
+	Result
+	NotifyType    string `json:"notify_type"`             //通知类型
+	NotifyId      string `json:"notify_id,omitempty"`     //通知标识,支付宝为notify_id,微信为支付或退款单号,用于去重
+	TradeNo       string `json:"trade_no"`                //商户订单号
+	TransactionId string `json:"transaction_id"`          //渠道订单号
+	OutRefundNo   string `json:"out_refund_no,omitempty"` //商户退款单号
+	TradeState    string `json:"trade_state"`             //交易状态
+	TotalFee      Money  `json:"total_fee"`               //订单金额(分)
+	RefundFee     Money  `json:"refund_fee"`              //退款金额(分),退款通知时使用
+	Duplicate     bool   `json:"duplicate,omitempty"`     //重复通知,已处理过,不再更新订单
+}
+
+//支付渠道接口,微信和支付宝模块分别实现
+type PaymentGateway interface {
+	CreateOrder(req OrderRequest) (ret OrderResult, err error)             //下单
+	Query(tradeNo string) (ret QueryResult, err error)                     //查询订单
+	Refund(req RefundRequest) (ret RefundResult, err error)                //退款
+	QueryRefund(tradeNo, outRefundNo string) (ret RefundResult, err error) //查询退款
+	Close(tradeNo string) (ret Result, err error)                          //关闭订单
+	Reverse(tradeNo string) (ret Result, err error)                        //撤销订单
+	VerifyNotify(body string) (ret NotifyResult, err error)                //异步通知验签
+}
+
+//渠道交易状态对应的订单状态,无对应状态时返回空
+func StatusOf(tradeState string) (status string) {
+	switch tradeState {
+	case "SUCCESS", "TRADE_SUCCESS", "TRADE_FINISHED":
+		status = STATUS_PAID
+	case "USERPAYING", "WAIT_BUYER_PAY":
+		status = STATUS_USERPAYING
+	case "CLOSED", "TRADE_CLOSED":
+		status = STATUS_CLOSED
+	case "REVOKED":
+		status = STATUS_REVERSED
+	}
+	return
+}
+
+//错误对应的错误码
+func ErrorCode(err error) (code int) {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	switch err {
+	case ErrNotSupport:
+		code = ERR_NOT_SUPPORT
+	case ErrVerifySign:
+		code = ERR_VERIFY_SIGN
+	case ErrOrderState:
+		code = ERR_ORDER_STATE
+	case ErrRefundFee:
+		code = ERR_REFUND_EXCEED
+	case ErrTotalFee:
+		code = ERR_LACK_PARAM
+	case ErrMerchant:
+		code = ERR_MERCHANT
+	case ErrTimeout, ErrMoney, ErrYuan:
+		code = ERR_INVALID_PARAM
+	case ErrCert:
+		code = ERR_CERT
+	case ErrNotifyMismatch:
+		code = ERR_NOTIFY_MISMATCH
+	case ErrNotifyAppId:
+		code = ERR_NOTIFY_APPID
+	case ErrNotifyMchId:
+		code = ERR_NOTIFY_MCHID
+	case ErrNotifySeller:
+		code = ERR_NOTIFY_SELLER
+	case ErrNotifyAmount:
+		code = ERR_NOTIFY_AMOUNT
+	case ErrNotifyUnknown:
+		code = ERR_NOTIFY_UNKNOWN
+	default:
+		code = ERR_CALL_PARMENT
+	}
+	return
+}
+
+//错误返回,全部接口的错误统一返回err_code,err_msg和retryable
+func ReturnError(code int, msg string, c *gin.Context) {
+	c.JSON(HTTP_SUCCESS, ResultOf(code, msg))
+}
+
+//渠道错误返回
+func ReturnGatewayError(err error, c *gin.Context) {
+	ReturnError(ErrorCode(err), err.Error(), c)
+}
+
+var gateways = make(map[string]PaymentGateway) //商户标识+支付渠道对应的支付渠道
+
+//注册商户的支付渠道,merchantId为空时为默认商户
+func Register(merchantId, channel string, g PaymentGateway) {
+	gateways[merchantId+":"+channel] = g
+}
+
+//获取商户的支付渠道,merchantId为空时为默认商户
+func Get(merchantId, channel string) (g PaymentGateway, ok bool) {
+	g, ok = gateways[merchantId+":"+channel]
+	return
+}
+
+//渠道异步通知回调相对路径,回调地址为回调域名+CALLBACK_PATH+支付渠道[/商户标识]
+const CALLBACK_PATH = "/payService/notify/"
+
+var callbackHost string //本服务接收渠道异步通知的外网地址
+
+//设置本服务接收渠道异步通知的外网地址,如https://pay.example.com.设置后渠道通知发到本服务,由本服务通知商户notify_url
+func SetCallbackHost(host string) {
+	callbackHost = strings.TrimRight(host, "/")
+}
+
+//商户支付渠道的异步通知回调地址,未设置回调地址时返回空
+func CallbackUrl(merchantId, channel string) (callbackUrl string) {
+	if callbackHost == EMPTY {
+		return
+	}
+	callbackUrl = callbackHost + CALLBACK_PATH + channel
+	if merchantId != EMPTY {
+		callbackUrl += "/" + url.PathEscape(merchantId)
+	}
+	return
+}
+
+var defaultTimeout string //订单默认有效时间
+
+//设置订单默认有效时间,下单未指定有效时间时使用,为空时使用渠道默认值
+func SetDefaultTimeout(timeout string) {
+	defaultTimeout = timeout
+}
+
+//订单有效时间,未指定时为默认有效时间.付款码订单由轮询撤销,不设置有效时间
+func TimeoutOf(req OrderRequest) string {
+	if req.TradeType == TRADE_MICRO {
+		return EMPTY
+	}
+	if req.Timeout == EMPTY {
+		return defaultTimeout
+	}
+	return req.Timeout
+}
+
+//渠道使用的时区(北京时间)
+var ChannelZone = time.FixedZone("CST", 8*3600)
+
+//订单有效时间对应的过期时间,timeout格式与支付宝timeout_express一致,取值1m~15d,m-分钟,h-小时,d-天,
+//1c-当天(无论何时下单,都在0点关闭)
+func ExpireAt(timeout string, from time.Time) (t time.Time, err error) {
+	if len(timeout) < 2 {
+		err = ErrTimeout
+		return
+	}
+	n, e := strconv.Atoi(timeout[:len(timeout)-1])
+	if e != nil || n <= 0 {
+		err = ErrTimeout
+		return
+	}
+	switch timeout[len(timeout)-1] {
+	case 'm':
+		t = from.Add(time.Duration(n) * time.Minute)
+	case 'h':
+		t = from.Add(time.Duration(n) * time.Hour)
+	case 'd':
+		t = from.AddDate(0, 0, n)
+	case 'c':
+		if n != 1 {
+			err = ErrTimeout
+			return
+		}
+		day := from.In(ChannelZone)
+		t = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, ChannelZone).AddDate(0, 0, 1)
+	default:
+		err = ErrTimeout
+		return
+	}
+	if t.Sub(from) > 15*24*time.Hour {
+		err = ErrTimeout
+	}
+	return
+}
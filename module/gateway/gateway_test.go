@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireAt(t *testing.T) {
+	from := time.Date(2019, 1, 1, 10, 30, 0, 0, ChannelZone)
+	cases := []struct {
+		timeout string
+		from    time.Time
+		want    time.Time
+		err     bool
+	}{
+		{"1m", from, from.Add(time.Minute), false},
+		{"30m", from, from.Add(30 * time.Minute), false},
+		{"2h", from, from.Add(2 * time.Hour), false},
+		{"1d", from, from.AddDate(0, 0, 1), false},
+		{"15d", from, from.AddDate(0, 0, 15), false},
+		{"360h", from, from.Add(360 * time.Hour), false},
+		{"21600m", from, from.Add(21600 * time.Minute), false},
+		{"1c", from, time.Date(2019, 1, 2, 0, 0, 0, 0, ChannelZone), false},
+		//UTC 2018-12-31 23:30 为北京时间 2019-01-01 07:30,当天0点关闭
+		{"1c", time.Date(2018, 12, 31, 23, 30, 0, 0, time.UTC), time.Date(2019, 1, 2, 0, 0, 0, 0, ChannelZone), false},
+		{"16d", from, time.Time{}, true},
+		{"361h", from, time.Time{}, true},
+		{"2c", from, time.Time{}, true},
+		{"0m", from, time.Time{}, true},
+		{"-1m", from, time.Time{}, true},
+		{"10s", from, time.Time{}, true},
+		{"1.5h", from, time.Time{}, true},
+		{"m", from, time.Time{}, true},
+		{"", from, time.Time{}, true},
+	}
+	for _, c := range cases {
+		got, err := ExpireAt(c.timeout, c.from)
+		if c.err {
+			if err != ErrTimeout {
+				t.Errorf("ExpireAt(%q) = %v, %v, want ErrTimeout", c.timeout, got, err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(c.want) {
+			t.Errorf("ExpireAt(%q, %v) = %v, %v, want %v", c.timeout, c.from, got, err, c.want)
+		}
+	}
+}
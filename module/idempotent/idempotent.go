@@ -0,0 +1,128 @@
+package idempotent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"pay_service/module/auth"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+)
+
+const contentType = "application/json; charset=utf-8"
+
+//记录响应内容的ResponseWriter
+type recordWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+//幂等检查中间件,幂等键取请求头Idempotency-Key,没有时取请求参数keyField(如trade_no,out_refund_no),
+//按调用方和商户区分.相同幂等键的重复请求直接返回首次响应,不再调用渠道;请求内容不一致时返回ERR_IDEMPOTENT.
+//可重试的错误响应和处理中panic时不保存,之后的请求重新处理
+func Check(scope, keyField string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := store.Default()
+		if s == nil {
+			return
+		}
+		buffer, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			gateway.ReturnError(ERR_INVALID_PARAM, MSG_IVALID_PARAM, c)
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(buffer))
+		var param map[string]interface{}
+		json.Unmarshal(buffer, &param)
+		key := c.GetHeader(IDEMPOTENCY)
+		if key == EMPTY {
+			key, _ = param[keyField].(string)
+		}
+		if key == EMPTY {
+			return
+		}
+		merchantId, _ := param[MERCHANT_ID].(string)
+		record := store.Idempotency{Key: scope + ":" + c.GetString(auth.HEADER_KEY) + ":" + merchantId + ":" + key,
+			RequestHash: hashOf(buffer, param)}
+		if err = s.CreateIdempotency(record); err == store.ErrDuplicate {
+			replay(s, record, c)
+			return
+		} else if err != nil {
+			fmt.Println("idempotency create error:", err)
+			return
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				s.DeleteIdempotency(record.Key)
+				panic(r)
+			}
+		}()
+		writer := &recordWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		if writer.body.Len() == 0 || retryable(writer.body.Bytes()) {
+			s.DeleteIdempotency(record.Key)
+			return
+		}
+		record.Status = writer.Status()
+		record.Response = writer.body.String()
+		if err = s.UpdateIdempotency(record); err != nil {
+			fmt.Println("idempotency update error:", err)
+		}
+	}
+}
+
+//返回首次响应
+func replay(s store.Store, record store.Idempotency, c *gin.Context) {
+	defer c.Abort()
+	first, err := s.GetIdempotency(record.Key)
+	if err != nil {
+		gateway.ReturnError(ERR_PROCESSING, MSG_PROCESSING, c)
+		return
+	}
+	if first.RequestHash != record.RequestHash {
+		gateway.ReturnError(ERR_IDEMPOTENT, MSG_IDEMPOTENT, c)
+		return
+	}
+	if first.Status == 0 {
+		gateway.ReturnError(ERR_PROCESSING, MSG_PROCESSING, c)
+		return
+	}
+	c.Data(first.Status, contentType, []byte(first.Response))
+}
+
+//响应的错误码可重试时不保存,相同请求可再次调用渠道
+func retryable(response []byte) bool {
+	var ret struct {
+		ErrCode int `json:"err_code"`
+	}
+	json.Unmarshal(response, &ret)
+	return Retryable(ret.ErrCode)
+}
+
+//请求内容摘要,json请求按字段排序后计算,忽略字段顺序和空白
+func hashOf(buffer []byte, param map[string]interface{}) string {
+	if param != nil {
+		if b, err := json.Marshal(param); err == nil {
+			buffer = b
+		}
+	}
+	sum := sha256.Sum256(buffer)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,150 @@
+package merchant
+
+import (
+	"fmt"
+	. "pay_service/module/comm"
+	"strings"
+	"utils/file"
+)
+
+//配置文件字段
+const (
+	SECTION_WECHAT = "weChat"    //默认商户微信配置
+	SECTION_ALIPAY = "AliPay"    //默认商户支付宝配置
+	SECTION_LIST   = "merchant"  //商户列表配置
+	KEY_MERCHANTS  = "merchants" //商户标识列表,逗号分隔
+	SECTION_PREFIX = "merchant_" //商户配置前缀,如[merchant_store1]
+)
+
+//默认商户的证书和密钥路径
+const (
+	DEFAULT_CERT_FILE          = "resource/apiclient_cert.pem" //微信证书路径
+	DEFAULT_KEY_FILE           = "resource/apiclient_key.pem"  //微信证书私钥路径
+	DEFAULT_ALIPAY_PUBLIC_KEY  = "resource/alipay_public.txt"  //支付宝平台公钥路径
+	DEFAULT_ALIPAY_PRIVATE_KEY = "resource/alipay_private.txt" //支付宝商户私钥路径
+)
+
+//商户配置
+type Merchant struct {
+	Id                 string //商户标识,默认商户为空
+	WxAppId            string //微信公众号appId
+	WxMchId            string //微信商户号
+	WxAppSecret        string //微信app密钥
+	WxApiSecret        string //微信api密钥
+	WxPaymentNotify    string //公众号支付oauth2回调地址
+	WxMinProgramId     string //小程序id
+	WxMinProgramSecret string //小程序密钥
+	WxCertFile         string //微信证书路径
+	WxKeyFile          string //微信证书私钥路径
+	WxSubMchId         string //微信子商户号,配置后以服务商身份下单,微信配置为服务商的配置
+	WxSubAppId         string //微信子商户公众号或APP的appid
+	WxSubAppSecret     string //微信子商户公众号的app密钥,公众号支付获取sub_openid
+	AliPayAppId        string //支付宝appId
+	AliPayPrivateKey   string //支付宝商户私钥
+	AliPayPublicKey    string //支付宝平台公钥
+	AliPayAuthToken    string //支付宝第三方应用授权令牌(app_auth_token),配置后代子商户调用接口
+	AliPaySellerId     string //支付宝卖家账号ID(PID),校验异步通知的seller_id,未配置时拒绝异步通知
+}
+
+var merchants = make(map[string]Merchant)
+
+//是否开通微信支付
+func (m Merchant) HasWeChat() bool {
+	return m.WxMchId != EMPTY
+}
+
+//是否开通支付宝支付
+func (m Merchant) HasAliPay() bool {
+	return m.AliPayAppId != EMPTY
+}
+
+//读取商户配置.默认商户读取[weChat],[AliPay]和resource目录下的证书密钥,
+//其它商户在[merchant]merchants中列出,每个商户在[merchant_商户标识]中配置
+func Load(confPath string) (list []Merchant) {
+	def := Merchant{
+		WxAppId:            file.ReadConfig(SECTION_WECHAT, "wxAppId", confPath),
+		WxMchId:            file.ReadConfig(SECTION_WECHAT, "wxMchId", confPath),
+		WxAppSecret:        file.ReadConfig(SECTION_WECHAT, "wxAppSecret", confPath),
+		WxApiSecret:        file.ReadConfig(SECTION_WECHAT, "wxApiSecret", confPath),
+		WxPaymentNotify:    file.ReadConfig(SECTION_WECHAT, "wxPaymentNotify", confPath),
+		WxMinProgramId:     file.ReadConfig(SECTION_WECHAT, "wxMinProgramId", confPath),
+		WxMinProgramSecret: file.ReadConfig(SECTION_WECHAT, "wxMinProgramSecret", confPath),
+		WxCertFile:         DEFAULT_CERT_FILE,
+		WxKeyFile:          DEFAULT_KEY_FILE,
+		WxSubMchId:         file.ReadConfig(SECTION_WECHAT, "wxSubMchId", confPath),
+		WxSubAppId:         file.ReadConfig(SECTION_WECHAT, "wxSubAppId", confPath),
+		WxSubAppSecret:     file.ReadConfig(SECTION_WECHAT, "wxSubAppSecret", confPath),
+		AliPayAppId:        file.ReadConfig(SECTION_ALIPAY, "aliPayAppId", confPath),
+		AliPayAuthToken:    file.ReadConfig(SECTION_ALIPAY, "aliPayAppAuthToken", confPath),
+		AliPaySellerId:     file.ReadConfig(SECTION_ALIPAY, "aliPaySellerId", confPath),
+		AliPayPublicKey:    readKey(DEFAULT_ALIPAY_PUBLIC_KEY),
+		AliPayPrivateKey:   readKey(DEFAULT_ALIPAY_PRIVATE_KEY),
+	}
+	if def.WxAppId == EMPTY || def.WxMchId == EMPTY || def.WxAppSecret == EMPTY || def.WxApiSecret == EMPTY {
+		fmt.Println("read config file fail")
+	}
+	list = append(list, def)
+	for _, id := range strings.Split(file.ReadConfig(SECTION_LIST, KEY_MERCHANTS, confPath), ",") {
+		if id = strings.TrimSpace(id); id == EMPTY {
+			continue
+		}
+		section := SECTION_PREFIX + id
+		m := Merchant{
+			Id:                 id,
+			WxAppId:            file.ReadConfig(section, "wxAppId", confPath),
+			WxMchId:            file.ReadConfig(section, "wxMchId", confPath),
+			WxAppSecret:        file.ReadConfig(section, "wxAppSecret", confPath),
+			WxApiSecret:        file.ReadConfig(section, "wxApiSecret", confPath),
+			WxPaymentNotify:    file.ReadConfig(section, "wxPaymentNotify", confPath),
+			WxMinProgramId:     file.ReadConfig(section, "wxMinProgramId", confPath),
+			WxMinProgramSecret: file.ReadConfig(section, "wxMinProgramSecret", confPath),
+			WxCertFile:         file.ReadConfig(section, "wxCertFile", confPath),
+			WxKeyFile:          file.ReadConfig(section, "wxKeyFile", confPath),
+			WxSubMchId:         file.ReadConfig(section, "wxSubMchId", confPath),
+			WxSubAppId:         file.ReadConfig(section, "wxSubAppId", confPath),
+			WxSubAppSecret:     file.ReadConfig(section, "wxSubAppSecret", confPath),
+			AliPayAppId:        file.ReadConfig(section, "aliPayAppId", confPath),
+			AliPayAuthToken:    file.ReadConfig(section, "aliPayAppAuthToken", confPath),
+			AliPaySellerId:     file.ReadConfig(section, "aliPaySellerId", confPath),
+			AliPayPublicKey:    readKey(file.ReadConfig(section, "aliPayPublicKey", confPath)),
+			AliPayPrivateKey:   readKey(file.ReadConfig(section, "aliPayPrivateKey", confPath)),
+		}
+		//未配置证书路径时使用resource/商户标识/下的证书
+		if m.WxCertFile == EMPTY {
+			m.WxCertFile = "resource/" + id + "/apiclient_cert.pem"
+		}
+		if m.WxKeyFile == EMPTY {
+			m.WxKeyFile = "resource/" + id + "/apiclient_key.pem"
+		}
+		if !m.HasWeChat() && !m.HasAliPay() {
+			fmt.Println("merchant without wxMchId or aliPayAppId:", id)
+			continue
+		}
+		list = append(list, m)
+	}
+	return
+}
+
+//注册商户
+func Register(m Merchant) {
+	merchants[m.Id] = m
+}
+
+//获取商户,id为空时为默认商户
+func Get(id string) (m Merchant, ok bool) {
+	m, ok = merchants[id]
+	return
+}
+
+//读取密钥文件,路径为空或读取失败时返回空
+func readKey(path string) (key string) {
+	if path == EMPTY {
+		return
+	}
+	if buff, err := file.ReadFile(path); err == nil {
+		key = string(buff)
+	} else {
+		fmt.Println("load resource file error:", err)
+	}
+	return
+}
@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"strings"
+)
+
+//支付宝异步通知应答
+const (
+	ALIPAY_ACK_SUCCESS = "success" //接收成功
+	ALIPAY_ACK_FAIL    = "failure" //接收失败,支付宝稍后重发
+	maxCallbackBodyLen = 64 << 10  //渠道通知的最大长度
+)
+
+//接收渠道异步通知,验签解密后更新本地订单和退款,按渠道要求应答.状态变化由通知队列以统一格式通知商户
+func Callback(c *gin.Context) {
+	channel, merchantId := c.Param("channel"), c.Param("merchant")
+	g, ok := gateway.Get(merchantId, channel)
+	if !ok {
+		ack(c, channel, http.StatusNotFound, MSG_MERCHANT+":"+merchantId)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxCallbackBodyLen))
+	if err != nil {
+		ack(c, channel, http.StatusBadRequest, MSG_IVALID_PARAM)
+		return
+	}
+	ret, err := g.VerifyNotify(string(body))
+	if err != nil {
+		fmt.Printf("notify callback %s %s verify error: %v\n", channel, merchantId, err)
+		ack(c, channel, http.StatusBadRequest, err.Error())
+		return
+	}
+	//重复通知已处理过,直接应答成功
+	fmt.Printf("notify callback %s %s %s %s %s duplicate:%v\n", channel, merchantId, ret.NotifyType, ret.TradeNo, ret.TradeState,
+		ret.Duplicate)
+	ack(c, channel, HTTP_SUCCESS, EMPTY)
+}
+
+//按渠道要求应答,msg为空时表示接收成功
+func ack(c *gin.Context, channel string, status int, msg string) {
+	switch channel {
+	case gateway.WECHAT:
+		code := "SUCCESS"
+		if msg == EMPTY {
+			msg = OK
+		} else {
+			code = "FAIL"
+		}
+		msg = strings.Replace(msg, "]]>", EMPTY, -1)
+		c.Data(status, "text/xml; charset=utf-8", []byte("<xml><return_code><![CDATA["+code+"]]></return_code>"+
+			"<return_msg><![CDATA["+msg+"]]></return_msg></xml>"))
+	default:
+		body := ALIPAY_ACK_SUCCESS
+		if msg != EMPTY {
+			body = ALIPAY_ACK_FAIL
+		}
+		c.Data(status, "text/plain; charset=utf-8", []byte(body))
+	}
+}
@@ -0,0 +1,270 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//通知事件类型
+const (
+	EVENT_ORDER  = "ORDER_STATUS"  //订单状态变化
+	EVENT_REFUND = "REFUND_STATUS" //退款状态变化
+)
+
+//通知签名请求头,签名为HMAC-SHA256(密钥, 时间戳+"\n"+随机串+"\n"+请求内容)的十六进制
+const (
+	HEADER_TIMESTAMP = "X-Pay-Timestamp" //时间戳
+	HEADER_NONCE     = "X-Pay-Nonce"     //随机串
+	HEADER_SIGNATURE = "X-Pay-Signature" //签名
+)
+
+const (
+	ACK_SUCCESS   = "SUCCESS" //商户应答内容为SUCCESS表示接收成功
+	batchSize     = 20        //每次投递的通知数量
+	workerCount   = 5         //并发投递数量
+	defaultLimit  = 50        //查询通知默认数量
+	maxAckBodyLen = 1024      //读取商户应答的最大长度
+)
+
+//失败重试间隔,与微信支付结果通知一致,用完后标记为投递失败
+var retrySchedule = []time.Duration{
+	15 * time.Second, 15 * time.Second, 30 * time.Second, 3 * time.Minute, 10 * time.Minute, 20 * time.Minute,
+	30 * time.Minute, 30 * time.Minute, 30 * time.Minute, 60 * time.Minute, 3 * time.Hour, 3 * time.Hour,
+	3 * time.Hour, 6 * time.Hour, 6 * time.Hour,
+}
+
+//通知内容
+type Payload struct {
+	Event         string `json:"event"`                   //事件类型
+	TradeNo       string `json:"trade_no"`                //商户订单号
+	MerchantId    string `json:"merchant_id,omitempty"`   //商户标识
+	Channel       string `json:"channel"`                 //支付渠道
+	TransactionId string `json:"transaction_id"`          //渠道订单号
+	Status        string `json:"status"`                  //订单状态
+	TotalFee      Money  `json:"total_fee"`               //订单金额(分)
+	OutRefundNo   string `json:"out_refund_no,omitempty"` //商户退款单号
+	RefundFee     *Money `json:"refund_fee,omitempty"`    //退款金额(分),退款事件时使用
+	RefundStatus  string `json:"refund_status,omitempty"` //退款状态
+	Timestamp     int64  `json:"timestamp"`               //事件时间
+}
+
+//通知列表返回
+type RetNotifies struct {
+	ErrCode int            `json:"err_code"`
+	ErrMsg  string         `json:"err_msg"`
+	List    []store.Notify `json:"list"`
+}
+
+var errNoSecret = errors.New("notify secret not configured") //未配置通知签名密钥时不投递
+
+var (
+	secret string                                    //通知签名密钥
+	client = &http.Client{Timeout: 10 * time.Second} //投递客户端
+	wake   = make(chan struct{}, 1)                  //有新通知时唤醒投递
+)
+
+//初始化商户通知,订单和退款状态变化时在同一事务中加入通知队列.未配置签名密钥时通知只入队不投递
+func Init(notifySecret string) {
+	secret = notifySecret
+	if secret == EMPTY {
+		fmt.Println("notify secret not configured, merchant notifies will not be delivered")
+	}
+	store.SetOutbox(notifyOf)
+}
+
+//启动通知投递
+func Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+			deliverDue()
+		}
+	}()
+}
+
+//状态变化事件对应的通知,订单没有回调地址时不通知
+func notifyOf(e store.Event) (n store.Notify, ok bool) {
+	if e.Order.NotifyUrl == EMPTY {
+		return
+	}
+	payload := Payload{Event: EVENT_ORDER, TradeNo: e.Order.TradeNo, MerchantId: e.Order.MerchantId, Channel: e.Order.Channel,
+		TransactionId: e.Order.TransactionId,
+		Status:        e.Order.Status, TotalFee: e.Order.TotalFee, Timestamp: time.Now().Unix()}
+	if e.Refund != nil {
+		payload.Event = EVENT_REFUND
+		payload.OutRefundNo = e.Refund.OutRefundNo
+		payload.RefundFee = &e.Refund.RefundFee
+		payload.RefundStatus = e.Refund.Status
+	}
+	buff, _ := json.Marshal(payload)
+	n = store.Notify{TradeNo: e.Order.TradeNo, Event: payload.Event, NotifyUrl: e.Order.NotifyUrl, Payload: string(buff),
+		Status: DELIVERY_PENDING, NextAt: time.Now().Unix()}
+	ok = true
+	return
+}
+
+//通知签名
+func Sign(timestamp, nonce, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//查询商户通知
+func ListNotifies(c *gin.Context) {
+	s := store.Default()
+	if s == nil {
+		gateway.ReturnError(ERR_NOT_SUPPORT, MSG_NOT_SUPPORT, c)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	if list, err := s.ListNotifies(c.Query("status"), limit); err == nil {
+		c.JSON(HTTP_SUCCESS, RetNotifies{List: list})
+	} else {
+		gateway.ReturnError(ERR_INTERNAL, err.Error(), c)
+	}
+}
+
+//重新投递商户通知
+func ReplayNotify(c *gin.Context) {
+	s := store.Default()
+	if s == nil {
+		gateway.ReturnError(ERR_NOT_SUPPORT, MSG_NOT_SUPPORT, c)
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		gateway.ReturnError(ERR_INVALID_PARAM, MSG_IVALID_PARAM+":id", c)
+		return
+	}
+	n, err := s.GetNotify(id)
+	if err != nil {
+		gateway.ReturnError(ERR_INVALID_PARAM, err.Error(), c)
+		return
+	}
+	n.Status = DELIVERY_PENDING
+	n.Attempts = 0
+	n.NextAt = time.Now().Unix()
+	n.LastError = EMPTY
+	if err = s.UpdateNotify(n); err != nil {
+		gateway.ReturnError(ERR_INTERNAL, err.Error(), c)
+		return
+	}
+	wakeUp()
+	c.JSON(HTTP_SUCCESS, RetNotifies{List: []store.Notify{n}})
+}
+
+//唤醒投递
+func wakeUp() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+//投递到期的通知
+func deliverDue() {
+	s := store.Default()
+	if s == nil {
+		return
+	}
+	list, err := s.ListDueNotifies(time.Now().Unix(), batchSize)
+	if err != nil {
+		fmt.Println("notify list error:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workerCount)
+	for _, n := range list {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n store.Notify) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			deliver(s, n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+//投递通知,失败时按重试间隔安排下次投递
+func deliver(s store.Store, n store.Notify) {
+	n.Attempts++
+	if err := post(n.NotifyUrl, n.Payload); err == nil {
+		n.Status = DELIVERY_SUCCESS
+		n.LastError = EMPTY
+	} else {
+		n.LastError = err.Error()
+		if n.Attempts > len(retrySchedule) {
+			n.Status = DELIVERY_FAILED
+		} else {
+			n.NextAt = time.Now().Add(retrySchedule[n.Attempts-1]).Unix()
+		}
+	}
+	if err := s.UpdateNotify(n); err != nil {
+		fmt.Println("notify update error:", err)
+	}
+}
+
+//发送签名通知,商户返回2xx且应答为SUCCESS时表示接收成功
+func post(url, body string) (err error) {
+	if secret == EMPTY {
+		return errNoSecret
+	}
+	var req *http.Request
+	var resp *http.Response
+	if req, err = http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body)); err != nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := nonceStr()
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(HEADER_TIMESTAMP, timestamp)
+	req.Header.Set(HEADER_NONCE, nonce)
+	req.Header.Set(HEADER_SIGNATURE, Sign(timestamp, nonce, body))
+	if resp, err = client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	ack, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxAckBodyLen))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("http status %d", resp.StatusCode)
+	} else if strings.TrimSpace(string(ack)) != ACK_SUCCESS {
+		err = fmt.Errorf("unexpected ack: %s", ack)
+	}
+	return
+}
+
+//随机串
+func nonceStr() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
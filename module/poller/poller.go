@@ -0,0 +1,227 @@
+package poller
+
+import (
+	"fmt"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"sync"
+	"time"
+)
+
+//轮询配置,时间单位为秒
+type Config struct {
+	Interval    int     //首次查询间隔
+	MaxInterval int     //最大查询间隔
+	Multiplier  float64 //查询间隔增长倍数
+	Timeout     int     //下单后等待用户支付的时间,超过后撤销订单
+	Workers     int     //并发查询数量
+}
+
+//默认配置,与微信付款码支付建议一致:用户支付中时每隔几秒查询,30秒未支付撤销订单
+var DefaultConfig = Config{Interval: 2, MaxInterval: 10, Multiplier: 1.5, Timeout: 30, Workers: 4}
+
+const (
+	batchSize     = 50  //每次取出的到期轮询数量
+	reverseWindow = 300 //截止后继续尝试撤销的时间(秒),超过后标记失败
+)
+
+var (
+	config   = DefaultConfig
+	tasks    chan store.Poll         //待查询的轮询
+	inFlight = make(map[string]bool) //正在查询的商户订单,避免重复查询
+	mu       sync.Mutex
+)
+
+//初始化轮询配置,未配置的项使用默认值
+func Init(c Config) {
+	if c.Interval > 0 {
+		config.Interval = c.Interval
+	}
+	if c.MaxInterval > 0 {
+		config.MaxInterval = c.MaxInterval
+	}
+	if c.Multiplier >= 1 {
+		config.Multiplier = c.Multiplier
+	}
+	if c.Timeout > 0 {
+		config.Timeout = c.Timeout
+	}
+	if c.Workers > 0 {
+		config.Workers = c.Workers
+	}
+}
+
+//启动轮询,重启后继续处理未完成的轮询
+func Start() {
+	tasks = make(chan store.Poll, config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go worker()
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			dispatchDue()
+		}
+	}()
+}
+
+//付款码订单加入轮询,查询到最终状态前持续查询,超时未支付时撤销订单
+func Schedule(merchantId, channel, tradeNo string) {
+	s := store.Default()
+	if s == nil {
+		return
+	}
+	now := time.Now().Unix()
+	p := store.Poll{TradeNo: tradeNo, MerchantId: merchantId, Channel: channel, Status: POLL_PENDING, NextAt: now + int64(config.Interval),
+		Deadline: now + int64(config.Timeout)}
+	if err := s.SavePoll(p); err != nil {
+		fmt.Println("poller schedule error:", err)
+	}
+}
+
+//付款码下单后按结果加入轮询,未确认支付成功或调用渠道失败(可能是超时)时需要查询确认.
+//渠道明确拒绝(付款码无效,余额不足等)时关闭订单,不再查询
+func AfterMicroPay(merchantId, channel, tradeNo string, ret gateway.OrderResult, err error) {
+	if err == nil && gateway.StatusOf(ret.TradeState) == STATUS_PAID {
+		return
+	}
+	if err == nil && declined(ret.ErrCode) {
+		closeOrder(merchantId, tradeNo)
+		return
+	}
+	//调用渠道失败时结果未知,需要查询;其他不可重试的错误渠道未受理
+	if code := gateway.ErrorCode(err); err != nil && code != ERR_CALL_PARMENT && !Retryable(code) {
+		return
+	}
+	Schedule(merchantId, channel, tradeNo)
+}
+
+//分发到期的轮询
+func dispatchDue() {
+	s := store.Default()
+	if s == nil {
+		return
+	}
+	list, err := s.ListDuePolls(time.Now().Unix(), batchSize)
+	if err != nil {
+		fmt.Println("poller list error:", err)
+		return
+	}
+	for _, p := range list {
+		mu.Lock()
+		busy := inFlight[p.MerchantId+":"+p.TradeNo]
+		inFlight[p.MerchantId+":"+p.TradeNo] = true
+		mu.Unlock()
+		if !busy {
+			tasks <- p
+		}
+	}
+}
+
+func worker() {
+	for p := range tasks {
+		process(p)
+		mu.Lock()
+		delete(inFlight, p.MerchantId+":"+p.TradeNo)
+		mu.Unlock()
+	}
+}
+
+//查询订单,已有最终状态时结束轮询,交易不存在或已关闭时关闭订单,超时未支付时撤销订单
+func process(p store.Poll) {
+	s := store.Default()
+	g, ok := gateway.Get(p.MerchantId, p.Channel)
+	if !ok {
+		p.Status = POLL_FAILED
+		save(s, p)
+		return
+	}
+	now := time.Now().Unix()
+	p.Attempts++
+	if now < p.Deadline {
+		ret, err := g.Query(p.TradeNo)
+		if err == gateway.ErrNotSupport {
+			p.Status = POLL_FAILED
+			save(s, p)
+			return
+		}
+		if err == nil && (ret.ErrCode == ERR_TRADE_NOT_EXIST || ret.ErrCode == ERR_ORDER_CLOSED) {
+			//只在渠道明确交易不存在或已关闭时关闭订单,其他查询错误继续轮询,到期后撤销
+			closeOrder(p.MerchantId, p.TradeNo)
+			p.Status = POLL_DONE
+			save(s, p)
+			return
+		}
+		if err == nil && ret.ErrCode == 0 {
+			p.LastState = ret.TradeState
+			switch gateway.StatusOf(ret.TradeState) {
+			case STATUS_PAID, STATUS_CLOSED, STATUS_REVERSED:
+				p.Status = POLL_DONE
+				save(s, p)
+				return
+			}
+		}
+		p.NextAt = now + backoff(p.Attempts)
+		if p.NextAt > p.Deadline {
+			p.NextAt = p.Deadline
+		}
+		save(s, p)
+		return
+	}
+	//超时未支付,撤销订单
+	ret, err := g.Reverse(p.TradeNo)
+	switch {
+	case err == nil && ret.ErrCode == 0:
+		p.Status = POLL_REVERSED
+	case err == gateway.ErrNotSupport || err == gateway.ErrOrderState || now > p.Deadline+reverseWindow:
+		//渠道不支持撤销,订单已是最终状态,或多次撤销失败
+		p.Status = POLL_FAILED
+		if err == gateway.ErrOrderState {
+			p.Status = POLL_DONE
+		}
+	default:
+		p.NextAt = now + int64(config.Interval)
+	}
+	if err != nil {
+		fmt.Printf("poller reverse %s error: %v\n", p.TradeNo, err)
+	}
+	save(s, p)
+}
+
+//付款码支付渠道明确拒绝的错误码,不可重试且订单未扣款.调用失败时结果未知,订单已支付或单号重复时需要查询确认
+func declined(code int) bool {
+	switch code {
+	case 0, ERR_CALL_PARMENT, ERR_ORDER_PAID, ERR_DUPLICATE_ORDER:
+		return false
+	}
+	return !Retryable(code)
+}
+
+//关闭渠道拒绝的订单
+func closeOrder(merchantId, tradeNo string) {
+	if s := store.Default(); s != nil {
+		if _, err := store.Transit(s, merchantId, tradeNo, STATUS_CLOSED, EMPTY); err != nil && err != store.ErrNotFound {
+			fmt.Printf("poller close order %s error: %v\n", tradeNo, err)
+		}
+	}
+}
+
+//第n次查询后的等待时间
+func backoff(n int) int64 {
+	interval := float64(config.Interval)
+	for i := 1; i < n; i++ {
+		interval *= config.Multiplier
+		if interval >= float64(config.MaxInterval) {
+			return int64(config.MaxInterval)
+		}
+	}
+	return int64(interval)
+}
+
+func save(s store.Store, p store.Poll) {
+	if err := s.SavePoll(p); err != nil {
+		fmt.Println("poller save error:", err)
+	}
+}
@@ -0,0 +1,327 @@
+package reconcile
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"pay_service/module/bill"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"strings"
+	"time"
+)
+
+//差异类型
+const (
+	DIFF_LONG           = "LONG"            //长款,渠道有支付记录,本地无订单
+	DIFF_SHORT          = "SHORT"           //短款,本地已支付,渠道无支付记录
+	DIFF_AMOUNT         = "AMOUNT_MISMATCH" //金额不一致
+	DIFF_STATUS         = "STATUS_MISMATCH" //状态不一致
+	DIFF_MISSING_REFUND = "MISSING_REFUND"  //退款缺失,渠道有退款本地无记录或本地退款成功渠道无记录
+)
+
+const DATE_FORMAT = "2006-01-02" //账单日期格式
+
+//各渠道用于对账的交易账单类型
+var tradeBillTypes = map[string]string{
+	gateway.WECHAT: "ALL",
+	gateway.ALIPAY: "trade",
+}
+
+//对账配置
+type Config struct {
+	Time      string   //每天执行时间,如02:00,为空时不自动执行
+	Channels  []string //自动对账的支付渠道,为空时为全部渠道
+	ReportDir string   //差异报告保存目录,为空时不保存
+}
+
+var config Config
+
+//对账差异
+type Discrepancy struct {
+	Type          string `json:"type"`                    //差异类型
+	TradeNo       string `json:"trade_no"`                //商户订单号
+	OutRefundNo   string `json:"out_refund_no,omitempty"` //商户退款单号
+	TransactionId string `json:"transaction_id"`          //渠道订单号
+	LocalStatus   string `json:"local_status"`            //本地订单或退款状态
+	LocalAmount   Money  `json:"local_amount"`            //本地金额(分)
+	BillAmount    Money  `json:"bill_amount"`             //账单金额(分)
+	Detail        string `json:"detail"`                  //差异说明
+}
+
+//对账报告
+type Report struct {
+	Channel       string        `json:"channel"`       //支付渠道
+	MerchantId    string        `json:"merchant_id"`   //商户标识
+	BillDate      string        `json:"bill_date"`     //账单日期
+	BillCount     int           `json:"bill_count"`    //账单记录数
+	OrderCount    int           `json:"order_count"`   //本地订单数
+	RefundCount   int           `json:"refund_count"`  //本地退款数
+	Discrepancies []Discrepancy `json:"discrepancies"` //差异
+	CreatedAt     int64         `json:"created_at"`    //生成时间
+}
+
+//初始化对账配置
+func Init(c Config) {
+	config = c
+}
+
+//启动每日自动对账,对已注册对账单下载的商户渠道核对前一天的账单.执行时间和账单日期都按北京时间
+func Start() {
+	if config.Time == EMPTY {
+		return
+	}
+	at, err := time.Parse("15:04", config.Time)
+	if err != nil {
+		fmt.Println("reconcile time error:", err)
+		return
+	}
+	go func() {
+		for {
+			now := time.Now().In(gateway.ChannelZone)
+			next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, gateway.ChannelZone)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(next.Sub(now))
+			RunAll(next.AddDate(0, 0, -1).Format(DATE_FORMAT))
+		}
+	}()
+}
+
+//核对全部商户渠道的账单,只核对配置的渠道
+func RunAll(billDate string) {
+	for _, t := range bill.Targets() {
+		if !enabled(t.Channel) {
+			continue
+		}
+		if report, err := Run(t.MerchantId, t.Channel, billDate); err == nil {
+			fmt.Printf("reconcile %s %s %s: %d bills, %d discrepancies\n", t.MerchantId, t.Channel, billDate, report.BillCount,
+				len(report.Discrepancies))
+		} else {
+			fmt.Printf("reconcile %s %s %s error: %v\n", t.MerchantId, t.Channel, billDate, err)
+		}
+	}
+}
+
+func enabled(channel string) bool {
+	if len(config.Channels) == 0 {
+		return true
+	}
+	for _, c := range config.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+//下载商户渠道的交易账单并与本地订单和退款核对,配置了报告目录时保存JSON和CSV报告
+func Run(merchantId, channel, billDate string) (report Report, err error) {
+	s := store.Default()
+	if s == nil {
+		err = gateway.ErrNotSupport
+		return
+	}
+	billType, ok := tradeBillTypes[channel]
+	if !ok {
+		err = gateway.ErrNotSupport
+		return
+	}
+	var day time.Time
+	//账单日按北京时间划分
+	if day, err = time.ParseInLocation(DATE_FORMAT, billDate, gateway.ChannelZone); err != nil {
+		err = errors.New(MSG_IVALID_PARAM + ":" + BILL_DATE)
+		return
+	}
+	var bills []store.Bill
+	if bills, err = bill.Download(merchantId, channel, billType, billDate); err != nil {
+		return
+	}
+	from, to := day.Unix(), day.AddDate(0, 0, 1).Unix()
+	var orders []store.Order
+	if orders, err = s.ListOrdersPaidBetween(merchantId, channel, from, to); err != nil {
+		return
+	}
+	var refunds []store.Refund
+	if refunds, err = s.ListRefundsBetween(merchantId, channel, from, to); err != nil {
+		return
+	}
+	report = Compare(s, bills, orders, refunds)
+	report.Channel, report.MerchantId, report.BillDate = channel, merchantId, billDate
+	if config.ReportDir != EMPTY {
+		if e := report.Save(config.ReportDir); e != nil {
+			fmt.Println("reconcile save report error:", e)
+		}
+	}
+	return
+}
+
+//核对账单记录与本地订单和退款.orders为账单日支付的订单,refunds为账单日创建的退款,账单中的其他订单和退款从s中查询.
+//本地支付时间与渠道支付时间跨日的订单会报短款,需要通过Confirm查询确认
+func Compare(s store.Store, bills []store.Bill, orders []store.Order, refunds []store.Refund) (report Report) {
+	report = Report{BillCount: len(bills), OrderCount: len(orders), RefundCount: len(refunds), CreatedAt: time.Now().Unix()}
+	paid := make(map[string]bool)     //账单中已支付的订单
+	refunded := make(map[string]bool) //账单中的退款
+	for _, b := range bills {
+		switch b.Kind {
+		case BILL_PAY:
+			paid[b.TradeNo] = true
+			report.add(comparePay(s, b))
+		case BILL_REFUND:
+			d, outRefundNo := compareRefund(s, b)
+			refunded[outRefundNo] = true
+			report.add(d)
+		}
+	}
+	for _, o := range orders {
+		if paid[o.TradeNo] {
+			continue
+		}
+		switch o.Status {
+		case STATUS_PAID, STATUS_PARTIALLY_REFUNDED, STATUS_REFUNDED:
+			report.add(&Discrepancy{Type: DIFF_SHORT, TradeNo: o.TradeNo, TransactionId: o.TransactionId, LocalStatus: o.Status,
+				LocalAmount: o.TotalFee, Detail: "渠道账单无支付记录"})
+		}
+	}
+	for _, r := range refunds {
+		if r.Status == REFUND_SUCCESS && !refunded[r.OutRefundNo] {
+			report.add(&Discrepancy{Type: DIFF_MISSING_REFUND, TradeNo: r.TradeNo, OutRefundNo: r.OutRefundNo, LocalStatus: r.Status,
+				LocalAmount: r.RefundFee, Detail: "渠道账单无退款记录"})
+		}
+	}
+	return
+}
+
+func (r *Report) add(d *Discrepancy) {
+	if d != nil {
+		r.Discrepancies = append(r.Discrepancies, *d)
+	}
+}
+
+//核对支付记录
+func comparePay(s store.Store, b store.Bill) (d *Discrepancy) {
+	order, err := s.GetOrder(b.MerchantId, b.TradeNo)
+	if err != nil || order.Channel != b.Channel {
+		return &Discrepancy{Type: DIFF_LONG, TradeNo: b.TradeNo, TransactionId: b.TransactionId, BillAmount: b.Amount,
+			Detail: "本地无订单记录"}
+	}
+	d = &Discrepancy{TradeNo: b.TradeNo, TransactionId: b.TransactionId, LocalStatus: order.Status, LocalAmount: order.TotalFee,
+		BillAmount: b.Amount}
+	switch {
+	case order.TotalFee.Amount != b.Amount.Amount:
+		d.Type, d.Detail = DIFF_AMOUNT, "订单金额不一致"
+	case order.Status != STATUS_PAID && order.Status != STATUS_PARTIALLY_REFUNDED && order.Status != STATUS_REFUNDED:
+		d.Type, d.Detail = DIFF_STATUS, "渠道已支付,本地订单未支付"
+	default:
+		d = nil
+	}
+	return
+}
+
+//核对退款记录,账单中没有商户退款单号时按订单号和退款金额匹配本地退款
+func compareRefund(s store.Store, b store.Bill) (d *Discrepancy, outRefundNo string) {
+	outRefundNo = b.OutRefundNo
+	refund, err := s.GetRefund(b.MerchantId, outRefundNo)
+	if outRefundNo == EMPTY {
+		err = store.ErrNotFound
+		if list, e := s.ListRefunds(b.MerchantId, b.TradeNo); e == nil {
+			for _, r := range list {
+				if r.RefundFee.Amount == b.Amount.Amount {
+					refund, err, outRefundNo = r, nil, r.OutRefundNo
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return &Discrepancy{Type: DIFF_MISSING_REFUND, TradeNo: b.TradeNo, OutRefundNo: b.OutRefundNo, TransactionId: b.TransactionId,
+			BillAmount: b.Amount, Detail: "本地无退款记录"}, outRefundNo
+	}
+	d = &Discrepancy{TradeNo: b.TradeNo, OutRefundNo: outRefundNo, TransactionId: b.TransactionId, LocalStatus: refund.Status,
+		LocalAmount: refund.RefundFee, BillAmount: b.Amount}
+	switch {
+	case refund.RefundFee.Amount != b.Amount.Amount:
+		d.Type, d.Detail = DIFF_AMOUNT, "退款金额不一致"
+	case refund.Status != REFUND_SUCCESS:
+		d.Type, d.Detail = DIFF_STATUS, "渠道已退款,本地退款未成功"
+	default:
+		d = nil
+	}
+	return
+}
+
+//确认结果
+type Confirmation struct {
+	Order      store.Order           `json:"order"`            //确认后的本地订单
+	TradeState string                `json:"trade_state"`      //渠道交易状态
+	Refund     *gateway.RefundResult `json:"refund,omitempty"` //渠道退款查询结果
+}
+
+//向渠道查询订单和退款确认真实状态,通过记录订单的支付渠道查询,本地订单和退款状态随查询结果更新
+func Confirm(merchantId, channel, tradeNo, outRefundNo string) (ret Confirmation, err error) {
+	g, ok := gateway.Get(merchantId, channel)
+	if !ok {
+		err = gateway.ErrMerchant
+		return
+	}
+	var q gateway.QueryResult
+	if q, err = g.Query(tradeNo); err != nil {
+		return
+	}
+	if q.ErrCode != 0 {
+		err = gateway.NewError(q.ErrCode, q.ErrMsg)
+		return
+	}
+	ret.TradeState = q.TradeState
+	if outRefundNo != EMPTY {
+		var r gateway.RefundResult
+		if r, err = g.QueryRefund(tradeNo, outRefundNo); err != nil {
+			return
+		}
+		ret.Refund = &r
+	}
+	if s := store.Default(); s != nil {
+		ret.Order, _ = s.GetOrder(merchantId, tradeNo)
+	}
+	return
+}
+
+//命令行对账,如: pay_service reconcile -channel wechat -date 2019-01-01
+func RunCommand(args []string) (err error) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format(DATE_FORMAT)
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	channel := flags.String("channel", EMPTY, "支付渠道(wechat,alipay),为空时为全部渠道")
+	merchantId := flags.String("merchant", EMPTY, "商户标识,为空时为默认商户")
+	billDate := flags.String("date", yesterday, "账单日期")
+	format := flags.String("format", "json", "报告输出格式(json,csv)")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	found := false
+	for _, t := range bill.Targets() {
+		if t.MerchantId != *merchantId || (*channel != EMPTY && t.Channel != *channel) {
+			continue
+		}
+		found = true
+		var report Report
+		if report, err = Run(t.MerchantId, t.Channel, *billDate); err != nil {
+			return
+		}
+		var out []byte
+		if strings.ToLower(*format) == "csv" {
+			out, err = report.CSV()
+		} else {
+			out, err = report.JSON()
+		}
+		if err != nil {
+			return
+		}
+		fmt.Println(string(out))
+	}
+	if !found {
+		err = gateway.ErrMerchant
+	}
+	return
+}
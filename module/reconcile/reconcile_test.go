@@ -0,0 +1,109 @@
+package reconcile
+
+import (
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"testing"
+)
+
+//只实现核对用到的查询的内存存储
+type memStore struct {
+	store.Store
+	orders  map[string]store.Order
+	refunds map[string]store.Refund
+}
+
+func (s *memStore) GetOrder(merchantId, tradeNo string) (order store.Order, err error) {
+	order, ok := s.orders[tradeNo]
+	if !ok {
+		err = store.ErrNotFound
+	}
+	return
+}
+
+func (s *memStore) GetRefund(merchantId, outRefundNo string) (refund store.Refund, err error) {
+	refund, ok := s.refunds[outRefundNo]
+	if !ok {
+		err = store.ErrNotFound
+	}
+	return
+}
+
+func (s *memStore) ListRefunds(merchantId, tradeNo string) (refunds []store.Refund, err error) {
+	for _, r := range s.refunds {
+		if r.TradeNo == tradeNo {
+			refunds = append(refunds, r)
+		}
+	}
+	return
+}
+
+func TestCompare(t *testing.T) {
+	order := func(tradeNo, status string, fee int64) store.Order {
+		return store.Order{TradeNo: tradeNo, MerchantId: "m1", Channel: gateway.WECHAT, Status: status, TotalFee: Fen(fee)}
+	}
+	pay := func(tradeNo string, fee int64) store.Bill {
+		return store.Bill{TradeNo: tradeNo, MerchantId: "m1", Channel: gateway.WECHAT, Kind: BILL_PAY, Amount: Fen(fee)}
+	}
+	refund := func(tradeNo, outRefundNo string, fee int64) store.Bill {
+		return store.Bill{TradeNo: tradeNo, MerchantId: "m1", Channel: gateway.WECHAT, Kind: BILL_REFUND, OutRefundNo: outRefundNo,
+			Amount: Fen(fee)}
+	}
+	cases := []struct {
+		name    string
+		orders  []store.Order
+		refunds []store.Refund
+		bills   []store.Bill
+		want    []string //期望的差异类型
+	}{
+		{"matched", []store.Order{order("t1", STATUS_PAID, 100)}, nil, []store.Bill{pay("t1", 100)}, nil},
+		{"long", nil, nil, []store.Bill{pay("t1", 100)}, []string{DIFF_LONG}},
+		{"long other channel", []store.Order{{TradeNo: "t1", MerchantId: "m1", Channel: gateway.ALIPAY, Status: STATUS_PAID,
+			TotalFee: Fen(100)}}, nil, []store.Bill{pay("t1", 100)}, []string{DIFF_LONG}},
+		{"short", []store.Order{order("t1", STATUS_PAID, 100)}, nil, nil, []string{DIFF_SHORT}},
+		{"short refunded", []store.Order{order("t1", STATUS_REFUNDED, 100)}, nil, nil, []string{DIFF_SHORT}},
+		{"unpaid not short", []store.Order{order("t1", STATUS_CLOSED, 100)}, nil, nil, nil},
+		{"amount mismatch", []store.Order{order("t1", STATUS_PAID, 100)}, nil, []store.Bill{pay("t1", 99)}, []string{DIFF_AMOUNT}},
+		{"status mismatch", []store.Order{order("t1", STATUS_CREATED, 100)}, nil, []store.Bill{pay("t1", 100)}, []string{DIFF_STATUS}},
+		{"refund matched", []store.Order{order("t1", STATUS_REFUNDED, 100)},
+			[]store.Refund{{OutRefundNo: "r1", TradeNo: "t1", RefundFee: Fen(100), Status: REFUND_SUCCESS}},
+			[]store.Bill{pay("t1", 100), refund("t1", "r1", 100)}, nil},
+		{"refund matched by amount", []store.Order{order("t1", STATUS_PARTIALLY_REFUNDED, 100)},
+			[]store.Refund{{OutRefundNo: "r1", TradeNo: "t1", RefundFee: Fen(30), Status: REFUND_SUCCESS}},
+			[]store.Bill{pay("t1", 100), refund("t1", EMPTY, 30)}, nil},
+		{"refund amount mismatch", []store.Order{order("t1", STATUS_PARTIALLY_REFUNDED, 100)},
+			[]store.Refund{{OutRefundNo: "r1", TradeNo: "t1", RefundFee: Fen(30), Status: REFUND_SUCCESS}},
+			[]store.Bill{pay("t1", 100), refund("t1", "r1", 40)}, []string{DIFF_AMOUNT}},
+		{"refund status mismatch", []store.Order{order("t1", STATUS_PAID, 100)},
+			[]store.Refund{{OutRefundNo: "r1", TradeNo: "t1", RefundFee: Fen(30), Status: REFUND_PROCESSING}},
+			[]store.Bill{pay("t1", 100), refund("t1", "r1", 30)}, []string{DIFF_STATUS}},
+		{"refund missing locally", []store.Order{order("t1", STATUS_PAID, 100)}, nil,
+			[]store.Bill{pay("t1", 100), refund("t1", "r1", 30)}, []string{DIFF_MISSING_REFUND}},
+		{"refund missing in bill", []store.Order{order("t1", STATUS_REFUNDED, 100)},
+			[]store.Refund{{OutRefundNo: "r1", TradeNo: "t1", RefundFee: Fen(100), Status: REFUND_SUCCESS}},
+			[]store.Bill{pay("t1", 100)}, []string{DIFF_MISSING_REFUND}},
+	}
+	for _, c := range cases {
+		s := &memStore{orders: make(map[string]store.Order), refunds: make(map[string]store.Refund)}
+		for _, o := range c.orders {
+			s.orders[o.TradeNo] = o
+		}
+		for _, r := range c.refunds {
+			s.refunds[r.OutRefundNo] = r
+		}
+		report := Compare(s, c.bills, c.orders, c.refunds)
+		if len(report.Discrepancies) != len(c.want) {
+			t.Errorf("%s: got %d discrepancies %+v, want %v", c.name, len(report.Discrepancies), report.Discrepancies, c.want)
+			continue
+		}
+		for i, d := range report.Discrepancies {
+			if d.Type != c.want[i] {
+				t.Errorf("%s: discrepancy %d type %s, want %s", c.name, i, d.Type, c.want[i])
+			}
+		}
+		if report.BillCount != len(c.bills) || report.OrderCount != len(c.orders) || report.RefundCount != len(c.refunds) {
+			t.Errorf("%s: counts %d/%d/%d", c.name, report.BillCount, report.OrderCount, report.RefundCount)
+		}
+	}
+}
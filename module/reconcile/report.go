@@ -0,0 +1,95 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"utils/gin_check"
+)
+
+//确认差异返回
+type RetConfirm struct {
+	ErrCode int    `json:"err_code"`
+	ErrMsg  string `json:"err_msg"`
+	Confirmation
+}
+
+//JSON格式报告
+func (r Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, EMPTY, "  ")
+}
+
+//CSV格式报告,每行一条差异
+func (r Report) CSV() (content []byte, err error) {
+	var buff bytes.Buffer
+	w := csv.NewWriter(&buff)
+	w.Write([]string{"channel", "merchant_id", "bill_date", "type", "trade_no", "out_refund_no", "transaction_id", "local_status",
+		"local_amount", "bill_amount", "detail"})
+	for _, d := range r.Discrepancies {
+		w.Write([]string{r.Channel, r.MerchantId, r.BillDate, d.Type, d.TradeNo, d.OutRefundNo, d.TransactionId, d.LocalStatus,
+			d.LocalAmount.String(), d.BillAmount.String(), d.Detail})
+	}
+	w.Flush()
+	content, err = buff.Bytes(), w.Error()
+	return
+}
+
+//保存JSON和CSV报告,文件名为渠道_商户_日期,默认商户为default
+func (r Report) Save(dir string) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	merchantId := r.MerchantId
+	if merchantId == EMPTY {
+		merchantId = "default"
+	}
+	name := filepath.Join(dir, r.Channel+"_"+merchantId+"_"+r.BillDate)
+	var content []byte
+	if content, err = r.JSON(); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(name+".json", content, 0644); err != nil {
+		return
+	}
+	if content, err = r.CSV(); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(name+".csv", content, 0644)
+	return
+}
+
+//对账,下载渠道账单与本地记录核对后返回差异报告,format为csv时返回CSV
+func RunReconcile(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, CHANNEL, BILL_DATE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		if report, err := Run(merchantId, mapData[CHANNEL].(string), mapData[BILL_DATE].(string)); err == nil {
+			if format, _ := mapData["format"].(string); format == "csv" {
+				content, _ := report.CSV()
+				c.Data(HTTP_SUCCESS, "text/csv; charset=utf-8", content)
+			} else {
+				c.JSON(HTTP_SUCCESS, report)
+			}
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//确认差异,向渠道查询订单(及退款)的真实状态并更新本地记录
+func ConfirmDiscrepancy(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, CHANNEL, TRADE_NO); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		outRefundNo, _ := mapData[OUT_REFUND_NO].(string)
+		if ret, err := Confirm(merchantId, mapData[CHANNEL].(string), mapData[TRADE_NO].(string), outRefundNo); err == nil {
+			c.JSON(HTTP_SUCCESS, RetConfirm{Confirmation: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
@@ -0,0 +1,649 @@
+package store
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"path/filepath"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"time"
+)
+
+//订单,退款和轮询表按商户区分单号,旧版本数据库的单号主键在打开时迁移为商户+单号
+const ordersTable = `
+CREATE TABLE IF NOT EXISTS orders (
+	trade_no       TEXT NOT NULL,
+	channel        TEXT NOT NULL,
+	trade_type     TEXT NOT NULL,
+	body           TEXT NOT NULL DEFAULT '',
+	total_fee      INTEGER NOT NULL,
+	notify_url     TEXT NOT NULL DEFAULT '',
+	transaction_id TEXT NOT NULL DEFAULT '',
+	status         TEXT NOT NULL,
+	created_at     INTEGER NOT NULL,
+	updated_at     INTEGER NOT NULL,
+	merchant_id    TEXT NOT NULL DEFAULT '',
+	expire_at      INTEGER NOT NULL DEFAULT 0,
+	paid_at        INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (merchant_id, trade_no)
+);`
+
+const refundsTable = `
+CREATE TABLE IF NOT EXISTS refunds (
+	out_refund_no TEXT NOT NULL,
+	trade_no      TEXT NOT NULL,
+	refund_fee    INTEGER NOT NULL,
+	refund_id     TEXT NOT NULL DEFAULT '',
+	status        TEXT NOT NULL,
+	created_at    INTEGER NOT NULL,
+	updated_at    INTEGER NOT NULL,
+	merchant_id   TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (merchant_id, out_refund_no)
+);`
+
+const pollsTable = `
+CREATE TABLE IF NOT EXISTS polls (
+	trade_no   TEXT NOT NULL,
+	channel    TEXT NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	status     TEXT NOT NULL,
+	last_state TEXT NOT NULL DEFAULT '',
+	next_at    INTEGER NOT NULL,
+	deadline   INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL,
+	merchant_id TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (merchant_id, trade_no)
+);`
+
+const sqliteSchema = ordersTable + refundsTable + pollsTable + `
+CREATE TABLE IF NOT EXISTS notifies (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	trade_no   TEXT NOT NULL,
+	event      TEXT NOT NULL,
+	notify_url TEXT NOT NULL,
+	payload    TEXT NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	status     TEXT NOT NULL,
+	next_at    INTEGER NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_notifies_status_next_at ON notifies (status, next_at);
+CREATE TABLE IF NOT EXISTS pay_states (
+	token      TEXT PRIMARY KEY,
+	body       TEXT NOT NULL,
+	trade_no   TEXT NOT NULL,
+	notify_url TEXT NOT NULL,
+	total_fee  INTEGER NOT NULL,
+	expire_at  INTEGER NOT NULL,
+	used       INTEGER NOT NULL DEFAULT 0,
+	merchant_id TEXT NOT NULL DEFAULT '',
+	timeout    TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS bills (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel        TEXT NOT NULL,
+	merchant_id    TEXT NOT NULL DEFAULT '',
+	bill_type      TEXT NOT NULL,
+	bill_date      TEXT NOT NULL,
+	trade_no       TEXT NOT NULL DEFAULT '',
+	transaction_id TEXT NOT NULL DEFAULT '',
+	out_refund_no  TEXT NOT NULL DEFAULT '',
+	kind           TEXT NOT NULL DEFAULT '',
+	amount         INTEGER NOT NULL DEFAULT 0,
+	fee            INTEGER NOT NULL DEFAULT 0,
+	trade_time     TEXT NOT NULL DEFAULT '',
+	raw            TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_bills_bill ON bills (channel, merchant_id, bill_type, bill_date);
+CREATE TABLE IF NOT EXISTS notify_receipts (
+	key        TEXT PRIMARY KEY,
+	trade_no   TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS idempotency (
+	key          TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	status       INTEGER NOT NULL DEFAULT 0,
+	response     TEXT NOT NULL DEFAULT '',
+	created_at   INTEGER NOT NULL
+);
+`
+
+//旧版本数据库缺少的列,打开时补充,fill为补充列后回填已有记录的语句
+var sqliteColumns = []struct{ table, column, define, fill string }{
+	{"orders", "merchant_id", "TEXT NOT NULL DEFAULT ''", EMPTY},
+	{"polls", "merchant_id", "TEXT NOT NULL DEFAULT ''", EMPTY},
+	{"pay_states", "merchant_id", "TEXT NOT NULL DEFAULT ''", EMPTY},
+	{"orders", "expire_at", "INTEGER NOT NULL DEFAULT 0", EMPTY},
+	{"pay_states", "timeout", "TEXT NOT NULL DEFAULT ''", EMPTY},
+	{"refunds", "merchant_id", "TEXT NOT NULL DEFAULT ''", EMPTY},
+	//已支付的旧订单没有记录支付时间,以最后更新时间近似
+	{"orders", "paid_at", "INTEGER NOT NULL DEFAULT 0", "UPDATE orders SET paid_at = updated_at WHERE status IN ('" + STATUS_PAID + "', '" +
+		STATUS_PARTIALLY_REFUNDED + "', '" + STATUS_REFUNDED + "')"},
+}
+
+//旧版本数据库以单号为主键的表,补充列后按新表结构重建
+var sqliteRekeys = []struct{ table, create, columns string }{
+	{"orders", ordersTable, orderColumns},
+	{"refunds", refundsTable, refundColumns},
+	{"polls", pollsTable, "trade_no, channel, attempts, status, last_state, next_at, deadline, created_at, updated_at, merchant_id"},
+}
+
+//依赖补充列的索引,补充列后创建
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS idx_orders_status_expire_at ON orders (status, expire_at);
+CREATE INDEX IF NOT EXISTS idx_orders_paid_at ON orders (merchant_id, channel, paid_at);
+CREATE INDEX IF NOT EXISTS idx_refunds_trade_no ON refunds (merchant_id, trade_no);
+CREATE INDEX IF NOT EXISTS idx_refunds_created_at ON refunds (created_at);
+CREATE INDEX IF NOT EXISTS idx_polls_status_next_at ON polls (status, next_at);
+`
+
+const orderColumns = "trade_no, channel, trade_type, body, total_fee, notify_url, transaction_id, status, created_at, updated_at, merchant_id, " +
+	"expire_at, paid_at"
+const notifyColumns = "id, trade_no, event, notify_url, payload, attempts, status, next_at, last_error, created_at, updated_at"
+const billColumns = "id, channel, merchant_id, bill_type, bill_date, trade_no, transaction_id, out_refund_no, kind, amount, fee, trade_time, raw"
+const refundColumns = "out_refund_no, trade_no, refund_fee, refund_id, status, created_at, updated_at, merchant_id"
+
+//sqlite存储
+type SqliteStore struct {
+	db *sql.DB
+}
+
+//打开sqlite存储,数据库文件不存在时自动创建
+func OpenSqlite(path string) (s *SqliteStore, err error) {
+	var db *sql.DB
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	if db, err = sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL"); err != nil {
+		return
+	}
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return
+	}
+	for _, c := range sqliteColumns {
+		if err = addColumn(db, c.table, c.column, c.define, c.fill); err != nil {
+			db.Close()
+			return
+		}
+	}
+	for _, r := range sqliteRekeys {
+		if err = rekey(db, r.table, r.create, r.columns); err != nil {
+			db.Close()
+			return
+		}
+	}
+	if _, err = db.Exec(sqliteIndexes); err != nil {
+		db.Close()
+		return
+	}
+	s = &SqliteStore{db: db}
+	return
+}
+
+func (s *SqliteStore) CreateOrder(order Order) (err error) {
+	now := time.Now().Unix()
+	_, err = s.db.Exec("INSERT INTO orders ("+orderColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		order.TradeNo, order.Channel, order.TradeType, order.Body, order.TotalFee, order.NotifyUrl, order.TransactionId,
+		order.Status, now, now, order.MerchantId, order.ExpireAt, order.PaidAt)
+	return
+}
+
+func (s *SqliteStore) GetOrder(merchantId, tradeNo string) (order Order, err error) {
+	row := s.db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE merchant_id = ? AND trade_no = ?", merchantId, tradeNo)
+	err = row.Scan(&order.TradeNo, &order.Channel, &order.TradeType, &order.Body, &order.TotalFee, &order.NotifyUrl,
+		&order.TransactionId, &order.Status, &order.CreatedAt, &order.UpdatedAt, &order.MerchantId, &order.ExpireAt, &order.PaidAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *SqliteStore) UpdateOrder(order Order, fromStatus string, notifies ...Notify) (err error) {
+	var tx *sql.Tx
+	if tx, err = s.db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	var res sql.Result
+	var n int64
+	if res, err = tx.Exec("UPDATE orders SET transaction_id = ?, status = ?, paid_at = ?, updated_at = ? WHERE merchant_id = ? AND trade_no = ? "+
+		"AND status = ?", order.TransactionId, order.Status, order.PaidAt, time.Now().Unix(), order.MerchantId, order.TradeNo, fromStatus); err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return
+	} else if n == 0 {
+		err = gateway.ErrOrderState
+		return
+	}
+	err = insertNotifies(tx, notifies)
+	return
+}
+
+func (s *SqliteStore) SaveRefund(refund Refund, notifies ...Notify) (err error) {
+	var tx *sql.Tx
+	if tx, err = s.db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	now := time.Now().Unix()
+	if _, err = tx.Exec("INSERT INTO refunds ("+refundColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT(merchant_id, out_refund_no) DO UPDATE SET refund_id = excluded.refund_id, status = excluded.status, "+
+		"updated_at = excluded.updated_at", refund.OutRefundNo, refund.TradeNo, refund.RefundFee, refund.RefundId, refund.Status, now, now,
+		refund.MerchantId); err != nil {
+		return
+	}
+	err = insertNotifies(tx, notifies)
+	return
+}
+
+func (s *SqliteStore) GetRefund(merchantId, outRefundNo string) (refund Refund, err error) {
+	var list []Refund
+	if list, err = s.queryRefunds("SELECT "+refundColumns+" FROM refunds WHERE merchant_id = ? AND out_refund_no = ?", merchantId,
+		outRefundNo); err == nil {
+		if len(list) == 0 {
+			err = ErrNotFound
+		} else {
+			refund = list[0]
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) ListRefunds(merchantId, tradeNo string) (refunds []Refund, err error) {
+	return s.queryRefunds("SELECT "+refundColumns+" FROM refunds WHERE merchant_id = ? AND trade_no = ? ORDER BY created_at", merchantId,
+		tradeNo)
+}
+
+func (s *SqliteStore) queryRefunds(query string, args ...interface{}) (refunds []Refund, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query(query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var refund Refund
+		if err = rows.Scan(&refund.OutRefundNo, &refund.TradeNo, &refund.RefundFee, &refund.RefundId, &refund.Status,
+			&refund.CreatedAt, &refund.UpdatedAt, &refund.MerchantId); err != nil {
+			return
+		}
+		refunds = append(refunds, refund)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SqliteStore) CreateNotify(n Notify) (id int64, err error) {
+	return insertNotify(s.db, n)
+}
+
+//sql.DB和sql.Tx共用的执行接口
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertNotify(db execer, n Notify) (id int64, err error) {
+	var res sql.Result
+	now := time.Now().Unix()
+	res, err = db.Exec("INSERT INTO notifies (trade_no, event, notify_url, payload, attempts, status, next_at, last_error, created_at, updated_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", n.TradeNo, n.Event, n.NotifyUrl, n.Payload, n.Attempts, n.Status, n.NextAt, n.LastError, now, now)
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	return
+}
+
+//在状态变化的事务中加入商户通知
+func insertNotifies(db execer, notifies []Notify) (err error) {
+	for _, n := range notifies {
+		if _, err = insertNotify(db, n); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) GetNotify(id int64) (n Notify, err error) {
+	var list []Notify
+	if list, err = s.queryNotifies("SELECT "+notifyColumns+" FROM notifies WHERE id = ?", id); err == nil {
+		if len(list) == 0 {
+			err = ErrNotFound
+		} else {
+			n = list[0]
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) UpdateNotify(n Notify) (err error) {
+	_, err = s.db.Exec("UPDATE notifies SET attempts = ?, status = ?, next_at = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		n.Attempts, n.Status, n.NextAt, n.LastError, time.Now().Unix(), n.Id)
+	return
+}
+
+func (s *SqliteStore) ListDueNotifies(now int64, limit int) (list []Notify, err error) {
+	return s.queryNotifies("SELECT "+notifyColumns+" FROM notifies WHERE status = ? AND next_at <= ? ORDER BY next_at LIMIT ?",
+		DELIVERY_PENDING, now, limit)
+}
+
+func (s *SqliteStore) ListNotifies(status string, limit int) (list []Notify, err error) {
+	if status == EMPTY {
+		return s.queryNotifies("SELECT "+notifyColumns+" FROM notifies ORDER BY id DESC LIMIT ?", limit)
+	}
+	return s.queryNotifies("SELECT "+notifyColumns+" FROM notifies WHERE status = ? ORDER BY id DESC LIMIT ?", status, limit)
+}
+
+func (s *SqliteStore) queryNotifies(query string, args ...interface{}) (list []Notify, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query(query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n Notify
+		if err = rows.Scan(&n.Id, &n.TradeNo, &n.Event, &n.NotifyUrl, &n.Payload, &n.Attempts, &n.Status, &n.NextAt,
+			&n.LastError, &n.CreatedAt, &n.UpdatedAt); err != nil {
+			return
+		}
+		list = append(list, n)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SqliteStore) SavePoll(p Poll) (err error) {
+	now := time.Now().Unix()
+	_, err = s.db.Exec("INSERT INTO polls (trade_no, channel, attempts, status, last_state, next_at, deadline, created_at, updated_at, merchant_id) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(merchant_id, trade_no) DO UPDATE SET channel = excluded.channel, attempts = excluded.attempts, "+
+		"status = excluded.status, last_state = excluded.last_state, next_at = excluded.next_at, deadline = excluded.deadline, "+
+		"updated_at = excluded.updated_at", p.TradeNo, p.Channel, p.Attempts, p.Status, p.LastState, p.NextAt, p.Deadline, now, now, p.MerchantId)
+	return
+}
+
+func (s *SqliteStore) ListDuePolls(now int64, limit int) (list []Poll, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query("SELECT trade_no, channel, attempts, status, last_state, next_at, deadline, created_at, updated_at, merchant_id "+
+		"FROM polls WHERE status = ? AND next_at <= ? ORDER BY next_at LIMIT ?", POLL_PENDING, now, limit); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Poll
+		if err = rows.Scan(&p.TradeNo, &p.Channel, &p.Attempts, &p.Status, &p.LastState, &p.NextAt, &p.Deadline,
+			&p.CreatedAt, &p.UpdatedAt, &p.MerchantId); err != nil {
+			return
+		}
+		list = append(list, p)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SqliteStore) CreatePayState(st PayState) (err error) {
+	_, err = s.db.Exec("INSERT INTO pay_states (token, body, trade_no, notify_url, total_fee, expire_at, merchant_id, timeout) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)", st.Token, st.Body, st.TradeNo, st.NotifyUrl, st.TotalFee, st.ExpireAt, st.MerchantId, st.Timeout)
+	return
+}
+
+func (s *SqliteStore) UsePayState(token string, now int64) (st PayState, err error) {
+	var used int
+	row := s.db.QueryRow("SELECT token, body, trade_no, notify_url, total_fee, expire_at, used, merchant_id, timeout FROM pay_states "+
+		"WHERE token = ?", token)
+	if err = row.Scan(&st.Token, &st.Body, &st.TradeNo, &st.NotifyUrl, &st.TotalFee, &st.ExpireAt, &used, &st.MerchantId,
+		&st.Timeout); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	if used != 0 {
+		err = ErrUsed
+		return
+	}
+	if now > st.ExpireAt {
+		err = ErrExpired
+		return
+	}
+	var res sql.Result
+	var n int64
+	if res, err = s.db.Exec("UPDATE pay_states SET used = 1 WHERE token = ? AND used = 0", token); err == nil {
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = ErrUsed
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) CreateIdempotency(record Idempotency) (err error) {
+	var res sql.Result
+	var n int64
+	res, err = s.db.Exec("INSERT OR IGNORE INTO idempotency (key, request_hash, status, response, created_at) VALUES (?, ?, ?, ?, ?)",
+		record.Key, record.RequestHash, record.Status, record.Response, time.Now().Unix())
+	if err == nil {
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = ErrDuplicate
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) GetIdempotency(key string) (record Idempotency, err error) {
+	row := s.db.QueryRow("SELECT key, request_hash, status, response, created_at FROM idempotency WHERE key = ?", key)
+	err = row.Scan(&record.Key, &record.RequestHash, &record.Status, &record.Response, &record.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *SqliteStore) UpdateIdempotency(record Idempotency) (err error) {
+	_, err = s.db.Exec("UPDATE idempotency SET status = ?, response = ? WHERE key = ?", record.Status, record.Response, record.Key)
+	return
+}
+
+func (s *SqliteStore) DeleteIdempotency(key string) (err error) {
+	_, err = s.db.Exec("DELETE FROM idempotency WHERE key = ?", key)
+	return
+}
+
+func (s *SqliteStore) CreateNotifyReceipt(r NotifyReceipt) (err error) {
+	var res sql.Result
+	var n int64
+	res, err = s.db.Exec("INSERT OR IGNORE INTO notify_receipts (key, trade_no, created_at) VALUES (?, ?, ?)", r.Key, r.TradeNo,
+		time.Now().Unix())
+	if err == nil {
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = ErrDuplicate
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) SaveBills(channel, merchantId, billType, billDate string, bills []Bill) (err error) {
+	var tx *sql.Tx
+	if tx, err = s.db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if _, err = tx.Exec("DELETE FROM bills WHERE channel = ? AND merchant_id = ? AND bill_type = ? AND bill_date = ?",
+		channel, merchantId, billType, billDate); err != nil {
+		return
+	}
+	var stmt *sql.Stmt
+	if stmt, err = tx.Prepare("INSERT INTO bills (channel, merchant_id, bill_type, bill_date, trade_no, transaction_id, out_refund_no, " +
+		"kind, amount, fee, trade_time, raw) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"); err != nil {
+		return
+	}
+	defer stmt.Close()
+	for _, b := range bills {
+		if _, err = stmt.Exec(channel, merchantId, billType, billDate, b.TradeNo, b.TransactionId, b.OutRefundNo, b.Kind, b.Amount,
+			b.Fee, b.TradeTime, b.Raw); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *SqliteStore) ListBills(channel, merchantId, billType, billDate string) (bills []Bill, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query("SELECT "+billColumns+" FROM bills WHERE channel = ? AND merchant_id = ? AND bill_type = ? AND bill_date = ? "+
+		"ORDER BY id", channel, merchantId, billType, billDate); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b Bill
+		if err = rows.Scan(&b.Id, &b.Channel, &b.MerchantId, &b.BillType, &b.BillDate, &b.TradeNo, &b.TransactionId, &b.OutRefundNo,
+			&b.Kind, &b.Amount, &b.Fee, &b.TradeTime, &b.Raw); err != nil {
+			return
+		}
+		bills = append(bills, b)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SqliteStore) ListOrdersPaidBetween(merchantId, channel string, from, to int64) (orders []Order, err error) {
+	return s.queryOrders("SELECT "+orderColumns+" FROM orders WHERE merchant_id = ? AND channel = ? AND paid_at >= ? AND paid_at < ? "+
+		"ORDER BY paid_at", merchantId, channel, from, to)
+}
+
+func (s *SqliteStore) ListExpiredOrders(now int64, limit int) (orders []Order, err error) {
+	return s.queryOrders("SELECT "+orderColumns+" FROM orders WHERE status IN (?, ?) AND expire_at > 0 AND expire_at <= ? "+
+		"ORDER BY expire_at LIMIT ?", STATUS_CREATED, STATUS_USERPAYING, now, limit)
+}
+
+func (s *SqliteStore) queryOrders(query string, args ...interface{}) (orders []Order, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query(query, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var order Order
+		if err = rows.Scan(&order.TradeNo, &order.Channel, &order.TradeType, &order.Body, &order.TotalFee, &order.NotifyUrl,
+			&order.TransactionId, &order.Status, &order.CreatedAt, &order.UpdatedAt, &order.MerchantId, &order.ExpireAt, &order.PaidAt); err != nil {
+			return
+		}
+		orders = append(orders, order)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *SqliteStore) ListRefundsBetween(merchantId, channel string, from, to int64) (refunds []Refund, err error) {
+	return s.queryRefunds("SELECT r.out_refund_no, r.trade_no, r.refund_fee, r.refund_id, r.status, r.created_at, r.updated_at, "+
+		"r.merchant_id FROM refunds r JOIN orders o ON o.merchant_id = r.merchant_id AND o.trade_no = r.trade_no WHERE r.merchant_id = ? "+
+		"AND o.channel = ? AND r.created_at >= ? AND r.created_at < ? ORDER BY r.created_at", merchantId, channel, from, to)
+}
+
+func (s *SqliteStore) Close() (err error) {
+	return s.db.Close()
+}
+
+//表中缺少列时添加
+func addColumn(db *sql.DB, table, column, define, fill string) (err error) {
+	var rows *sql.Rows
+	if rows, err = db.Query("PRAGMA table_info(" + table + ")"); err != nil {
+		return
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || found {
+		return
+	}
+	if _, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + define); err == nil && fill != EMPTY {
+		_, err = db.Exec(fill)
+	}
+	return
+}
+
+//表的主键只有一列时按新表结构重建,旧退款记录的商户从订单补充
+func rekey(db *sql.DB, table, create, columns string) (err error) {
+	var rows *sql.Rows
+	if rows, err = db.Query("PRAGMA table_info(" + table + ")"); err != nil {
+		return
+	}
+	keys := 0
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return
+		}
+		if pk > 0 {
+			keys++
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || keys != 1 {
+		return
+	}
+	var tx *sql.Tx
+	if tx, err = db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if table == "refunds" {
+		if _, err = tx.Exec("UPDATE refunds SET merchant_id = COALESCE((SELECT o.merchant_id FROM orders o WHERE o.trade_no = " +
+			"refunds.trade_no LIMIT 1), '') WHERE merchant_id = ''"); err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec("ALTER TABLE " + table + " RENAME TO " + table + "_old"); err != nil {
+		return
+	}
+	if _, err = tx.Exec(create); err != nil {
+		return
+	}
+	if _, err = tx.Exec("INSERT INTO " + table + " (" + columns + ") SELECT " + columns + " FROM " + table + "_old"); err != nil {
+		return
+	}
+	_, err = tx.Exec("DROP TABLE " + table + "_old")
+	return
+}
@@ -0,0 +1,249 @@
+package store
+
+import (
+	"errors"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("记录不存在")
+	ErrDuplicate = errors.New("记录已存在")
+	ErrExpired   = errors.New("记录已过期")
+	ErrUsed      = errors.New("记录已使用")
+)
+
+//订单
+type Order struct {
+	TradeNo       string `json:"trade_no"`       //商户订单号
+	MerchantId    string `json:"merchant_id"`    //商户标识
+	Channel       string `json:"channel"`        //支付渠道(wechat,alipay)
+	TradeType     string `json:"trade_type"`     //交易类型
+	Body          string `json:"body"`           //订单标题
+	TotalFee      Money  `json:"total_fee"`      //订单金额(分)
+	NotifyUrl     string `json:"notify_url"`     //回调地址
+	TransactionId string `json:"transaction_id"` //渠道订单号
+	Status        string `json:"status"`         //订单状态
+	ExpireAt      int64  `json:"expire_at"`      //过期时间,0表示不过期
+	PaidAt        int64  `json:"paid_at"`        //支付时间,未支付时为0
+	CreatedAt     int64  `json:"created_at"`     //创建时间
+	UpdatedAt     int64  `json:"updated_at"`     //更新时间
+}
+
+//退款
+type Refund struct {
+	OutRefundNo string `json:"out_refund_no"` //商户退款单号
+	MerchantId  string `json:"merchant_id"`   //商户标识
+	TradeNo     string `json:"trade_no"`      //商户订单号
+	RefundFee   Money  `json:"refund_fee"`    //退款金额(分)
+	RefundId    string `json:"refund_id"`     //渠道退款单号
+	Status      string `json:"status"`        //退款状态
+	CreatedAt   int64  `json:"created_at"`    //创建时间
+	UpdatedAt   int64  `json:"updated_at"`    //更新时间
+}
+
+//幂等记录
+type Idempotency struct {
+	Key         string `json:"key"`          //幂等键
+	RequestHash string `json:"request_hash"` //请求内容摘要
+	Status      int    `json:"status"`       //首次响应http状态码,0表示处理中
+	Response    string `json:"response"`     //首次响应内容
+	CreatedAt   int64  `json:"created_at"`   //创建时间
+}
+
+//商户通知
+type Notify struct {
+	Id        int64  `json:"id"`
+	TradeNo   string `json:"trade_no"`   //商户订单号
+	Event     string `json:"event"`      //事件类型
+	NotifyUrl string `json:"notify_url"` //商户通知地址
+	Payload   string `json:"payload"`    //通知内容
+	Attempts  int    `json:"attempts"`   //已投递次数
+	Status    string `json:"status"`     //投递状态
+	NextAt    int64  `json:"next_at"`    //下次投递时间
+	LastError string `json:"last_error"` //最后一次投递错误
+	CreatedAt int64  `json:"created_at"` //创建时间
+	UpdatedAt int64  `json:"updated_at"` //更新时间
+}
+
+//已处理的渠道异步通知,用于重复通知去重
+type NotifyReceipt struct {
+	Key       string `json:"key"`        //去重键,商户+支付渠道+通知类型+通知标识+状态
+	TradeNo   string `json:"trade_no"`   //商户订单号
+	CreatedAt int64  `json:"created_at"` //首次处理时间
+}
+
+//付款码订单轮询
+type Poll struct {
+	TradeNo    string `json:"trade_no"`    //商户订单号
+	MerchantId string `json:"merchant_id"` //商户标识
+	Channel    string `json:"channel"`     //支付渠道
+	Attempts   int    `json:"attempts"`    //已查询次数
+	Status     string `json:"status"`      //轮询状态
+	LastState  string `json:"last_state"`  //最后一次查询的交易状态
+	NextAt     int64  `json:"next_at"`     //下次查询时间
+	Deadline   int64  `json:"deadline"`    //截止时间,超过后撤销订单
+	CreatedAt  int64  `json:"created_at"`  //创建时间
+	UpdatedAt  int64  `json:"updated_at"`  //更新时间
+}
+
+//公众号支付oauth2授权的state,保存待支付订单信息
+type PayState struct {
+	Token      string `json:"token"`       //state令牌
+	MerchantId string `json:"merchant_id"` //商户标识
+	Body       string `json:"body"`        //订单标题
+	TradeNo    string `json:"trade_no"`    //商户订单号
+	NotifyUrl  string `json:"notify_url"`  //回调地址
+	TotalFee   Money  `json:"total_fee"`   //订单金额(分)
+	Timeout    string `json:"timeout"`     //订单有效时间
+	ExpireAt   int64  `json:"expire_at"`   //过期时间
+}
+
+//渠道对账单记录
+type Bill struct {
+	Id            int64  `json:"id"`
+	Channel       string `json:"channel"`        //支付渠道
+	MerchantId    string `json:"merchant_id"`    //商户标识
+	BillType      string `json:"bill_type"`      //账单类型
+	BillDate      string `json:"bill_date"`      //账单日期
+	TradeNo       string `json:"trade_no"`       //商户订单号
+	TransactionId string `json:"transaction_id"` //渠道订单号
+	OutRefundNo   string `json:"out_refund_no"`  //商户退款单号
+	Kind          string `json:"kind"`           //记录类型(PAY-支付,REFUND-退款,资金账单为渠道业务类型)
+	Amount        Money  `json:"amount"`         //金额(分),支付为订单金额,退款为退款金额,资金账单为收入减支出
+	Fee           Money  `json:"fee"`            //手续费(分)
+	TradeTime     string `json:"trade_time"`     //交易时间
+	Raw           string `json:"raw"`            //渠道原始记录(json)
+}
+
+//订单和退款存储接口,默认使用sqlite.订单和轮询按商户+商户订单号区分,退款按商户+商户退款单号区分,不同商户可以使用相同单号
+type Store interface {
+	CreateOrder(order Order) (err error)                                                          //新建订单,订单已存在时返回错误
+	GetOrder(merchantId, tradeNo string) (order Order, err error)                                 //查询商户订单,不存在时返回ErrNotFound
+	UpdateOrder(order Order, fromStatus string, notifies ...Notify) (err error)                   //更新订单并在同一事务中加入商户通知,订单状态不是fromStatus时返回gateway.ErrOrderState
+	SaveRefund(refund Refund, notifies ...Notify) (err error)                                     //保存退款并在同一事务中加入商户通知,已存在时更新
+	GetRefund(merchantId, outRefundNo string) (refund Refund, err error)                          //查询商户退款,不存在时返回ErrNotFound
+	ListRefunds(merchantId, tradeNo string) (refunds []Refund, err error)                         //查询商户订单的所有退款
+	CreateIdempotency(record Idempotency) (err error)                                             //新建幂等记录,已存在时返回ErrDuplicate
+	GetIdempotency(key string) (record Idempotency, err error)                                    //查询幂等记录,不存在时返回ErrNotFound
+	UpdateIdempotency(record Idempotency) (err error)                                             //保存首次响应
+	DeleteIdempotency(key string) (err error)                                                     //删除幂等记录
+	CreateNotify(n Notify) (id int64, err error)                                                  //新建商户通知
+	GetNotify(id int64) (n Notify, err error)                                                     //查询商户通知,不存在时返回ErrNotFound
+	UpdateNotify(n Notify) (err error)                                                            //更新商户通知投递状态
+	ListDueNotifies(now int64, limit int) (list []Notify, err error)                              //查询到期待投递的商户通知
+	ListNotifies(status string, limit int) (list []Notify, err error)                             //按投递状态查询商户通知,status为空时查询全部
+	CreateNotifyReceipt(r NotifyReceipt) (err error)                                              //记录已处理的渠道通知,已存在时返回ErrDuplicate
+	SavePoll(p Poll) (err error)                                                                  //保存轮询,已存在时覆盖
+	ListDuePolls(now int64, limit int) (list []Poll, err error)                                   //查询到期的轮询
+	CreatePayState(st PayState) (err error)                                                       //新建state令牌
+	UsePayState(token string, now int64) (st PayState, err error)                                 //使用state令牌,不存在返回ErrNotFound,过期返回ErrExpired,已使用返回ErrUsed
+	SaveBills(channel, merchantId, billType, billDate string, bills []Bill) (err error)           //保存对账单,替换同一账单已有的记录
+	ListBills(channel, merchantId, billType, billDate string) (bills []Bill, err error)           //查询对账单记录
+	ListOrdersPaidBetween(merchantId, channel string, from, to int64) (orders []Order, err error) //查询支付时间在[from,to)内的商户渠道订单
+	ListRefundsBetween(merchantId, channel string, from, to int64) (refunds []Refund, err error)  //查询创建时间在[from,to)内的商户渠道退款
+	ListExpiredOrders(now int64, limit int) (orders []Order, err error)                           //查询已过期未支付的订单
+	Close() (err error)                                                                           //关闭存储
+}
+
+//订单状态可迁移的目标状态
+var transitions = map[string][]string{
+	STATUS_CREATED:            {STATUS_USERPAYING, STATUS_PAID, STATUS_CLOSED, STATUS_REVERSED},
+	STATUS_USERPAYING:         {STATUS_PAID, STATUS_CLOSED, STATUS_REVERSED},
+	STATUS_PAID:               {STATUS_PARTIALLY_REFUNDED, STATUS_REFUNDED, STATUS_REVERSED},
+	STATUS_PARTIALLY_REFUNDED: {STATUS_REFUNDED},
+}
+
+//订单状态能否从from迁移到to
+func CanTransit(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//订单状态能否从from经过一次或多次迁移到达to
+func reachable(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to || reachable(s, to) {
+			return true
+		}
+	}
+	return false
+}
+
+//迁移订单状态,非法迁移返回gateway.ErrOrderState,状态未变化时不做修改.状态变化的商户通知与订单在同一事务中保存
+func Transit(s Store, merchantId, tradeNo, to string, transactionId string) (order Order, err error) {
+	if order, err = s.GetOrder(merchantId, tradeNo); err != nil {
+		return
+	}
+	if order.Status == to {
+		return
+	}
+	if !CanTransit(order.Status, to) {
+		err = gateway.ErrOrderState
+		return
+	}
+	from := order.Status
+	order.Status = to
+	if to == STATUS_PAID && order.PaidAt == 0 {
+		order.PaidAt = time.Now().Unix()
+	}
+	if transactionId != EMPTY {
+		order.TransactionId = transactionId
+	}
+	err = s.UpdateOrder(order, from, notifiesOf(Event{Order: order})...)
+	return
+}
+
+//订单已退款金额(分),只统计成功和处理中的退款,不包括退款单号为excludeRefundNo的退款
+func RefundedFee(s Store, merchantId, tradeNo string, excludeRefundNo string) (fee Money, err error) {
+	var refunds []Refund
+	if refunds, err = s.ListRefunds(merchantId, tradeNo); err == nil {
+		fee = Fen(0)
+		for _, r := range refunds {
+			if r.Status != REFUND_FAIL && r.OutRefundNo != excludeRefundNo {
+				fee.Amount += r.RefundFee.Amount
+			}
+		}
+	}
+	return
+}
+
+//订单或退款状态变化事件
+type Event struct {
+	Order  Order   //订单
+	Refund *Refund //退款,订单状态变化时为nil
+}
+
+var outbox func(e Event) (n Notify, ok bool)
+
+//设置状态变化时生成商户通知的函数,ok为false时不通知
+func SetOutbox(f func(e Event) (n Notify, ok bool)) {
+	outbox = f
+}
+
+//状态变化对应的商户通知,与状态变化在同一事务中保存
+func notifiesOf(e Event) (notifies []Notify) {
+	if outbox != nil {
+		if n, ok := outbox(e); ok {
+			notifies = append(notifies, n)
+		}
+	}
+	return
+}
+
+var defaultStore Store
+
+//设置默认存储
+func SetDefault(s Store) {
+	defaultStore = s
+}
+
+//获取默认存储
+func Default() Store {
+	return defaultStore
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	. "pay_service/module/comm"
+	"testing"
+)
+
+func TestCanTransit(t *testing.T) {
+	cases := []struct {
+		from, to string
+		want     bool
+	}{
+		{STATUS_CREATED, STATUS_USERPAYING, true},
+		{STATUS_CREATED, STATUS_PAID, true},
+		{STATUS_CREATED, STATUS_CLOSED, true},
+		{STATUS_CREATED, STATUS_REVERSED, true},
+		{STATUS_CREATED, STATUS_REFUNDED, false},
+		{STATUS_USERPAYING, STATUS_PAID, true},
+		{STATUS_USERPAYING, STATUS_CLOSED, true},
+		{STATUS_USERPAYING, STATUS_CREATED, false},
+		{STATUS_PAID, STATUS_PARTIALLY_REFUNDED, true},
+		{STATUS_PAID, STATUS_REFUNDED, true},
+		{STATUS_PAID, STATUS_REVERSED, true},
+		{STATUS_PAID, STATUS_CLOSED, false},
+		{STATUS_PAID, STATUS_CREATED, false},
+		{STATUS_PARTIALLY_REFUNDED, STATUS_REFUNDED, true},
+		{STATUS_PARTIALLY_REFUNDED, STATUS_PAID, false},
+		{STATUS_REFUNDED, STATUS_PAID, false},
+		{STATUS_REFUNDED, STATUS_PARTIALLY_REFUNDED, false},
+		{STATUS_CLOSED, STATUS_PAID, false},
+		{STATUS_REVERSED, STATUS_PAID, false},
+		{EMPTY, STATUS_PAID, false},
+	}
+	for _, c := range cases {
+		if got := CanTransit(c.from, c.to); got != c.want {
+			t.Errorf("CanTransit(%s, %s) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestReachable(t *testing.T) {
+	cases := []struct {
+		from, to string
+		want     bool
+	}{
+		{STATUS_CREATED, STATUS_REFUNDED, true},
+		{STATUS_USERPAYING, STATUS_PARTIALLY_REFUNDED, true},
+		{STATUS_PAID, STATUS_REFUNDED, true},
+		{STATUS_PARTIALLY_REFUNDED, STATUS_PAID, false},
+		{STATUS_CLOSED, STATUS_PAID, false},
+		{STATUS_PAID, STATUS_PAID, false},
+	}
+	for _, c := range cases {
+		if got := reachable(c.from, c.to); got != c.want {
+			t.Errorf("reachable(%s, %s) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
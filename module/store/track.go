@@ -0,0 +1,328 @@
+package store
+
+import (
+	"fmt"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"sync"
+	"time"
+)
+
+//记录订单的支付渠道,调用渠道前后记录订单和退款,并迁移订单状态
+type trackedGateway struct {
+	gateway.PaymentGateway
+	merchantId string     //商户标识
+	channel    string     //支付渠道(wechat,alipay)
+	refundMu   sync.Mutex //退款额度检查锁
+}
+
+//包装商户的支付渠道,通过该渠道创建的订单和退款都记录到默认存储
+func Track(merchantId, channel string, g gateway.PaymentGateway) gateway.PaymentGateway {
+	return &trackedGateway{PaymentGateway: g, merchantId: merchantId, channel: channel}
+}
+
+//下单,已支付,关闭或退款的订单不允许重新下单,订单按商户区分.未指定有效时间时使用默认有效时间,记录过期时间.
+//订单记录失败时不调用渠道,渠道通知只接受本服务记录过的订单
+func (t *trackedGateway) CreateOrder(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	var expireAt int64
+	if req.Timeout = gateway.TimeoutOf(req); req.Timeout != EMPTY {
+		var at time.Time
+		if at, err = gateway.ExpireAt(req.Timeout, time.Now()); err != nil {
+			return
+		}
+		expireAt = at.Unix()
+	}
+	s := Default()
+	if s == nil {
+		return t.PaymentGateway.CreateOrder(req)
+	}
+	if order, e := s.GetOrder(t.merchantId, req.TradeNo); e == nil {
+		if order.Status != STATUS_CREATED && order.Status != STATUS_USERPAYING {
+			err = gateway.ErrOrderState
+			return
+		}
+	} else if e == ErrNotFound {
+		order = Order{TradeNo: req.TradeNo, MerchantId: t.merchantId, Channel: t.channel, TradeType: req.TradeType, Body: req.Body,
+			TotalFee: req.TotalFee, NotifyUrl: req.NotifyUrl, Status: STATUS_CREATED, ExpireAt: expireAt}
+		if err = s.CreateOrder(order); err != nil {
+			fmt.Println("store create order error:", err)
+			return
+		}
+	} else {
+		fmt.Println("store get order error:", e)
+		err = e
+		return
+	}
+	//渠道通知发到本服务,商户notify_url由通知队列通知
+	if callbackUrl := gateway.CallbackUrl(t.merchantId, t.channel); callbackUrl != EMPTY {
+		req.NotifyUrl = callbackUrl
+	}
+	if ret, err = t.PaymentGateway.CreateOrder(req); err == nil && ret.ErrCode == 0 {
+		t.transit(req.TradeNo, gateway.StatusOf(ret.TradeState), ret.TransactionId)
+	}
+	return
+}
+
+//查询订单,按渠道返回的交易状态迁移订单状态
+func (t *trackedGateway) Query(tradeNo string) (ret gateway.QueryResult, err error) {
+	if ret, err = t.PaymentGateway.Query(tradeNo); err == nil && ret.ErrCode == 0 {
+		t.transit(tradeNo, gateway.StatusOf(ret.TradeState), ret.TransactionId)
+	}
+	return
+}
+
+//退款,只有本商户已支付或部分退款的订单可以退款,累计退款金额不能超过订单金额.
+//退款成功后才迁移订单状态,处理中的退款等异步通知或查询退款确认
+func (t *trackedGateway) Refund(req gateway.RefundRequest) (ret gateway.RefundResult, err error) {
+	s := Default()
+	if s == nil {
+		return t.PaymentGateway.Refund(req)
+	}
+	if order, e := s.GetOrder(t.merchantId, req.TradeNo); e == nil {
+		if order.Status != STATUS_PAID && order.Status != STATUS_PARTIALLY_REFUNDED {
+			err = gateway.ErrOrderState
+			return
+		}
+		req.TotalFee = order.TotalFee
+	} else if e != ErrNotFound {
+		err = e
+		return
+	}
+	refund := Refund{OutRefundNo: req.OutRefundNo, MerchantId: t.merchantId, TradeNo: req.TradeNo, RefundFee: req.RefundFee,
+		Status: REFUND_PROCESSING}
+	if err = t.reserveRefund(s, refund, req.TotalFee); err != nil {
+		return
+	}
+	if callbackUrl := gateway.CallbackUrl(t.merchantId, t.channel); callbackUrl != EMPTY {
+		req.NotifyUrl = callbackUrl
+	}
+	if ret, err = t.PaymentGateway.Refund(req); err != nil {
+		return
+	}
+	if ret.ErrCode != 0 {
+		//只有渠道明确拒绝时退款失败并释放额度,结果未知或可重试时保持处理中,用相同退款单号重试或查询确认
+		if !Retryable(ret.ErrCode) && ret.ErrCode != ERR_CALL_PARMENT {
+			refund.Status = REFUND_FAIL
+		}
+	} else if ret.RefundStatus != EMPTY {
+		refund.Status = ret.RefundStatus
+	}
+	refund.RefundId = ret.RefundId
+	if e := t.saveRefund(s, refund, refund.Status != REFUND_PROCESSING); e != nil {
+		fmt.Println("store save refund error:", e)
+	} else if refund.Status == REFUND_SUCCESS {
+		t.transitRefunded(s, refund.TradeNo)
+	}
+	return
+}
+
+//检查累计退款额度并记录处理中的退款,处理中的退款计入已退款金额,防止并发退款超额
+func (t *trackedGateway) reserveRefund(s Store, refund Refund, totalFee Money) (err error) {
+	t.refundMu.Lock()
+	defer t.refundMu.Unlock()
+	if exist, e := s.GetRefund(t.merchantId, refund.OutRefundNo); e == nil && exist.Status == REFUND_SUCCESS {
+		//已成功的退款重复提交,交给渠道返回原退款结果
+		return
+	}
+	if totalFee.Amount > 0 {
+		var refunded Money
+		if refunded, err = RefundedFee(s, t.merchantId, refund.TradeNo, refund.OutRefundNo); err != nil {
+			return
+		}
+		if refunded.Amount+refund.RefundFee.Amount > totalFee.Amount {
+			err = gateway.ErrRefundFee
+			return
+		}
+	}
+	if err = s.SaveRefund(refund); err != nil {
+		fmt.Println("store save refund error:", err)
+	}
+	return
+}
+
+//查询退款,按渠道返回的退款状态更新退款记录
+func (t *trackedGateway) QueryRefund(tradeNo, outRefundNo string) (ret gateway.RefundResult, err error) {
+	if ret, err = t.PaymentGateway.QueryRefund(tradeNo, outRefundNo); err == nil && ret.ErrCode == 0 && ret.RefundStatus != EMPTY {
+		t.updateRefund(outRefundNo, ret.RefundStatus, ret.RefundId)
+	}
+	return
+}
+
+//关闭订单
+func (t *trackedGateway) Close(tradeNo string) (ret gateway.Result, err error) {
+	if err = t.check(tradeNo, STATUS_CLOSED); err != nil {
+		return
+	}
+	if ret, err = t.PaymentGateway.Close(tradeNo); err == nil && ret.ErrCode == 0 {
+		t.transit(tradeNo, STATUS_CLOSED, EMPTY)
+	}
+	return
+}
+
+//撤销订单
+func (t *trackedGateway) Reverse(tradeNo string) (ret gateway.Result, err error) {
+	if err = t.check(tradeNo, STATUS_REVERSED); err != nil {
+		return
+	}
+	if ret, err = t.PaymentGateway.Reverse(tradeNo); err == nil && ret.ErrCode == 0 {
+		t.transit(tradeNo, STATUS_REVERSED, EMPTY)
+	}
+	return
+}
+
+//异步通知验签,按通知内容迁移订单状态或更新退款记录.订单不属于本商户返回ErrNotifyMismatch,金额不一致返回ErrNotifyAmount,
+//已处理过的相同通知标识和状态的通知标记为重复.订单或退款更新成功后才记录已处理,更新失败时返回错误,渠道稍后重发
+func (t *trackedGateway) VerifyNotify(body string) (ret gateway.NotifyResult, err error) {
+	if ret, err = t.PaymentGateway.VerifyNotify(body); err != nil {
+		return
+	}
+	s := Default()
+	if s == nil {
+		return
+	}
+	if err = t.checkNotify(s, ret); err != nil {
+		return
+	}
+	//订单和退款的更新可重复执行,重复通知再次更新不会改变状态
+	switch ret.NotifyType {
+	case gateway.NOTIFY_PAYMENT:
+		to := gateway.StatusOf(ret.TradeState)
+		if err = t.transit(ret.TradeNo, to, ret.TransactionId); err == gateway.ErrOrderState {
+			//迟到的通知,订单已迁移到之后的状态
+			if order, e := s.GetOrder(t.merchantId, ret.TradeNo); e == nil && reachable(to, order.Status) {
+				err = nil
+			}
+		}
+	case gateway.NOTIFY_REFUND:
+		if ret.OutRefundNo != EMPTY {
+			status := REFUND_FAIL
+			if ret.TradeState == REFUND_SUCCESS {
+				status = REFUND_SUCCESS
+			}
+			err = t.updateRefund(ret.OutRefundNo, status, EMPTY)
+		}
+	}
+	if err != nil {
+		return
+	}
+	notifyId := ret.NotifyId
+	if notifyId == EMPTY {
+		notifyId = ret.TransactionId
+	}
+	receipt := NotifyReceipt{Key: t.merchantId + ":" + t.channel + ":" + ret.NotifyType + ":" + notifyId + ":" + ret.TradeState,
+		TradeNo: ret.TradeNo}
+	if err = s.CreateNotifyReceipt(receipt); err == ErrDuplicate {
+		ret.Duplicate = true
+		err = nil
+	} else if err != nil {
+		fmt.Println("store create notify receipt error:", err)
+	}
+	return
+}
+
+//检查通知与本地订单和退款一致.本服务下单和退款前都先记录,订单或退款不存在的通知不是本服务发起的,返回ErrNotifyUnknown
+func (t *trackedGateway) checkNotify(s Store, ret gateway.NotifyResult) (err error) {
+	order, err := s.GetOrder(t.merchantId, ret.TradeNo)
+	if err == ErrNotFound {
+		return gateway.ErrNotifyUnknown
+	} else if err != nil {
+		return
+	}
+	if ret.TotalFee.Amount != order.TotalFee.Amount {
+		return gateway.ErrNotifyAmount
+	}
+	if ret.NotifyType == gateway.NOTIFY_REFUND && ret.OutRefundNo != EMPTY {
+		refund, e := s.GetRefund(t.merchantId, ret.OutRefundNo)
+		switch {
+		case e == ErrNotFound:
+			err = gateway.ErrNotifyUnknown
+		case e != nil:
+			err = e
+		case refund.TradeNo != ret.TradeNo:
+			err = gateway.ErrNotifyMismatch
+		case refund.RefundFee.Amount != ret.RefundFee.Amount:
+			err = gateway.ErrNotifyAmount
+		}
+	}
+	return
+}
+
+//检查订单是否属于本商户,状态能否迁移,订单不存在时不检查
+func (t *trackedGateway) check(tradeNo, to string) (err error) {
+	if s := Default(); s != nil {
+		if order, e := s.GetOrder(t.merchantId, tradeNo); e == nil && order.Status != to && !CanTransit(order.Status, to) {
+			err = gateway.ErrOrderState
+		}
+	}
+	return
+}
+
+//迁移订单状态,订单不存在以外的错误记录日志
+func (t *trackedGateway) transit(tradeNo, to, transactionId string) (err error) {
+	s := Default()
+	if s == nil || to == EMPTY {
+		return
+	}
+	if _, err = Transit(s, t.merchantId, tradeNo, to, transactionId); err != nil && err != ErrNotFound {
+		fmt.Printf("store transit order %s to %s error: %v\n", tradeNo, to, err)
+	}
+	return
+}
+
+//按退款成功的金额迁移订单到部分退款或全额退款,处理中的退款不计入
+func (t *trackedGateway) transitRefunded(s Store, tradeNo string) (err error) {
+	order, err := s.GetOrder(t.merchantId, tradeNo)
+	if err != nil {
+		return
+	}
+	refunds, err := s.ListRefunds(t.merchantId, tradeNo)
+	if err != nil {
+		fmt.Println("store list refunds error:", err)
+		return
+	}
+	refunded := Fen(0)
+	for _, r := range refunds {
+		if r.Status == REFUND_SUCCESS {
+			refunded = refunded.Add(r.RefundFee)
+		}
+	}
+	if refunded.Amount >= order.TotalFee.Amount {
+		return t.transit(order.TradeNo, STATUS_REFUNDED, EMPTY)
+	}
+	return t.transit(order.TradeNo, STATUS_PARTIALLY_REFUNDED, EMPTY)
+}
+
+//更新退款状态,退款成功时迁移订单状态,可重复调用
+func (t *trackedGateway) updateRefund(outRefundNo, status, refundId string) (err error) {
+	s := Default()
+	if s == nil {
+		return
+	}
+	refund, err := s.GetRefund(t.merchantId, outRefundNo)
+	if err != nil {
+		return
+	}
+	changed := refund.Status != status
+	refund.Status = status
+	if refundId != EMPTY {
+		refund.RefundId = refundId
+	}
+	if err = t.saveRefund(s, refund, changed); err != nil {
+		fmt.Println("store save refund error:", err)
+	} else if status == REFUND_SUCCESS {
+		//上次迁移订单失败时重试
+		err = t.transitRefunded(s, refund.TradeNo)
+	}
+	return
+}
+
+//保存退款,changed为true时在同一事务中加入退款状态变化的商户通知,订单不存在时不通知
+func (t *trackedGateway) saveRefund(s Store, refund Refund, changed bool) (err error) {
+	var notifies []Notify
+	if changed {
+		if order, e := s.GetOrder(t.merchantId, refund.TradeNo); e == nil {
+			notifies = notifiesOf(Event{Order: order, Refund: &refund})
+		}
+	}
+	return s.SaveRefund(refund, notifies...)
+}
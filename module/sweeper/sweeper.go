@@ -0,0 +1,80 @@
+package sweeper
+
+import (
+	"fmt"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/store"
+	"time"
+)
+
+const (
+	interval  = 60  //扫描间隔(秒)
+	grace     = 60  //过期后等待的时间(秒),避免与渠道时间误差导致提前关闭
+	batchSize = 100 //每次取出的过期订单数量
+)
+
+//启动过期订单扫描,关闭过期未支付的订单
+func Start() {
+	go func() {
+		ticker := time.NewTicker(interval * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			Sweep()
+		}
+	}()
+}
+
+//关闭一批过期未支付的订单
+func Sweep() {
+	s := store.Default()
+	if s == nil {
+		return
+	}
+	list, err := s.ListExpiredOrders(time.Now().Unix()-grace, batchSize)
+	if err != nil {
+		fmt.Println("sweeper list error:", err)
+		return
+	}
+	for _, order := range list {
+		expire(s, order)
+	}
+}
+
+//先查询订单,已支付时按查询结果迁移状态,否则向渠道关闭订单并标记为已关闭.
+//渠道确认订单已关闭或交易不存在时只标记本地订单,其它失败(如系统繁忙,用户支付中)等待下次扫描
+func expire(s store.Store, order store.Order) {
+	g, ok := gateway.Get(order.MerchantId, order.Channel)
+	if !ok {
+		return
+	}
+	q, err := g.Query(order.TradeNo)
+	if err != nil && err != gateway.ErrNotSupport {
+		fmt.Printf("sweeper query %s error: %v\n", order.TradeNo, err)
+		return
+	}
+	if err == nil && q.ErrCode == 0 {
+		switch gateway.StatusOf(q.TradeState) {
+		case STATUS_PAID, STATUS_CLOSED, STATUS_REVERSED:
+			//查询时已迁移订单状态
+			return
+		}
+	}
+	ret, err := g.Close(order.TradeNo)
+	if err != nil {
+		fmt.Printf("sweeper close %s error: %v\n", order.TradeNo, err)
+		return
+	}
+	switch ret.ErrCode {
+	case 0:
+		//关闭时已迁移订单状态
+		return
+	case ERR_ORDER_CLOSED, ERR_TRADE_NOT_EXIST:
+	default:
+		fmt.Printf("sweeper close %s error: %d %s\n", order.TradeNo, ret.ErrCode, ret.ErrMsg)
+		return
+	}
+	if _, err = store.Transit(s, order.MerchantId, order.TradeNo, STATUS_CLOSED, EMPTY); err != nil {
+		fmt.Printf("sweeper transit %s error: %v\n", order.TradeNo, err)
+	}
+}
@@ -0,0 +1,232 @@
+package unify_payment
+
+import (
+	"github.com/gin-gonic/gin"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/poller"
+	"strings"
+	"utils/gin_check"
+)
+
+//统一下单渠道
+const (
+	WECHAT_NATIVE = "wechat_native" //微信扫码支付
+	WECHAT_JSAPI  = "wechat_jsapi"  //微信公众号支付
+	WECHAT_APP    = "wechat_app"    //微信APP支付
+	WECHAT_MINI   = "wechat_mini"   //微信小程序支付
+	WECHAT_MICRO  = "wechat_micro"  //微信付款码支付
+	ALIPAY_NATIVE = "alipay_native" //支付宝扫码支付
+	ALIPAY_MICRO  = "alipay_micro"  //支付宝付款码支付
+	ALIPAY_H5     = "alipay_h5"     //支付宝手机网页支付
+	ALIPAY_APP    = "alipay_app"    //支付宝APP支付
+	ALIPAY_PAGE   = "alipay_page"   //支付宝电脑网站支付
+)
+
+//渠道对应的支付渠道和交易类型
+type channelInfo struct {
+	provider  string //支付渠道(wechat,alipay)
+	tradeType string //交易类型
+}
+
+var channels = map[string]channelInfo{
+	WECHAT_NATIVE: {gateway.WECHAT, gateway.TRADE_NATIVE},
+	WECHAT_JSAPI:  {gateway.WECHAT, gateway.TRADE_JSAPI},
+	WECHAT_APP:    {gateway.WECHAT, gateway.TRADE_APP},
+	WECHAT_MINI:   {gateway.WECHAT, gateway.TRADE_MINI},
+	WECHAT_MICRO:  {gateway.WECHAT, gateway.TRADE_MICRO},
+	ALIPAY_NATIVE: {gateway.ALIPAY, gateway.TRADE_NATIVE},
+	ALIPAY_MICRO:  {gateway.ALIPAY, gateway.TRADE_MICRO},
+	ALIPAY_H5:     {gateway.ALIPAY, gateway.TRADE_H5},
+	ALIPAY_APP:    {gateway.ALIPAY, gateway.TRADE_APP},
+	ALIPAY_PAGE:   {gateway.ALIPAY, gateway.TRADE_PAGE},
+}
+
+//统一下单返回
+type RetOrder struct {
+	Channel string `json:"channel"` //支付渠道
+	gateway.OrderResult
+}
+
+//统一查询订单返回
+type RetQuery struct {
+	Channel string `json:"channel"` //支付渠道
+	gateway.QueryResult
+}
+
+//统一退款返回
+type RetRefund struct {
+	Channel string `json:"channel"` //支付渠道
+	gateway.RefundResult
+}
+
+//统一关闭,撤销订单返回
+type RetResult struct {
+	Channel string `json:"channel"` //支付渠道
+	TradeNo string `json:"out_trade_no"`
+	gateway.Result
+}
+
+//错误码目录返回
+type RetErrors struct {
+	gateway.Result
+	Errors []ErrorInfo `json:"errors"` //全部错误码及是否可重试
+}
+
+//错误码目录
+func ListErrors(c *gin.Context) {
+	c.JSON(HTTP_SUCCESS, RetErrors{Errors: ErrorCatalogue()})
+}
+
+//统一下单
+func CreateOrder(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, CHANNEL, OUT_TRADE_NO, BODY, TOTAL_FEE); err == nil {
+		channel := mapData[CHANNEL].(string)
+		info, ok := channels[channel]
+		if !ok {
+			gateway.ReturnError(ERR_INVALID_PARAM, MSG_IVALID_PARAM+":"+CHANNEL, c)
+			return
+		}
+		merchantId := stringOf(mapData, MERCHANT_ID)
+		g, ok := gateway.Get(merchantId, info.provider)
+		if !ok {
+			gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+			return
+		}
+		totalFee, err := ParseMoney(mapData[TOTAL_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{
+			TradeType: info.tradeType,
+			Body:      mapData[BODY].(string),
+			TradeNo:   mapData[OUT_TRADE_NO].(string),
+			NotifyUrl: stringOf(mapData, NOTIFY_URL),
+			ClientIp:  stringOf(mapData, CLIENT_IP),
+			AuthCode:  stringOf(mapData, AUTH_CODE),
+			Code:      stringOf(mapData, CODE),
+			TotalFee:  totalFee,
+			Timeout:   stringOf(mapData, TIMEOUT),
+			Passback:  stringOf(mapData, PASSBACK),
+			ReturnUrl: stringOf(mapData, RETURN_URL),
+		}
+		ret, err := g.CreateOrder(req)
+		if req.TradeType == gateway.TRADE_MICRO {
+			poller.AfterMicroPay(merchantId, info.provider, req.TradeNo, ret, err)
+		}
+		if err == nil {
+			c.JSON(HTTP_SUCCESS, RetOrder{Channel: channel, OrderResult: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//统一查询订单
+func QueryOrder(c *gin.Context) {
+	if g, channel, ok := gatewayOf(c); ok {
+		if ret, err := g.Query(c.Param("no")); err == nil {
+			c.JSON(HTTP_SUCCESS, RetQuery{Channel: channel, QueryResult: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//统一退款
+func Refund(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, CHANNEL, OUT_REFUND_NO, REFUND_FEE); err == nil {
+		merchantId := stringOf(mapData, MERCHANT_ID)
+		g, ok := gateway.Get(merchantId, providerOf(mapData[CHANNEL].(string)))
+		if !ok {
+			gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+			return
+		}
+		//total_fee可不传,默认取本地订单金额
+		totalFee, err := MoneyOf(mapData, TOTAL_FEE)
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		refundFee, err := ParseMoney(mapData[REFUND_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.RefundRequest{
+			TradeNo:     c.Param("no"),
+			OutRefundNo: mapData[OUT_REFUND_NO].(string),
+			NotifyUrl:   stringOf(mapData, NOTIFY_URL),
+			TotalFee:    totalFee,
+			RefundFee:   refundFee,
+		}
+		if ret, err := g.Refund(req); err == nil {
+			c.JSON(HTTP_SUCCESS, RetRefund{Channel: mapData[CHANNEL].(string), RefundResult: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//统一查询退款
+func QueryRefund(c *gin.Context) {
+	if g, channel, ok := gatewayOf(c); ok {
+		if ret, err := g.QueryRefund(c.Param("no"), c.Param("refund_no")); err == nil {
+			c.JSON(HTTP_SUCCESS, RetRefund{Channel: channel, RefundResult: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//统一关闭订单
+func CloseOrder(c *gin.Context) {
+	if g, channel, ok := gatewayOf(c); ok {
+		if ret, err := g.Close(c.Param("no")); err == nil {
+			c.JSON(HTTP_SUCCESS, RetResult{Channel: channel, TradeNo: c.Param("no"), Result: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//统一撤销订单
+func ReverseOrder(c *gin.Context) {
+	if g, channel, ok := gatewayOf(c); ok {
+		if ret, err := g.Reverse(c.Param("no")); err == nil {
+			c.JSON(HTTP_SUCCESS, RetResult{Channel: channel, TradeNo: c.Param("no"), Result: ret})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
+}
+
+//根据url参数channel和merchant_id获取商户的支付渠道
+func gatewayOf(c *gin.Context) (g gateway.PaymentGateway, channel string, ok bool) {
+	channel = c.Query(CHANNEL)
+	if channel == EMPTY {
+		gateway.ReturnError(ERR_LACK_PARAM, "缺少参数:"+CHANNEL, c)
+		return
+	}
+	merchantId := c.Query(MERCHANT_ID)
+	if g, ok = gateway.Get(merchantId, providerOf(channel)); !ok {
+		gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+	}
+	return
+}
+
+//渠道对应的支付渠道,channel可以是wechat_native或wechat
+func providerOf(channel string) (provider string) {
+	if info, ok := channels[channel]; ok {
+		return info.provider
+	}
+	provider = strings.SplitN(channel, "_", 2)[0]
+	return
+}
+
+//获取可选字符串参数
+func stringOf(mapData map[string]interface{}, key string) (value string) {
+	value, _ = mapData[key].(string)
+	return
+}
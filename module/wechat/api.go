@@ -0,0 +1,289 @@
+package wechat_payment
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"sort"
+	"strings"
+	"time"
+	"utils/wxpay"
+)
+
+//微信支付接口地址
+const WX_API_URL = "https://api.mch.weixin.qq.com"
+
+//签名类型
+const (
+	SIGN_MD5         = "MD5"
+	SIGN_HMAC_SHA256 = "HMAC-SHA256"
+)
+
+//utils/wxpay只封装了固定参数的MD5签名接口,不支持服务商子商户参数,HMAC-SHA256签名,商户证书和gzip账单,
+//服务商模式,指定有效时间的下单和对账单下载由这里直接调用接口,商户号和密钥与utils/wxpay使用同一份配置
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+//接口返回的错误信息
+type apiError struct {
+	ReturnCode string `xml:"return_code"` //返回状态码
+	ReturnMsg  string `xml:"return_msg"`  //返回信息
+	ErrorCode  string `xml:"error_code"`  //对账单接口的错误代码
+}
+
+//调用微信支付接口,未指定appid时使用公众号appid,useCert为true时使用商户证书.return_code不为SUCCESS时返回错误,gzip压缩的内容自动解压.
+//服务商模式下未指定时带上子商户号和子商户appid,不支持子商户的接口传入空的sub_mch_id,空值参数不发送
+func (g *WeChatGateway) post(path string, params map[string]string, signType string, useCert bool) (body []byte, err error) {
+	if params["appid"] == EMPTY {
+		params["appid"] = g.pay.AppId
+	}
+	params["mch_id"] = g.pay.MchId
+	if _, ok := params["sub_mch_id"]; !ok && g.partner() {
+		params["sub_mch_id"] = g.subMchId
+		if _, ok = params["sub_appid"]; !ok {
+			params["sub_appid"] = g.subAppId
+		}
+	}
+	for k, v := range params {
+		if v == EMPTY {
+			delete(params, k)
+		}
+	}
+	params["nonce_str"] = nonceStr()
+	if signType != SIGN_MD5 {
+		params["sign_type"] = signType
+	}
+	params["sign"] = g.sign(params, signType)
+	client := apiClient
+	if useCert {
+		if err = g.checkCert(); err != nil {
+			return
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(g.certFile, g.keyFile); err != nil {
+			err = gateway.NewError(ERR_CERT, MSG_CERT+":"+err.Error())
+			return
+		}
+		client = &http.Client{Timeout: apiClient.Timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}}
+	}
+	var resp *http.Response
+	if resp, err = client.Post(WX_API_URL+path, "text/xml; charset=utf-8", strings.NewReader(xmlOf(params))); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		var reader *gzip.Reader
+		if reader, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return
+		}
+		defer reader.Close()
+		if body, err = ioutil.ReadAll(reader); err == nil {
+			body, err = untar(body)
+		}
+		return
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("<xml>")) {
+		var e apiError
+		xml.Unmarshal(body, &e)
+		if e.ReturnCode != weixin.SUCCESS {
+			msg := e.ReturnMsg
+			if e.ErrorCode != EMPTY {
+				msg = e.ErrorCode + ":" + e.ReturnMsg
+			}
+			code := ERR_CALL_PARMENT
+			if strings.Contains(e.ReturnMsg, "签名") {
+				code = ERR_SIGN
+			}
+			err = gateway.NewError(code, msg)
+		}
+	}
+	return
+}
+
+//调用返回xml的接口,验证返回签名后返回全部字段.业务结果(result_code)由调用方判断.
+//return_code为SUCCESS的返回必须带签名,只有通信失败的返回可以不带签名
+func (g *WeChatGateway) call(path string, params map[string]string, signType string, useCert bool) (resp map[string]string, err error) {
+	var body []byte
+	if body, err = g.post(path, params, signType, useCert); err != nil {
+		return
+	}
+	if resp, err = xmlToMap(body); err != nil {
+		return
+	}
+	sign := resp["sign"]
+	if (sign == EMPTY && resp["return_code"] == weixin.SUCCESS) || (sign != EMPTY && sign != g.sign(resp, signType)) {
+		err = gateway.ErrVerifySign
+	}
+	return
+}
+
+//业务结果对应的统一错误码和错误信息
+func resultOf(resp map[string]string) (ret gateway.Result) {
+	if resp["result_code"] != weixin.SUCCESS {
+		ret = gateway.ResultOf(errorCodeOf(resp["err_code"]), resp["err_code"]+":"+resp["err_code_des"])
+	}
+	return
+}
+
+//微信err_code对应的统一错误码
+var wxErrorCodes = map[string]int{
+	"SYSTEMERROR":           ERR_SYSTEM,
+	"BANKERROR":             ERR_SYSTEM,
+	"NOTENOUGH":             ERR_BALANCE,
+	"USERPAYING":            ERR_USER_PAYING,
+	"ORDERCLOSED":           ERR_ORDER_CLOSED,
+	"ORDERPAID":             ERR_ORDER_PAID,
+	"ORDERREVERSED":         ERR_ORDER_REVERSED,
+	"OUT_TRADE_NO_USED":     ERR_DUPLICATE_ORDER,
+	"ORDERNOTEXIST":         ERR_TRADE_NOT_EXIST,
+	"REFUNDNOTEXIST":        ERR_TRADE_NOT_EXIST,
+	"TRADE_STATE_ERROR":     ERR_ORDER_STATE,
+	"TRADE_OVERDUE":         ERR_ORDER_STATE,
+	"AUTHCODEEXPIRE":        ERR_AUTH_CODE,
+	"AUTH_CODE_ERROR":       ERR_AUTH_CODE,
+	"AUTH_CODE_INVALID":     ERR_AUTH_CODE,
+	"BUYER_MISMATCH":        ERR_BUYER,
+	"USER_ACCOUNT_ABNORMAL": ERR_BUYER,
+	"SIGNERROR":             ERR_SIGN,
+	"NOAUTH":                ERR_PERMISSION,
+	"APPID_NOT_EXIST":       ERR_PERMISSION,
+	"MCHID_NOT_EXIST":       ERR_PERMISSION,
+	"APPID_MCHID_NOT_MATCH": ERR_PERMISSION,
+	"FREQUENCY_LIMITED":     ERR_FREQUENCY,
+	"INVALID_REQ_TOO_MUCH":  ERR_FREQUENCY,
+	"PARAM_ERROR":           ERR_INVALID_PARAM,
+	"LACK_PARAMS":           ERR_INVALID_PARAM,
+	"XML_FORMAT_ERROR":      ERR_INVALID_PARAM,
+	"POST_DATA_EMPTY":       ERR_INVALID_PARAM,
+	"NOT_UTF8":              ERR_INVALID_PARAM,
+	"REQUIRE_POST_METHOD":   ERR_INVALID_PARAM,
+	"INVALID_TRANSACTIONID": ERR_INVALID_PARAM,
+	"INVALID_REQUEST":       ERR_INVALID_PARAM,
+}
+
+//微信err_code对应的统一错误码,未知错误码为调用失败
+func errorCodeOf(errCode string) int {
+	if code, ok := wxErrorCodes[errCode]; ok {
+		return code
+	}
+	return ERR_CALL_PARMENT
+}
+
+//检查商户证书,退款和撤销接口需要
+func (g *WeChatGateway) checkCert() error {
+	if g.certFile == EMPTY || g.keyFile == EMPTY {
+		return gateway.ErrCert
+	}
+	return nil
+}
+
+//xml转为字段map,只取根节点下的字段
+func xmlToMap(body []byte) (m map[string]string, err error) {
+	m = make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var key string
+	depth := 0
+	for {
+		var token xml.Token
+		if token, err = decoder.Token(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				key = t.Name.Local
+				m[key] = EMPTY
+			}
+		case xml.CharData:
+			if depth == 2 {
+				m[key] += string(t)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+//gzip解压后为tar包时取第一个文件的内容,否则原样返回
+func untar(content []byte) (body []byte, err error) {
+	if len(content) < 262 || string(content[257:262]) != "ustar" {
+		body = content
+		return
+	}
+	reader := tar.NewReader(bytes.NewReader(content))
+	for {
+		var h *tar.Header
+		if h, err = reader.Next(); err != nil {
+			if err == io.EOF {
+				err = errors.New("wechat bill file not found")
+			}
+			return
+		}
+		if h.Typeflag == tar.TypeReg {
+			body, err = ioutil.ReadAll(reader)
+			return
+		}
+	}
+}
+
+//接口签名,参数按名称排序后以key=value&拼接,最后加上&key=api密钥
+func (g *WeChatGateway) sign(params map[string]string, signType string) string {
+	var keys []string
+	for k, v := range params {
+		if k != "sign" && v != EMPTY {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+params[k])
+	}
+	var h hash.Hash
+	if signType == SIGN_HMAC_SHA256 {
+		h = hmac.New(sha256.New, []byte(g.apiSecret))
+	} else {
+		h = md5.New()
+	}
+	h.Write([]byte(strings.Join(pairs, "&") + "&key=" + g.apiSecret))
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+}
+
+//请求参数转为xml
+func xmlOf(params map[string]string) string {
+	var buff bytes.Buffer
+	buff.WriteString("<xml>")
+	for k, v := range params {
+		buff.WriteString("<" + k + "><![CDATA[" + strings.Replace(v, "]]>", "]]]]><![CDATA[>", -1) + "]]></" + k + ">")
+	}
+	buff.WriteString("</xml>")
+	return buff.String()
+}
+
+//随机串
+func nonceStr() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
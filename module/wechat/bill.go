@@ -0,0 +1,350 @@
+package wechat_payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pay_service/module/bill"
+	. "pay_service/module/comm"
+	"pay_service/module/store"
+	"strconv"
+	"strings"
+)
+
+//微信账单类型
+const (
+	BILL_TYPE_ALL           = "ALL"                //当日所有订单信息(不含充值退款订单)
+	BILL_TYPE_SUCCESS       = "SUCCESS"            //当日成功支付的订单
+	BILL_TYPE_REFUND        = "REFUND"             //当日退款订单
+	BILL_FUNDFLOW_BASIC     = "FUNDFLOW_BASIC"     //基本账户资金账单
+	BILL_FUNDFLOW_OPERATION = "FUNDFLOW_OPERATION" //运营账户资金账单
+	BILL_FUNDFLOW_FEES      = "FUNDFLOW_FEES"      //手续费账户资金账单
+)
+
+//资金账单类型对应的资金账户类型
+var fundFlowAccounts = map[string]string{
+	BILL_FUNDFLOW_BASIC:     "Basic",
+	BILL_FUNDFLOW_OPERATION: "Operation",
+	BILL_FUNDFLOW_FEES:      "Fees",
+}
+
+var errBillType = errors.New("无效的参数:" + BILL_TYPE)
+
+//微信交易账单记录
+type WxTradeBill struct {
+	TradeTime       string `json:"trade_time"`        //交易时间
+	AppId           string `json:"appid"`             //公众账号ID
+	MchId           string `json:"mch_id"`            //商户号
+	SubMchId        string `json:"sub_mch_id"`        //特约商户号
+	DeviceInfo      string `json:"device_info"`       //设备号
+	TransactionId   string `json:"transaction_id"`    //微信订单号
+	OutTradeNo      string `json:"out_trade_no"`      //商户订单号
+	OpenId          string `json:"openid"`            //用户标识
+	TradeType       string `json:"trade_type"`        //交易类型
+	TradeState      string `json:"trade_state"`       //交易状态(SUCCESS,REFUND,REVOKED)
+	BankType        string `json:"bank_type"`         //付款银行
+	FeeType         string `json:"fee_type"`          //货币种类
+	SettlementFee   Money  `json:"settlement_fee"`    //应结订单金额(分)
+	CouponFee       Money  `json:"coupon_fee"`        //代金券金额(分)
+	RefundId        string `json:"refund_id"`         //微信退款单号
+	OutRefundNo     string `json:"out_refund_no"`     //商户退款单号
+	RefundFee       Money  `json:"refund_fee"`        //退款金额(分)
+	CouponRefundFee Money  `json:"coupon_refund_fee"` //充值券退款金额(分)
+	RefundType      string `json:"refund_type"`       //退款类型
+	RefundStatus    string `json:"refund_status"`     //退款状态
+	Body            string `json:"body"`              //商品名称
+	Attach          string `json:"attach"`            //商户数据包
+	ServiceFee      Money  `json:"service_fee"`       //手续费(分)
+	Rate            string `json:"rate"`              //费率
+	TotalFee        Money  `json:"total_fee"`         //订单金额(分)
+	ApplyRefundFee  Money  `json:"apply_refund_fee"`  //申请退款金额(分)
+}
+
+//微信交易账单汇总
+type WxTradeBillSummary struct {
+	Count             int   `json:"count"`             //总交易单数
+	SettlementFee     Money `json:"settlement_fee"`    //应结订单总金额(分)
+	RefundFee         Money `json:"refund_fee"`        //退款总金额(分)
+	CouponRefundFee   Money `json:"coupon_refund_fee"` //充值券退款总金额(分)
+	ServiceFee        Money `json:"service_fee"`       //手续费总金额(分)
+	TotalFee          Money `json:"total_fee"`         //订单总金额(分)
+	ApplyRefundFee    Money `json:"apply_refund_fee"`  //申请退款总金额(分)
+	hasTotalFee       bool
+	hasApplyRefundFee bool
+}
+
+//微信资金账单记录
+type WxFundFlowBill struct {
+	BillTime      string `json:"bill_time"`      //记账时间
+	TransactionId string `json:"transaction_id"` //微信支付业务单号
+	FlowId        string `json:"flow_id"`        //资金流水单号
+	BizName       string `json:"biz_name"`       //业务名称
+	BizType       string `json:"biz_type"`       //业务类型
+	InOut         string `json:"in_out"`         //收支类型(收入,支出)
+	Amount        Money  `json:"amount"`         //收支金额(分)
+	Balance       Money  `json:"balance"`        //账户结余(分)
+	Applicant     string `json:"applicant"`      //资金变更提交申请人
+	Remark        string `json:"remark"`         //备注
+	VoucherNo     string `json:"voucher_no"`     //业务凭证号
+}
+
+//微信资金账单汇总
+type WxFundFlowSummary struct {
+	Count        int   `json:"count"`         //资金流水总笔数
+	IncomeCount  int   `json:"income_count"`  //收入笔数
+	Income       Money `json:"income"`        //收入金额(分)
+	OutcomeCount int   `json:"outcome_count"` //支出笔数
+	Outcome      Money `json:"outcome"`       //支出金额(分)
+}
+
+//下载并解析对账单,billType为ALL,SUCCESS,REFUND或FUNDFLOW_BASIC等资金账单,billDate为yyyy-MM-dd或yyyyMMdd.
+//汇总行与明细合计不一致时返回错误
+func (g *WeChatGateway) DownloadBill(billType, billDate string) (bills []store.Bill, err error) {
+	date := strings.Replace(billDate, "-", EMPTY, -1)
+	var body []byte
+	if account, ok := fundFlowAccounts[billType]; ok {
+		//资金账单需要商户证书,只支持HMAC-SHA256签名.服务商模式下为服务商的资金账单,不带子商户号
+		params := map[string]string{"bill_date": date, "account_type": account, "tar_type": "GZIP", "sub_mch_id": EMPTY}
+		if body, err = g.post("/pay/downloadfundflow", params, SIGN_HMAC_SHA256, true); err != nil {
+			return
+		}
+		var list []WxFundFlowBill
+		if list, _, err = ParseFundFlowBill(body); err == nil {
+			for _, r := range list {
+				bills = append(bills, r.bill())
+			}
+		}
+		return
+	}
+	if billType != BILL_TYPE_ALL && billType != BILL_TYPE_SUCCESS && billType != BILL_TYPE_REFUND {
+		err = errBillType
+		return
+	}
+	params := map[string]string{"bill_date": date, "bill_type": billType, "tar_type": "GZIP"}
+	if body, err = g.post("/pay/downloadbill", params, SIGN_MD5, false); err != nil {
+		return
+	}
+	var list []WxTradeBill
+	if list, _, err = ParseTradeBill(body); err == nil {
+		for _, r := range list {
+			bills = append(bills, r.bill())
+		}
+	}
+	return
+}
+
+//解析交易账单,校验汇总行与明细合计
+func ParseTradeBill(content []byte) (list []WxTradeBill, summary WxTradeBillSummary, err error) {
+	var detail, total bill.Table
+	if detail, total, err = parseBillTables(content); err != nil {
+		return
+	}
+	for i, row := range detail.Rows {
+		var fees []Money
+		if fees, err = detail.Fees(row, "应结订单金额", "代金券金额", "退款金额", "充值券退款金额", "手续费", "订单金额",
+			"申请退款金额"); err != nil {
+			err = fmt.Errorf("wechat bill line %d: %v", i+1, err)
+			return
+		}
+		list = append(list, WxTradeBill{
+			TradeTime:       detail.Get(row, "交易时间"),
+			AppId:           detail.Get(row, "公众账号ID"),
+			MchId:           detail.Get(row, "商户号"),
+			SubMchId:        detail.Get(row, "特约商户号"),
+			DeviceInfo:      detail.Get(row, "设备号"),
+			TransactionId:   detail.Get(row, "微信订单号"),
+			OutTradeNo:      detail.Get(row, "商户订单号"),
+			OpenId:          detail.Get(row, "用户标识"),
+			TradeType:       detail.Get(row, "交易类型"),
+			TradeState:      detail.Get(row, "交易状态"),
+			BankType:        detail.Get(row, "付款银行"),
+			FeeType:         detail.Get(row, "货币种类"),
+			SettlementFee:   fees[0],
+			CouponFee:       fees[1],
+			RefundId:        detail.Get(row, "微信退款单号"),
+			OutRefundNo:     detail.Get(row, "商户退款单号"),
+			RefundFee:       fees[2],
+			CouponRefundFee: fees[3],
+			RefundType:      detail.Get(row, "退款类型"),
+			RefundStatus:    detail.Get(row, "退款状态"),
+			Body:            detail.Get(row, "商品名称"),
+			Attach:          detail.Get(row, "商户数据包"),
+			ServiceFee:      fees[4],
+			Rate:            detail.Get(row, "费率"),
+			TotalFee:        fees[5],
+			ApplyRefundFee:  fees[6],
+		})
+	}
+	if len(total.Rows) == 0 {
+		err = errors.New("wechat bill summary not found")
+		return
+	}
+	row := total.Rows[0]
+	var fees []Money
+	if fees, err = total.Fees(row, "应结订单总金额", "退款总金额", "充值券退款总金额", "手续费总金额", "订单总金额",
+		"申请退款总金额"); err != nil {
+		err = fmt.Errorf("wechat bill summary: %v", err)
+		return
+	}
+	summary = WxTradeBillSummary{
+		Count:             countOf(total.Get(row, "总交易单数")),
+		SettlementFee:     fees[0],
+		RefundFee:         fees[1],
+		CouponRefundFee:   fees[2],
+		ServiceFee:        fees[3],
+		TotalFee:          fees[4],
+		ApplyRefundFee:    fees[5],
+		hasTotalFee:       total.Has("订单总金额"),
+		hasApplyRefundFee: total.Has("申请退款总金额"),
+	}
+	var sum WxTradeBillSummary
+	sum.Count = len(list)
+	for _, r := range list {
+		sum.SettlementFee = sum.SettlementFee.Add(r.SettlementFee)
+		sum.RefundFee = sum.RefundFee.Add(r.RefundFee)
+		sum.CouponRefundFee = sum.CouponRefundFee.Add(r.CouponRefundFee)
+		sum.ServiceFee = sum.ServiceFee.Add(r.ServiceFee)
+		sum.TotalFee = sum.TotalFee.Add(r.TotalFee)
+		sum.ApplyRefundFee = sum.ApplyRefundFee.Add(r.ApplyRefundFee)
+	}
+	switch {
+	case sum.Count != summary.Count:
+		err = summaryError("总交易单数", summary.Count, sum.Count)
+	case sum.SettlementFee.Amount != summary.SettlementFee.Amount:
+		err = summaryError("应结订单总金额", summary.SettlementFee, sum.SettlementFee)
+	case sum.RefundFee.Amount != summary.RefundFee.Amount:
+		err = summaryError("退款总金额", summary.RefundFee, sum.RefundFee)
+	case sum.ServiceFee.Amount != summary.ServiceFee.Amount:
+		err = summaryError("手续费总金额", summary.ServiceFee, sum.ServiceFee)
+	case summary.hasTotalFee && sum.TotalFee.Amount != summary.TotalFee.Amount:
+		err = summaryError("订单总金额", summary.TotalFee, sum.TotalFee)
+	case summary.hasApplyRefundFee && sum.ApplyRefundFee.Amount != summary.ApplyRefundFee.Amount:
+		err = summaryError("申请退款总金额", summary.ApplyRefundFee, sum.ApplyRefundFee)
+	}
+	return
+}
+
+//解析资金账单,校验汇总行与明细合计
+func ParseFundFlowBill(content []byte) (list []WxFundFlowBill, summary WxFundFlowSummary, err error) {
+	var detail, total bill.Table
+	if detail, total, err = parseBillTables(content); err != nil {
+		return
+	}
+	for i, row := range detail.Rows {
+		var fees []Money
+		if fees, err = detail.Fees(row, "收支金额", "账户结余"); err != nil {
+			err = fmt.Errorf("wechat fund flow line %d: %v", i+1, err)
+			return
+		}
+		list = append(list, WxFundFlowBill{
+			BillTime:      detail.Get(row, "记账时间"),
+			TransactionId: detail.Get(row, "微信支付业务单号"),
+			FlowId:        detail.Get(row, "资金流水单号"),
+			BizName:       detail.Get(row, "业务名称"),
+			BizType:       detail.Get(row, "业务类型"),
+			InOut:         detail.Get(row, "收支类型"),
+			Amount:        fees[0],
+			Balance:       fees[1],
+			Applicant:     detail.Get(row, "资金变更提交申请人"),
+			Remark:        detail.Get(row, "备注"),
+			VoucherNo:     detail.Get(row, "业务凭证号"),
+		})
+	}
+	if len(total.Rows) == 0 {
+		err = errors.New("wechat fund flow summary not found")
+		return
+	}
+	row := total.Rows[0]
+	var fees []Money
+	if fees, err = total.Fees(row, "收入金额", "支出金额"); err != nil {
+		err = fmt.Errorf("wechat fund flow summary: %v", err)
+		return
+	}
+	summary = WxFundFlowSummary{
+		Count:        countOf(total.Get(row, "资金流水总笔数")),
+		IncomeCount:  countOf(total.Get(row, "收入笔数")),
+		Income:       fees[0],
+		OutcomeCount: countOf(total.Get(row, "支出笔数")),
+		Outcome:      fees[1],
+	}
+	var sum WxFundFlowSummary
+	sum.Count = len(list)
+	for _, r := range list {
+		if r.InOut == "收入" {
+			sum.IncomeCount++
+			sum.Income = sum.Income.Add(r.Amount)
+		} else {
+			sum.OutcomeCount++
+			sum.Outcome = sum.Outcome.Add(r.Amount)
+		}
+	}
+	switch {
+	case sum.Count != summary.Count:
+		err = summaryError("资金流水总笔数", summary.Count, sum.Count)
+	case sum.Income.Amount != summary.Income.Amount:
+		err = summaryError("收入金额", summary.Income, sum.Income)
+	case sum.Outcome.Amount != summary.Outcome.Amount:
+		err = summaryError("支出金额", summary.Outcome, sum.Outcome)
+	}
+	return
+}
+
+func summaryError(name string, summary, sum interface{}) error {
+	return fmt.Errorf("wechat bill summary mismatch: %s %v, detail total %v", name, summary, sum)
+}
+
+//交易账单转为对账单记录,退款记录的金额取退款金额
+func (r WxTradeBill) bill() (b store.Bill) {
+	b = store.Bill{TradeNo: r.OutTradeNo, TransactionId: r.TransactionId, Kind: r.TradeState, Amount: r.TotalFee, Fee: r.ServiceFee,
+		TradeTime: r.TradeTime}
+	if b.Amount.Amount == 0 {
+		b.Amount = r.SettlementFee
+	}
+	switch r.TradeState {
+	case "SUCCESS":
+		b.Kind = BILL_PAY
+	case "REFUND":
+		b.Kind = BILL_REFUND
+		b.OutRefundNo = r.OutRefundNo
+		if b.Amount = r.ApplyRefundFee; b.Amount.Amount == 0 {
+			b.Amount = r.RefundFee
+		}
+	}
+	raw, _ := json.Marshal(r)
+	b.Raw = string(raw)
+	return
+}
+
+//资金账单转为对账单记录,金额收入为正,支出为负
+func (r WxFundFlowBill) bill() (b store.Bill) {
+	b = store.Bill{TransactionId: r.TransactionId, Kind: r.BizType, Amount: r.Amount, TradeTime: r.BillTime}
+	if r.InOut != "收入" {
+		b.Amount = Fen(-r.Amount.Amount)
+	}
+	raw, _ := json.Marshal(r)
+	b.Raw = string(raw)
+	return
+}
+
+//拆分明细表和汇总表,明细表头后为`开头的明细行,之后为汇总表头和汇总行
+func parseBillTables(content []byte) (detail, total bill.Table, err error) {
+	var tables []bill.Table
+	if tables, err = bill.ParseTables(content, "`"); err != nil {
+		return
+	}
+	if len(tables) == 0 {
+		err = errors.New("wechat bill is empty")
+		return
+	}
+	detail = tables[0]
+	if len(tables) > 1 {
+		total = tables[len(tables)-1]
+	}
+	return
+}
+
+//笔数
+func countOf(count string) (n int) {
+	n, _ = strconv.Atoi(strings.TrimSpace(count))
+	return
+}
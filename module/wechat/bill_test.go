@@ -0,0 +1,85 @@
+package wechat_payment
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "pay_service/module/comm"
+	"testing"
+)
+
+func TestParseTradeBill(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/trade_bill.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, summary, err := ParseTradeBill(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("got %d records, want 3", len(list))
+	}
+	r := list[0]
+	if r.TradeTime != "2019-01-01 10:00:00" || r.TransactionId != "4200000001201901010001" || r.OutTradeNo != "T001" ||
+		r.TradeState != "SUCCESS" || r.Body != "商品A" || r.TotalFee.Amount != 100 || r.ServiceFee.Amount != 1 || r.Rate != "0.60%" {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if r := list[2]; r.OutRefundNo != "R001" || r.RefundFee.Amount != 50 || r.ApplyRefundFee.Amount != 50 || r.ServiceFee.Amount != -1 {
+		t.Errorf("record 2 = %+v", r)
+	}
+	if summary.Count != 3 || summary.SettlementFee.Amount != 300 || summary.RefundFee.Amount != 50 || summary.ServiceFee.Amount != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if b := list[0].bill(); b.Kind != BILL_PAY || b.TradeNo != "T001" || b.Amount.Amount != 100 || b.Fee.Amount != 1 {
+		t.Errorf("pay bill = %+v", b)
+	}
+	if b := list[2].bill(); b.Kind != BILL_REFUND || b.OutRefundNo != "R001" || b.Amount.Amount != 50 {
+		t.Errorf("refund bill = %+v", b)
+	}
+}
+
+func TestParseTradeBillInvalid(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/trade_bill.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]byte{
+		"count mismatch":  bytes.Replace(content, []byte("`3,`3.00"), []byte("`4,`3.00"), 1),
+		"amount mismatch": bytes.Replace(content, []byte("`3,`3.00"), []byte("`3,`3.01"), 1),
+		"invalid amount":  bytes.Replace(content, []byte("`1.00,`0.00,`0"), []byte("`1.001,`0.00,`0"), 1),
+		"no summary":      content[:bytes.Index(content, []byte("总交易单数"))],
+		"empty":           nil,
+	}
+	for name, c := range cases {
+		if _, _, err := ParseTradeBill(c); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestParseFundFlowBill(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/fund_flow_bill.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, summary, err := ParseFundFlowBill(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d records, want 2", len(list))
+	}
+	if r := list[0]; r.FlowId != "F001" || r.InOut != "收入" || r.Amount.Amount != 100 || r.Balance.Amount != 100 || r.VoucherNo != "V001" {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if summary.Count != 2 || summary.IncomeCount != 1 || summary.Income.Amount != 100 || summary.OutcomeCount != 1 ||
+		summary.Outcome.Amount != 50 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if b := list[1].bill(); b.Amount.Amount != -50 || b.TransactionId != "50000000012019010100001" {
+		t.Errorf("outcome bill = %+v", b)
+	}
+	if _, _, err = ParseFundFlowBill(bytes.Replace(content, []byte("`1,`0.50"), []byte("`1,`0.60"), 1)); err == nil {
+		t.Error("outcome mismatch: want error")
+	}
+}
@@ -0,0 +1,310 @@
+package wechat_payment
+
+import (
+	"encoding/json"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"strings"
+	"utils/data_conv/json_lib"
+	"utils/data_conv/xml_lib"
+	"utils/wechat"
+	"utils/wechat/wechat_pay"
+	"utils/wxpay"
+)
+
+//微信支付渠道,实现gateway.PaymentGateway
+type WeChatGateway struct {
+	pay       wechat_pay.WXPay //微信支付对像
+	apiSecret string           //微信api密钥
+	certFile  string           //证书路径
+	keyFile   string           //证书私钥路径
+	subMchId  string           //子商户号,服务商模式
+	subAppId  string           //子商户公众号或APP的appid,服务商模式
+	subSecret string           //子商户公众号的app密钥,用于网页授权获取sub_openid
+}
+
+//subMchId不为空时为服务商模式,appId,mchId,apiSecret和证书为服务商的配置
+func NewGateway(appId, mchId, appSecret, apiSecret string, cFile, kFile string, minProgramId, minProgramSecret string,
+	subMchId, subAppId, subSecret string) *WeChatGateway {
+	return &WeChatGateway{
+		pay: wechat_pay.WXPay{AppId: appId, MchId: mchId, AppSecret: appSecret, ApiSecret: apiSecret, MinProgramId: minProgramId,
+			MinProgramSecret: minProgramSecret},
+		apiSecret: apiSecret,
+		certFile:  cFile,
+		keyFile:   kFile,
+		subMchId:  subMchId,
+		subAppId:  subAppId,
+		subSecret: subSecret,
+	}
+}
+
+//下单,H5支付,服务商模式和指定了有效时间的扫码,公众号,小程序,APP支付直接调用统一下单接口
+func (g *WeChatGateway) CreateOrder(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	if req.TradeType == gateway.TRADE_MICRO && g.partner() {
+		return g.microPay(req)
+	}
+	if req.TradeType == gateway.TRADE_H5 || (g.partner() && req.TradeType != gateway.TRADE_MICRO) ||
+		(req.Timeout != EMPTY && req.TradeType != gateway.TRADE_MICRO) {
+		return g.placeOrder(req)
+	}
+	switch req.TradeType {
+	case gateway.TRADE_NATIVE:
+		if info, e := g.pay.GetPayCode(req.Body, req.TradeNo, req.NotifyUrl, req.ClientIp, req.TotalFee.Int()); e == nil {
+			var code RetPayCode
+			json_lib.ObjectToObject(&code, info)
+			ret.Result = analysisOf(info.RetBase, info.RetPublic)
+			ret.CodeUrl = code.CodeUrl
+			ret.PrepayId = code.PrepayId
+			ret.Raw = info
+		} else {
+			err = e
+		}
+	case gateway.TRADE_JSAPI:
+		info := g.pay.PublicPlaceOrder(req.Body, req.TradeNo, req.NotifyUrl, req.Code, req.TotalFee.Int())
+		ret.PayPage = wxPaymentPageOf(info.AppId, info.TimeStamp, info.NonceStr, info.Package, info.SignType, info.PaySign)
+		ret.PayParams = info
+		ret.Raw = info
+	case gateway.TRADE_MINI:
+		info := g.pay.MinProgramPlaceOrder(req.Body, req.TradeNo, req.NotifyUrl, req.Code, req.TotalFee.Int())
+		if info.ErrCode != 0 {
+			ret.Result = gateway.ResultOf(ERR_CALL_PARMENT, EMPTY)
+		}
+		ret.PayParams = info
+		ret.Raw = info
+	case gateway.TRADE_APP:
+		info := g.pay.AppPlaceOrder(req.Body, req.TradeNo, req.NotifyUrl, req.TotalFee.Int())
+		if info.ErrCode != 0 {
+			ret.Result = gateway.ResultOf(ERR_CALL_PARMENT, EMPTY)
+		}
+		ret.PayParams = info
+		ret.Raw = info
+	case gateway.TRADE_MICRO:
+		if info, e := g.pay.MicroPay(req.Body, req.TradeNo, req.NotifyUrl, req.AuthCode, req.TotalFee.Int()); e == nil {
+			var micro RetMicroPay
+			json_lib.ObjectToObject(&micro, info)
+			ret.Result = analysisOf(info.RetBase, info.RetPublic)
+			ret.TransactionId = micro.TransactionId
+			ret.TradeState = weixin.SUCCESS
+			if info.ResultCode != weixin.SUCCESS {
+				//支付未成功时查询订单确认是否需要用户输入密码
+				var query wechat.RetQuery
+				if query, e = g.pay.QueryOrder(req.TradeNo); e == nil {
+					ret.TradeState = query.TradeStatus
+				} else {
+					ret.TradeState = EMPTY
+				}
+			}
+			ret.Raw = info
+		} else {
+			err = e
+		}
+	default:
+		err = gateway.ErrNotSupport
+	}
+	return
+}
+
+//支付库返回的业务错误码
+type retPublic struct {
+	ErrCode string `json:"err_code"` //错误代码
+}
+
+//支付库退款查询返回的第一笔退款,金额可能为数字或字符串
+type wxLibRefundQuery struct {
+	RefundStatus string      `json:"refund_status_0"` //退款状态
+	RefundFee    json.Number `json:"refund_fee_0"`    //退款金额(分)
+}
+
+//支付库接口返回对应的统一错误码和错误信息
+func analysisOf(base wechat.RetBase, public wechat.RetPublic) (ret gateway.Result) {
+	if errCode, errMsg := wechat.AnalysisWxReturn(base, public); errCode != 0 {
+		var r retPublic
+		json_lib.ObjectToObject(&r, public)
+		ret = gateway.ResultOf(errorCodeOf(r.ErrCode), errMsg)
+	}
+	return
+}
+
+//查询订单
+func (g *WeChatGateway) Query(tradeNo string) (ret gateway.QueryResult, err error) {
+	if g.partner() {
+		return g.orderQuery(tradeNo)
+	}
+	var info wechat.RetQuery
+	if info, err = g.pay.QueryOrder(tradeNo); err == nil {
+		var query RetQueryTrade
+		json_lib.ObjectToObject(&query, info)
+		ret.Result = analysisOf(info.RetBase, info.RetPublic)
+		ret.TradeNo = query.OutTradeNo
+		ret.TransactionId = query.TransactionId
+		ret.TradeState = query.TradeStatus
+		ret.TotalFee = query.TotalFee
+		ret.Raw = info
+	}
+	return
+}
+
+//退款
+func (g *WeChatGateway) Refund(req gateway.RefundRequest) (ret gateway.RefundResult, err error) {
+	if req.TotalFee.Amount <= 0 {
+		err = gateway.ErrTotalFee
+		return
+	}
+	if err = g.checkCert(); err != nil {
+		return
+	}
+	if g.partner() {
+		return g.refund(req)
+	}
+	var info wechat.RetRefund
+	if info, err = g.pay.Refund(req.TradeNo, req.OutRefundNo, req.NotifyUrl, req.TotalFee.Int(), req.RefundFee.Int(), g.certFile,
+		g.keyFile); err == nil {
+		var refund RetRefund
+		json_lib.ObjectToObject(&refund, info)
+		ret.Result = analysisOf(info.RetBase, info.RetPublic)
+		ret.TradeNo = refund.OutTradeNo
+		ret.OutRefundNo = refund.OutRefundNo
+		ret.RefundId = refund.RefundId
+		ret.RefundFee = refund.RefundFee
+		if ret.ErrCode == 0 {
+			ret.RefundStatus = REFUND_PROCESSING
+		}
+		ret.Raw = info
+	}
+	return
+}
+
+//查询退款
+func (g *WeChatGateway) QueryRefund(tradeNo, outRefundNo string) (ret gateway.RefundResult, err error) {
+	if g.partner() {
+		return g.refundQuery(outRefundNo)
+	}
+	var info wechat.RetQueryRefund
+	if info, err = g.pay.QueryRefund(outRefundNo, EMPTY); err == nil {
+		var refund RetQueryRefund
+		json_lib.ObjectToObject(&refund, info)
+		var lib wxLibRefundQuery
+		json_lib.ObjectToObject(&lib, info)
+		ret.Result = analysisOf(info.RetBase, info.RetPublic)
+		ret.TradeNo = refund.OutTradeNo
+		ret.OutRefundNo = refund.OutRefundNo
+		ret.RefundId = refund.RefundId
+		if lib.RefundFee != EMPTY {
+			if ret.RefundFee, err = ParseMoney(lib.RefundFee); err != nil {
+				return
+			}
+		}
+		if ret.ErrCode == 0 {
+			ret.RefundStatus = refundStatusOf(lib.RefundStatus)
+		}
+		ret.Raw = info
+	}
+	return
+}
+
+//关闭订单
+func (g *WeChatGateway) Close(tradeNo string) (ret gateway.Result, err error) {
+	return g.closeOrder(tradeNo)
+}
+
+//撤销订单
+func (g *WeChatGateway) Reverse(tradeNo string) (ret gateway.Result, err error) {
+	if err = g.checkCert(); err != nil {
+		return
+	}
+	if g.partner() {
+		return g.reverse(tradeNo)
+	}
+	if info, e := g.pay.Reverse(tradeNo, g.certFile, g.keyFile); e == nil {
+		var reverse RetReverse
+		json_lib.ObjectToObject(&reverse, info)
+		ret = recallOf(analysisOf(info.RetBase, info.RetPublic), reverse.Recall)
+		ret.Raw = info
+	} else {
+		err = e
+	}
+	return
+}
+
+//异步通知验签,退款通知需解密.公众账号ID不是本商户返回ErrNotifyAppId,商户号或子商户号不是本商户返回ErrNotifyMchId
+func (g *WeChatGateway) VerifyNotify(body string) (ret gateway.NotifyResult, err error) {
+	if strings.Contains(body, "<req_info>") {
+		var info RetRefundNotifyInfo
+		if info, err = g.decodeRefundNotify(body); err == nil {
+			if err = g.checkNotifyOwner(body); err != nil {
+				return
+			}
+			ret.NotifyType = gateway.NOTIFY_REFUND
+			ret.NotifyId = info.RefundId
+			ret.TradeNo = info.OutTradeNo
+			ret.TransactionId = info.TransactionId
+			ret.OutRefundNo = info.OutRefundNo
+			ret.TradeState = info.RefundStatus
+			ret.TotalFee = info.TotalFee
+			ret.RefundFee = info.RefundFee
+			ret.Raw = info
+		}
+		return
+	}
+	if b, info := g.verifyPaymentNotify(body); b {
+		if err = g.checkNotifyOwner(body); err != nil {
+			return
+		}
+		ret.NotifyType = gateway.NOTIFY_PAYMENT
+		ret.NotifyId = info.TransactionId
+		ret.TradeNo = info.OutTradeNo
+		ret.TransactionId = info.TransactionId
+		ret.TradeState = info.TradeState
+		if ret.TradeState == EMPTY {
+			//支付通知只在支付成功时发送,不带trade_state
+			ret.TradeState = weixin.SUCCESS
+		}
+		ret.TotalFee = info.TotalFee
+		ret.Raw = info
+	} else {
+		err = gateway.ErrVerifySign
+	}
+	return
+}
+
+//检查通知的公众账号ID和商户号属于本商户,服务商模式下还检查子商户号
+func (g *WeChatGateway) checkNotifyOwner(body string) (err error) {
+	m, err := xmlToMap([]byte(body))
+	if err != nil {
+		return gateway.ErrVerifySign
+	}
+	appId := m["appid"]
+	if appId == EMPTY || (appId != g.pay.AppId && appId != g.pay.MinProgramId && appId != g.subAppId) {
+		return gateway.ErrNotifyAppId
+	}
+	if m["mch_id"] != g.pay.MchId || (g.partner() && m["sub_mch_id"] != g.subMchId) {
+		err = gateway.ErrNotifyMchId
+	}
+	return
+}
+
+//退款通知解密
+func (g *WeChatGateway) decodeRefundNotify(xmlStr string) (retInfo RetRefundNotifyInfo, err error) {
+	var info wechat.RefundNotifyInfo
+	var buff []byte
+	xml_lib.XmlToObject(xmlStr, &info)
+	if buff, err = wechat.DecodeRefundData(info.ReqInfo, g.apiSecret); err != nil {
+		//解密失败说明通知不是微信发出或api密钥不一致
+		err = gateway.NewError(ERR_VERIFY_SIGN, MSG_VERIFY_SIGN+":"+err.Error())
+		return
+	}
+	xml_lib.XmlToObject(string(buff), &info.RefundEncryptInfo)
+	json_lib.ObjectToObject(&retInfo, info.RefundEncryptInfo)
+	return
+}
+
+//支付通知验签
+func (g *WeChatGateway) verifyPaymentNotify(xmlStr string) (b bool, retInfo RetPaymentNotifyInfo) {
+	var info wechat.PaymentNotifyInfo
+	xml_lib.XmlToObject(xmlStr, &info)
+	if b = wechat.VerifySign(info, info.Sign, g.apiSecret); b {
+		json_lib.ObjectToObject(&retInfo, info)
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package wechat_payment
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"strconv"
+	"time"
+)
+
+//网页授权和小程序登录接口地址
+const (
+	OAUTH2_TOKEN_URL   = "https://api.weixin.qq.com/sns/oauth2/access_token"
+	JSCODE2SESSION_URL = "https://api.weixin.qq.com/sns/jscode2session"
+)
+
+//APP调起支付参数,字段与支付库的wechat.RetAppPay一致
+type RetAppPayParams struct {
+	RetBase
+	AppId     string `json:"appid"`     //应用ID
+	PartnerId string `json:"partnerid"` //商户号
+	PrepayId  string `json:"prepayid"`  //预支付交易会话ID
+	Package   string `json:"package"`   //固定值Sign=WXPay
+	NonceStr  string `json:"noncestr"`  //随机字符串
+	TimeStamp string `json:"timestamp"` //时间戳
+	Sign      string `json:"sign"`      //签名
+}
+
+//公众号,小程序调起支付参数,字段与支付库的wechat.RetMinProgramPay一致
+type RetJsPayParams struct {
+	RetBase
+	AppId     string `json:"appId"`     //公众号或小程序ID
+	TimeStamp string `json:"timeStamp"` //时间戳
+	NonceStr  string `json:"nonceStr"`  //随机字符串
+	Package   string `json:"package"`   //prepay_id=预支付交易会话ID
+	SignType  string `json:"signType"`  //签名类型
+	PaySign   string `json:"paySign"`   //签名
+}
+
+//H5支付返回信息
+type RetH5Pay struct {
+	RetBase
+	PrepayId string `json:"prepay_id"` //预支付交易会话ID
+	MwebUrl  string `json:"mweb_url"`  //支付跳转链接,有效期5分钟
+}
+
+//H5支付场景信息
+type h5SceneInfo struct {
+	H5Info struct {
+		Type    string `json:"type"`     //场景类型,固定为Wap
+		WapUrl  string `json:"wap_url"`  //WAP网站URL地址
+		WapName string `json:"wap_name"` //WAP网站名
+	} `json:"h5_info"`
+}
+
+//H5支付的场景信息
+func H5SceneInfo(wapUrl, wapName string) string {
+	var info h5SceneInfo
+	info.H5Info.Type = "Wap"
+	info.H5Info.WapUrl = wapUrl
+	info.H5Info.WapName = wapName
+	b, _ := json.Marshal(info)
+	return string(b)
+}
+
+//跳转到支付链接的页面,H5支付时返回给浏览器
+func redirectPageOf(payUrl string) string {
+	b, _ := json.Marshal(payUrl)
+	return `<!DOCTYPE HTML><html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"/></head>` +
+		`<body><script>window.location.href=` + string(b) + `;</script></body></html>`
+}
+
+//网页授权错误码
+const (
+	OAUTH_INVALID_CODE = 40029 //code无效
+	OAUTH_CODE_USED    = 40163 //code已被使用
+)
+
+//网页授权,小程序登录返回
+type oauthResponse struct {
+	OpenId  string `json:"openid"`  //用户标识
+	ErrCode int    `json:"errcode"` //错误码
+	ErrMsg  string `json:"errmsg"`  //错误信息
+}
+
+//统一下单(/pay/unifiedorder),指定有效时间时传入time_expire.公众号和小程序支付先用code换取openid,
+//服务商模式下子商户公众号,小程序授权的用户标识为sub_openid
+func (g *WeChatGateway) placeOrder(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	params := map[string]string{"body": req.Body, "out_trade_no": req.TradeNo, "total_fee": req.TotalFee.String(),
+		"spbill_create_ip": req.ClientIp, "notify_url": req.NotifyUrl}
+	if req.Timeout != EMPTY {
+		var expireAt time.Time
+		if expireAt, err = gateway.ExpireAt(req.Timeout, time.Now()); err != nil {
+			return
+		}
+		params["time_expire"] = expireAt.In(gateway.ChannelZone).Format("20060102150405")
+	}
+	if params["spbill_create_ip"] == EMPTY {
+		params["spbill_create_ip"] = "127.0.0.1"
+	}
+	appId := g.pay.AppId
+	switch req.TradeType {
+	case gateway.TRADE_NATIVE, gateway.TRADE_APP:
+		params["trade_type"] = req.TradeType
+	case gateway.TRADE_H5:
+		//H5支付的spbill_create_ip必须是用户浏览器的IP
+		params["trade_type"] = "MWEB"
+		params["scene_info"] = req.SceneInfo
+	case gateway.TRADE_JSAPI:
+		params["trade_type"] = gateway.TRADE_JSAPI
+		if g.subAppId != EMPTY {
+			//网页授权使用子商户公众号
+			appId = g.subAppId
+			if params["sub_openid"], err = g.openIdOf(OAUTH2_TOKEN_URL, g.subAppId, g.subSecret, "code", req.Code); err != nil {
+				return
+			}
+		} else if params["openid"], err = g.openIdOf(OAUTH2_TOKEN_URL, g.pay.AppId, g.pay.AppSecret, "code", req.Code); err != nil {
+			return
+		}
+	case gateway.TRADE_MINI:
+		appId = g.pay.MinProgramId
+		params["trade_type"] = gateway.TRADE_JSAPI
+		openId := "openid"
+		if g.partner() {
+			//服务商模式下小程序为子商户的小程序
+			params["sub_appid"] = appId
+			openId = "sub_openid"
+		} else {
+			params["appid"] = appId
+		}
+		if params[openId], err = g.openIdOf(JSCODE2SESSION_URL, g.pay.MinProgramId, g.pay.MinProgramSecret, "js_code", req.Code); err != nil {
+			return
+		}
+	default:
+		err = gateway.ErrNotSupport
+		return
+	}
+	var resp map[string]string
+	if resp, err = g.call("/pay/unifiedorder", params, SIGN_MD5, false); err != nil {
+		return
+	}
+	ret.Result = resultOf(resp)
+	prepayId := resp["prepay_id"]
+	timeStamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), nonceStr()
+	switch req.TradeType {
+	case gateway.TRADE_NATIVE:
+		ret.CodeUrl = resp["code_url"]
+		ret.PrepayId = prepayId
+		ret.Raw = RetPayCode{RetBase: baseOf(ret.Result), CodeUrl: ret.CodeUrl, PrepayId: prepayId}
+	case gateway.TRADE_H5:
+		info := RetH5Pay{RetBase: baseOf(ret.Result), PrepayId: prepayId, MwebUrl: resp["mweb_url"]}
+		if info.MwebUrl != EMPTY && req.ReturnUrl != EMPTY {
+			info.MwebUrl += "&redirect_url=" + url.QueryEscape(req.ReturnUrl)
+		}
+		ret.PrepayId = prepayId
+		ret.PayUrl = info.MwebUrl
+		if ret.PayUrl != EMPTY {
+			ret.PayPage = redirectPageOf(ret.PayUrl)
+		}
+		ret.Raw = info
+	case gateway.TRADE_APP:
+		//服务商模式下调起支付使用子商户的APP和子商户号
+		partnerId := g.pay.MchId
+		if g.partner() {
+			partnerId = g.subMchId
+			if g.subAppId != EMPTY {
+				appId = g.subAppId
+			}
+		}
+		info := RetAppPayParams{RetBase: baseOf(ret.Result), AppId: appId, PartnerId: partnerId,
+			PrepayId: prepayId, Package: "Sign=WXPay", NonceStr: nonce, TimeStamp: timeStamp}
+		if ret.ErrCode == 0 {
+			info.Sign = g.sign(map[string]string{"appid": info.AppId, "partnerid": info.PartnerId, "prepayid": info.PrepayId,
+				"package": info.Package, "noncestr": info.NonceStr, "timestamp": info.TimeStamp}, SIGN_MD5)
+		}
+		ret.PayParams = info
+		ret.Raw = info
+	default:
+		info := RetJsPayParams{RetBase: baseOf(ret.Result), AppId: appId, TimeStamp: timeStamp,
+			NonceStr: nonce, Package: "prepay_id=" + prepayId, SignType: SIGN_MD5}
+		if ret.ErrCode == 0 {
+			info.PaySign = g.sign(map[string]string{"appId": info.AppId, "timeStamp": info.TimeStamp, "nonceStr": info.NonceStr,
+				"package": info.Package, "signType": info.SignType}, SIGN_MD5)
+		}
+		if req.TradeType == gateway.TRADE_JSAPI {
+			ret.PayPage = wxPaymentPageOf(info.AppId, info.TimeStamp, info.NonceStr, info.Package, info.SignType, info.PaySign)
+		}
+		ret.PayParams = info
+		ret.Raw = info
+	}
+	return
+}
+
+//用网页授权code或小程序登录code换取openid
+func (g *WeChatGateway) openIdOf(apiUrl, appId, secret, codeName, code string) (openId string, err error) {
+	values := url.Values{"appid": {appId}, "secret": {secret}, codeName: {code}, "grant_type": {"authorization_code"}}
+	var resp *http.Response
+	if resp, err = apiClient.Get(apiUrl + "?" + values.Encode()); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	var info oauthResponse
+	if err = json.Unmarshal(body, &info); err != nil {
+		return
+	}
+	if info.ErrCode != 0 || info.OpenId == EMPTY {
+		code := ERR_CALL_PARMENT
+		if info.ErrCode == OAUTH_INVALID_CODE || info.ErrCode == OAUTH_CODE_USED {
+			code = ERR_INVALID_PARAM
+		}
+		err = gateway.NewError(code, strconv.Itoa(info.ErrCode)+":"+info.ErrMsg)
+		return
+	}
+	openId = info.OpenId
+	return
+}
+
+//关闭订单(/pay/closeorder),订单已关闭时视为成功
+func (g *WeChatGateway) closeOrder(tradeNo string) (ret gateway.Result, err error) {
+	var resp map[string]string
+	if resp, err = g.call("/pay/closeorder", map[string]string{"out_trade_no": tradeNo}, SIGN_MD5, false); err != nil {
+		return
+	}
+	if resp["err_code"] != "ORDERCLOSED" {
+		ret = resultOf(resp)
+	}
+	ret.Raw = RetCloseOrder{RetBase: baseOf(ret), OutTradeNo: tradeNo}
+	return
+}
@@ -0,0 +1,169 @@
+package wechat_payment
+
+import (
+	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"utils/wxpay"
+)
+
+//撤销订单返回信息
+type RetReverse struct {
+	RetBase
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+	Recall     string `json:"recall"`       //是否需要继续调用撤销(Y,N)
+}
+
+//服务商模式,配置了子商户号时所有接口都带上sub_mch_id
+func (g *WeChatGateway) partner() bool {
+	return g.subMchId != EMPTY
+}
+
+//付款码支付(/pay/micropay),支付未成功时查询订单确认是否需要用户输入密码
+func (g *WeChatGateway) microPay(req gateway.OrderRequest) (ret gateway.OrderResult, err error) {
+	ret.TradeNo = req.TradeNo
+	params := map[string]string{"body": req.Body, "out_trade_no": req.TradeNo, "total_fee": req.TotalFee.String(),
+		"spbill_create_ip": req.ClientIp, "auth_code": req.AuthCode}
+	if params["spbill_create_ip"] == EMPTY {
+		params["spbill_create_ip"] = "127.0.0.1"
+	}
+	var resp map[string]string
+	if resp, err = g.call("/pay/micropay", params, SIGN_MD5, false); err != nil {
+		return
+	}
+	ret.Result = resultOf(resp)
+	var fees []Money
+	if fees, err = feesOf(resp, "total_fee", "cash_fee"); err != nil {
+		return
+	}
+	info := RetMicroPay{RetBase: baseOf(ret.Result), Openid: resp["openid"], TradeType: resp["trade_type"],
+		BankType: resp["bank_type"], TransactionId: resp["transaction_id"], OutTradeNo: req.TradeNo, TimeEnd: resp["time_end"],
+		TotalFee: fees[0], CashFee: fees[1]}
+	ret.TransactionId = info.TransactionId
+	ret.TradeState = weixin.SUCCESS
+	if resp["result_code"] != weixin.SUCCESS {
+		if query, e := g.orderQuery(req.TradeNo); e == nil && query.ErrCode == 0 {
+			ret.TradeState = query.TradeState
+		} else {
+			ret.TradeState = EMPTY
+		}
+	}
+	ret.Raw = info
+	return
+}
+
+//查询订单(/pay/orderquery)
+func (g *WeChatGateway) orderQuery(tradeNo string) (ret gateway.QueryResult, err error) {
+	var resp map[string]string
+	if resp, err = g.call("/pay/orderquery", map[string]string{"out_trade_no": tradeNo}, SIGN_MD5, false); err != nil {
+		return
+	}
+	ret.Result = resultOf(resp)
+	var fees []Money
+	if fees, err = feesOf(resp, "total_fee", "cash_fee"); err != nil {
+		return
+	}
+	info := RetQueryTrade{RetBase: baseOf(ret.Result), Openid: resp["openid"], TradeType: resp["trade_type"],
+		TradeStatus: resp["trade_state"], BankType: resp["bank_type"], TransactionId: resp["transaction_id"], OutTradeNo: resp["out_trade_no"],
+		TimeEnd: resp["time_end"], TradeStatusDesc: resp["trade_state_desc"], TotalFee: fees[0], CashFee: fees[1]}
+	ret.TradeNo = info.OutTradeNo
+	ret.TransactionId = info.TransactionId
+	ret.TradeState = info.TradeStatus
+	ret.TotalFee = info.TotalFee
+	ret.Raw = info
+	return
+}
+
+//申请退款(/secapi/pay/refund),需要商户证书
+func (g *WeChatGateway) refund(req gateway.RefundRequest) (ret gateway.RefundResult, err error) {
+	params := map[string]string{"out_trade_no": req.TradeNo, "out_refund_no": req.OutRefundNo, "total_fee": req.TotalFee.String(),
+		"refund_fee": req.RefundFee.String(), "notify_url": req.NotifyUrl}
+	var resp map[string]string
+	if resp, err = g.call("/secapi/pay/refund", params, SIGN_MD5, true); err != nil {
+		return
+	}
+	ret.Result = resultOf(resp)
+	var fees []Money
+	if fees, err = feesOf(resp, "total_fee", "refund_fee", "cash_fee"); err != nil {
+		return
+	}
+	info := RetRefund{RetBase: baseOf(ret.Result), TransactionId: resp["transaction_id"],
+		OutTradeNo: resp["out_trade_no"], OutRefundNo: resp["out_refund_no"], RefundId: resp["refund_id"], TotalFee: fees[0],
+		RefundFee: fees[1], CashFee: fees[2]}
+	ret.TradeNo = info.OutTradeNo
+	ret.OutRefundNo = info.OutRefundNo
+	ret.RefundId = info.RefundId
+	ret.RefundFee = info.RefundFee
+	if ret.ErrCode == 0 {
+		ret.RefundStatus = REFUND_PROCESSING
+	}
+	ret.Raw = info
+	return
+}
+
+//查询退款(/pay/refundquery),按商户退款单号查询时只返回一笔退款,字段后缀为_0
+func (g *WeChatGateway) refundQuery(outRefundNo string) (ret gateway.RefundResult, err error) {
+	var resp map[string]string
+	if resp, err = g.call("/pay/refundquery", map[string]string{"out_refund_no": outRefundNo}, SIGN_MD5, false); err != nil {
+		return
+	}
+	ret.Result = resultOf(resp)
+	var fees []Money
+	if fees, err = feesOf(resp, "total_fee", "refund_fee_0"); err != nil {
+		return
+	}
+	info := RetQueryRefund{RetBase: baseOf(ret.Result), TransactionId: resp["transaction_id"],
+		OutTradeNo: resp["out_trade_no"], RefundId: resp["refund_id_0"], OutRefundNo: resp["out_refund_no_0"], TotalFee: fees[0]}
+	ret.TradeNo = info.OutTradeNo
+	ret.OutRefundNo = info.OutRefundNo
+	ret.RefundId = info.RefundId
+	ret.RefundFee = fees[1]
+	if ret.ErrCode == 0 {
+		ret.RefundStatus = refundStatusOf(resp["refund_status_0"])
+	}
+	ret.Raw = info
+	return
+}
+
+//微信退款状态对应的退款状态,退款关闭或退款异常为失败,未知状态为空
+func refundStatusOf(status string) string {
+	switch status {
+	case REFUND_SUCCESS, REFUND_PROCESSING:
+		return status
+	case "REFUNDCLOSE", "CHANGE":
+		return REFUND_FAIL
+	}
+	return EMPTY
+}
+
+//撤销订单(/secapi/pay/reverse),需要商户证书
+func (g *WeChatGateway) reverse(tradeNo string) (ret gateway.Result, err error) {
+	var resp map[string]string
+	if resp, err = g.call("/secapi/pay/reverse", map[string]string{"out_trade_no": tradeNo}, SIGN_MD5, true); err != nil {
+		return
+	}
+	ret = recallOf(resultOf(resp), resp["recall"])
+	ret.Raw = RetReverse{RetBase: baseOf(ret), OutTradeNo: tradeNo, Recall: resp["recall"]}
+	return
+}
+
+//撤销返回recall为Y时撤销未完成,按渠道系统繁忙返回,调用方需要重试撤销
+func recallOf(ret gateway.Result, recall string) gateway.Result {
+	if recall == "Y" {
+		ret = gateway.ResultOf(ERR_SYSTEM, MSG_SYSTEM+":recall")
+	}
+	return ret
+}
+
+//接口返回的金额(分),为空时为0,任一金额格式错误时返回ErrMoney
+func feesOf(resp map[string]string, keys ...string) (fees []Money, err error) {
+	fees = make([]Money, len(keys))
+	for i, key := range keys {
+		if resp[key] == EMPTY {
+			continue
+		}
+		if fees[i], err = ParseMoney(resp[key]); err != nil {
+			return
+		}
+	}
+	return
+}
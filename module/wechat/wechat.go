@@ -1,25 +1,30 @@
 package wechat_payment
 
 import (
-	"encoding/xml"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
+	"pay_service/module/bill"
 	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/poller"
+	"pay_service/module/store"
 	"strings"
 	"time"
 	"utils/data_conv/json_lib"
-	"utils/data_conv/number_lib"
-	"utils/data_conv/xml_lib"
 	"utils/gin_check"
-	"utils/http_lib"
 	"utils/wechat"
-	"utils/wechat/wechat_pay"
-	"utils/wxpay"
 )
 
 type RetBase struct {
-	ErrCode int    `json:"err_code"`
-	ErrMsg  string `json:"err_msg"`
+	ErrCode   int    `json:"err_code"`
+	ErrMsg    string `json:"err_msg"`
+	Retryable bool   `json:"retryable"` //可用相同参数重试
+}
+
+//渠道返回公共信息对应的返回信息
+func baseOf(r gateway.Result) RetBase {
+	return RetBase{ErrCode: r.ErrCode, ErrMsg: r.ErrMsg, Retryable: r.Retryable}
 }
 
 //支付付款返回信息
@@ -31,8 +36,8 @@ type RetMicroPay struct {
 	TransactionId string `xml:"transaction_id"` //微信订单号
 	OutTradeNo    string `xml:"out_trade_no"`   //商户订单号
 	TimeEnd       string `xml:"time_end"`       //支付完成时间
-	TotalFee      int    `xml:"total_fee"`      //支付金额
-	CashFee       int    `xml:"cash_fee"`       //现金支付金额
+	TotalFee      Money  `xml:"total_fee"`      //支付金额
+	CashFee       Money  `xml:"cash_fee"`       //现金支付金额
 }
 
 //查询订单返回信息
@@ -46,8 +51,8 @@ type RetQueryTrade struct {
 	OutTradeNo      string `xml:"out_trade_no" json:"out_trade_no"`          //商户订单号
 	TimeEnd         string `xml:"time_end" json:"time_end"`                  //支付完成时间
 	TradeStatusDesc string `xml:"trade_state_desc" json:"trade_status_desc"` //对当前查询订单状态的描述和下一步操作的指引
-	TotalFee        int    `xml:"total_fee" json:"total_fee"`                //标价金额
-	CashFee         int    `xml:"cash_fee" json:"cash_fee"`                  //现金支付金额
+	TotalFee        Money  `xml:"total_fee" json:"total_fee"`                //标价金额
+	CashFee         Money  `xml:"cash_fee" json:"cash_fee"`                  //现金支付金额
 }
 
 //获取支付二维码返回信息
@@ -64,9 +69,9 @@ type RetRefund struct {
 	OutTradeNo    string `json:"out_trade_no"`   //商户订单号
 	OutRefundNo   string `json:"out_refund_no"`  //商户退款单号
 	RefundId      string `json:"refund_id"`      //微信退款单号
-	TotalFee      int    `json:"total_fee"`      //标价金额
-	RefundFee     int    `json:"refund_fee"`     //退款金额
-	CashFee       int    `json:"cash_fee"`       //现金支付金额
+	TotalFee      Money  `json:"total_fee"`      //标价金额
+	RefundFee     Money  `json:"refund_fee"`     //退款金额
+	CashFee       Money  `json:"cash_fee"`       //现金支付金额
 }
 
 //查询退款返回信息
@@ -76,7 +81,21 @@ type RetQueryRefund struct {
 	OutTradeNo    string `xml:"out_trade_no" json:"out_trade_no"`     //商户订单号
 	RefundId      string `xml:"refund_id" json:"refund_id"`           //微信退款单号
 	OutRefundNo   string `xml:"out_refund_no" json:"out_refund_no"`   //商户退款订单号
-	TotalFee      int    `xml:"total_fee" json:"total_fee"`           //订单金额
+	TotalFee      Money  `xml:"total_fee" json:"total_fee"`           //订单金额
+}
+
+//关闭订单返回信息
+type RetCloseOrder struct {
+	RetBase
+	OutTradeNo string `json:"out_trade_no"` //商户订单号
+}
+
+//下载对账单返回
+type RetDownloadBill struct {
+	RetBase
+	BillType string `json:"bill_type"` //账单类型
+	BillDate string `json:"bill_date"` //账单日期
+	Count    int    `json:"count"`     //记录数
 }
 
 //支付结果异步通知信息
@@ -86,14 +105,15 @@ type RetPaymentNotifyInfo struct {
 	MchId          string `xml:"mch_id" json:"mch_id"`                     //商户号
 	OpenId         string `xml:"openid" json:"openid"`                     //用户标识
 	TradeType      string `xml:"trade_type" json:"trade_type"`             //交易类型
-	TotalFee       int    `xml:"total_fee" json:"total_fee"`               //订单金额
-	CashFee        int    `xml:"cash_fee" json:"cash_fee"`                 //现金支付金额
-	CouponFee      int    `xml:"coupon_fee" json:"coupon_fee"`             //总代金券金额
+	TotalFee       Money  `xml:"total_fee" json:"total_fee"`               //订单金额
+	CashFee        Money  `xml:"cash_fee" json:"cash_fee"`                 //现金支付金额
+	CouponFee      Money  `xml:"coupon_fee" json:"coupon_fee"`             //总代金券金额
 	TransactionId  string `xml:"transaction_id" json:"transaction_id"`     //微信支付订单号
 	OutTradeNo     string `xml:"out_trade_no" json:"out_trade_no"`         //商户订单号
 	TimeEnd        string `xml:"time_end" json:"time_end"`                 //支付完成时间
 	TradeStateDesc string `xml:"trade_state_desc" json:"trade_state_desc"` //订单状态描述
 	TradeState     string `xml:"trade_state" json:"trade_state"`           //订单状态
+	Duplicate      bool   `xml:"-" json:"duplicate,omitempty"`             //重复通知,已处理过
 }
 
 //退款异步通知信息
@@ -105,15 +125,16 @@ type RetRefundNotifyInfo struct {
 	OutTradeNo          string `xml:"out_trade_no" json:"out_trade_no"`                   //商户订单号
 	RefundId            string `xml:"refund_id" json:"refund_id"`                         //微信退款单号
 	OutRefundNo         string `xml:"out_refund_no" json:"out_refund_no"`                 //商户退款订单号
-	TotalFee            int    `xml:"total_fee" json:"total_fee"`                         //订单金额
-	SettlementTotalFee  int    `xml:"settlement_total_fee" json:"settlement_total_fee"`   //应结订单金额(当该订单有使用非充值券时，返回此字段。应结订单金额=订单金额-非充值代金券金额，应结订单金额<=订单金额)
-	RefundFee           int    `xml:"refund_fee" json:"refund_fee"`                       //申请退款金额
-	SettlementRefundFee int    `xml:"settlement_refund_fee" json:"settlement_refund_fee"` //退款金额
+	TotalFee            Money  `xml:"total_fee" json:"total_fee"`                         //订单金额
+	SettlementTotalFee  Money  `xml:"settlement_total_fee" json:"settlement_total_fee"`   //应结订单金额(当该订单有使用非充值券时，返回此字段。应结订单金额=订单金额-非充值代金券金额，应结订单金额<=订单金额)
+	RefundFee           Money  `xml:"refund_fee" json:"refund_fee"`                       //申请退款金额
+	SettlementRefundFee Money  `xml:"settlement_refund_fee" json:"settlement_refund_fee"` //退款金额
 	RefundStatus        string `xml:"refund_status" json:"refund_status"`                 //退款状态(SUCCESS-退款成功,CHANGE-退款异常,REFUNDCLOSE—退款关闭)
 	SuccessTime         string `xml:"success_time" json:"success_time"`                   //退款成功时间
 	RefundRecvAccout    string `xml:"refund_recv_accout" json:"refund_recv_accout"`       //退款入账账户
 	RefundAccount       string `xml:"refund_account"`                                     //退款资金来源(REFUND_SOURCE_RECHARGE_FUNDS-可用余额退款/基本账户,REFUND_SOURCE_UNSETTLED_FUNDS-未结算资金退款)
 	RefundRequestSource string `xml:"refund_request_source" json:"refund_request_source"` //退款发起来源(API-接口,VENDOR_PLATFORM-商户平台)
+	Duplicate           bool   `xml:"-" json:"duplicate,omitempty"`                       //重复通知,已处理过
 }
 
 //const (
@@ -121,15 +142,6 @@ type RetRefundNotifyInfo struct {
 //	OAUTH2_PARAM = "appid=%s&redirect_uri=%s&response_type=code&scope=snsapi_base&state=%s#wechat_redirect'"
 //)
 
-//证书相对路径
-var (
-	certFile = "resource/apiclient_cert.pem"
-	keyFile  = "resource/apiclient_key.pem"
-)
-var (
-	wxApiSecret string
-)
-
 //模板
 const (
 	wxPaymentPage = `<!DOCTYPE HTML>
@@ -191,28 +203,60 @@ const (
 </html>`
 )
 
-var wxPay wechat_pay.WXPay //微信支付对像
+var (
+	wxClients  = make(map[string]*WeChatGateway)         //商户的微信支付渠道
+	wxGateways = make(map[string]gateway.PaymentGateway) //商户记录订单的微信支付渠道
+)
 
-func Init(appId, mchId, appSecret, apiSecret string, cFile, kFile string, MinProgramId, MinProgramSecret string) {
-	wxPay = wechat_pay.WXPay{AppId: appId, MchId: mchId, AppSecret: appSecret, ApiSecret: apiSecret, MinProgramId: MinProgramId,
-		MinProgramSecret: MinProgramSecret}
-	wxApiSecret = apiSecret
-	certFile = cFile
-	keyFile = kFile
+//初始化商户的微信支付渠道,merchantId为空时为默认商户.subMchId不为空时以服务商身份为子商户下单
+func Init(merchantId, appId, mchId, appSecret, apiSecret string, cFile, kFile string, MinProgramId, MinProgramSecret string,
+	subMchId, subAppId, subSecret string) {
+	wxClients[merchantId] = NewGateway(appId, mchId, appSecret, apiSecret, cFile, kFile, MinProgramId, MinProgramSecret, subMchId, subAppId,
+		subSecret)
+	wxGateways[merchantId] = store.Track(merchantId, gateway.WECHAT, wxClients[merchantId])
+	bill.Register(merchantId, gateway.WECHAT, wxClients[merchantId])
+}
+
+//获取商户的微信支付渠道
+func Gateway(merchantId string) (g gateway.PaymentGateway, ok bool) {
+	g, ok = wxGateways[merchantId]
+	return
+}
+
+//按请求参数merchant_id获取商户的微信支付渠道,商户不存在时返回错误
+func gatewayOf(mapData map[string]interface{}, c *gin.Context) (client *WeChatGateway, g gateway.PaymentGateway, ok bool) {
+	merchantId, _ := mapData[MERCHANT_ID].(string)
+	if client, ok = wxClients[merchantId]; ok {
+		g = wxGateways[merchantId]
+	} else {
+		gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+	}
+	return
 }
 
 //获取商家支付码
 func WeChatGetPayCode(c *gin.Context) {
 	var ret RetPayCode
 	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, CLIENT_IP, FEE); err == nil {
-		if info, err := wxPay.GetPayCode(mapData[BODY].(string), mapData[TRADE_NO].(string), mapData[NOTIFY_URL].(string),
-			mapData[CLIENT_IP].(string), int(mapData[FEE].(float64))); err == nil {
-			json_lib.ObjectToObject(&ret, info)
-			ret.ErrCode, ret.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_NATIVE, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), ClientIp: mapData[CLIENT_IP].(string), TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		if info, err := g.CreateOrder(req); err == nil {
+			json_lib.ObjectToObject(&ret, info.Raw)
+			ret.RetBase = baseOf(info.Result)
 			c.JSON(HTTP_SUCCESS, ret)
 			return
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 			return
 		}
 	}
@@ -220,69 +264,146 @@ func WeChatGetPayCode(c *gin.Context) {
 
 //微信小程序支付
 func WeChatMinProgramPay(c *gin.Context) {
-	var retInfo wechat.RetMinProgramPay
 	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, CODE, FEE); err == nil {
-		retInfo = wxPay.MinProgramPlaceOrder(mapData[BODY].(string), mapData[TRADE_NO].(string), mapData[NOTIFY_URL].(string),
-			mapData[CODE].(string), int(mapData[FEE].(float64)))
-		if retInfo.ErrCode != 0 {
-			retInfo.ErrCode = ERR_CALL_PARMENT
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_MINI, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), Code: mapData[CODE].(string), TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		if info, err := g.CreateOrder(req); err == nil {
+			//统一下单返回的调起支付参数转为原有的返回结构
+			var retInfo wechat.RetMinProgramPay
+			json_lib.ObjectToObject(&retInfo, info.PayParams)
+			retInfo.ErrCode = info.ErrCode
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
 		}
-		c.JSON(HTTP_SUCCESS, retInfo)
 	}
 }
 
 //微信APP支付
 func WeChatAppPayment(c *gin.Context) {
-	var retInfo wechat.RetAppPay
 	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, FEE); err == nil {
-		retInfo = wxPay.AppPlaceOrder(mapData[BODY].(string), mapData[TRADE_NO].(string), mapData[NOTIFY_URL].(string),
-			int(mapData[FEE].(float64)))
-		if retInfo.ErrCode != 0 {
-			retInfo.ErrCode = ERR_CALL_PARMENT
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_APP, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		if info, err := g.CreateOrder(req); err == nil {
+			//统一下单返回的调起支付参数转为原有的返回结构
+			var retInfo wechat.RetAppPay
+			json_lib.ObjectToObject(&retInfo, info.PayParams)
+			retInfo.ErrCode = info.ErrCode
+			c.JSON(HTTP_SUCCESS, retInfo)
+		} else {
+			gateway.ReturnGatewayError(err, c)
 		}
-		c.JSON(HTTP_SUCCESS, retInfo)
 	}
 }
 
-//微信统一支付
+//公众号支付oauth2授权state有效期(秒)
+const PAY_STATE_EXPIRE = 600
+
+//保存待支付订单信息,返回oauth2授权的state令牌.令牌只能使用一次,过期后失效.timeout为订单有效时间,为空时使用默认有效时间
+func NewPayState(merchantId, body, tradeNo, notifyUrl string, totalFee Money, timeout string) (token string, err error) {
+	s := store.Default()
+	if s == nil {
+		err = gateway.ErrNotSupport
+		return
+	}
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+	err = s.CreatePayState(store.PayState{Token: token, MerchantId: merchantId, Body: body, TradeNo: tradeNo, NotifyUrl: notifyUrl, TotalFee: totalFee,
+		Timeout: timeout, ExpireAt: time.Now().Unix() + PAY_STATE_EXPIRE})
+	return
+}
+
+//微信统一支付,state为NewPayState返回的令牌,伪造,过期或已使用的令牌拒绝支付
 func WeChatUnifyPay(c *gin.Context) {
 	state := c.Query(STATE)
 	code := c.Query(CODE)
 	if state != EMPTY && code != EMPTY {
-		params := strings.Split(state, ",")
-		var fee int
-		number_lib.StrToInt(params[3], &fee)
-		info := wxPay.PublicPlaceOrder(params[0], params[1], params[2], code, fee)
-		sFile := strings.Replace(wxPaymentPage, "参数1", info.AppId, 1)
-		sFile = strings.Replace(sFile, "参数2", info.TimeStamp, 1)
-		sFile = strings.Replace(sFile, "参数3", info.NonceStr, 1)
-		sFile = strings.Replace(sFile, "参数4", info.Package, 1)
-		sFile = strings.Replace(sFile, "参数5", info.SignType, 1)
-		sFile = strings.Replace(sFile, "参数6", info.PaySign, 1)
-		fmt.Printf("%#v\n", info)
-		c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(sFile))
+		s := store.Default()
+		if s == nil {
+			gateway.ReturnError(ERR_NOT_SUPPORT, MSG_NOT_SUPPORT, c)
+			return
+		}
+		info, err := s.UsePayState(state, time.Now().Unix())
+		if err != nil {
+			gateway.ReturnError(ERR_PAY_STATE, MSG_PAY_STATE+":"+err.Error(), c)
+			return
+		}
+		g, ok := wxGateways[info.MerchantId]
+		if !ok {
+			gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+info.MerchantId, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_JSAPI, Body: info.Body, TradeNo: info.TradeNo, NotifyUrl: info.NotifyUrl,
+			Code: code, TotalFee: info.TotalFee, Timeout: info.Timeout}
+		if ret, err := g.CreateOrder(req); err == nil {
+			c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(ret.PayPage))
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
 	} else {
-		gin_check.SimpleReturn(ERR_LACK_PARAM, "缺少参数:state 或 code", c)
+		gateway.ReturnError(ERR_LACK_PARAM, "缺少参数:state 或 code", c)
 	}
 }
 
+//填充公众号支付页面
+func wxPaymentPageOf(appId, timeStamp, nonceStr, pkg, signType, paySign string) (sFile string) {
+	sFile = strings.Replace(wxPaymentPage, "参数1", appId, 1)
+	sFile = strings.Replace(sFile, "参数2", timeStamp, 1)
+	sFile = strings.Replace(sFile, "参数3", nonceStr, 1)
+	sFile = strings.Replace(sFile, "参数4", pkg, 1)
+	sFile = strings.Replace(sFile, "参数5", signType, 1)
+	sFile = strings.Replace(sFile, "参数6", paySign, 1)
+	return
+}
+
 //微信支付码支付
 func WeChatMicroPay(c *gin.Context) {
 	var retInfo RetMicroPay
-	var info wechat.RetMicroPay
 	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, AUTH_CODE, NOTIFY_URL, TOTAL_FEE); err == nil {
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[TOTAL_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
 		tradeNo := mapData[TRADE_NO].(string)
-		if info, err = wxPay.MicroPay(mapData[BODY].(string), tradeNo, mapData[NOTIFY_URL].(string),
-			mapData[AUTH_CODE].(string), int(mapData[TOTAL_FEE].(float64))); err == nil {
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
-			fmt.Printf("%#v\n", retInfo)
-			if info.ResultCode == weixin.SUCCESS {
-				go wxQueryMicroTrade(tradeNo, mapData[NOTIFY_URL].(string))
-			}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_MICRO, Body: mapData[BODY].(string), TradeNo: tradeNo,
+			NotifyUrl: mapData[NOTIFY_URL].(string), AuthCode: mapData[AUTH_CODE].(string), TotalFee: totalFee}
+		info, err := g.CreateOrder(req)
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		poller.AfterMicroPay(merchantId, gateway.WECHAT, tradeNo, info, err)
+		if err == nil {
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.RetBase = baseOf(info.Result)
 			c.JSON(HTTP_SUCCESS, retInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
@@ -290,31 +411,48 @@ func WeChatMicroPay(c *gin.Context) {
 //查询微信订单状态
 func WeChatQueryTrade(c *gin.Context) {
 	var retInfo RetQueryTrade
-	var info wechat.RetQuery
 	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO); err == nil {
-		if info, err = wxPay.QueryOrder(mapData[TRADE_NO].(string)); err == nil {
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		if info, err := g.Query(mapData[TRADE_NO].(string)); err == nil {
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.RetBase = baseOf(info.Result)
 			c.JSON(HTTP_SUCCESS, retInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
 
 //微信退款
 func WeChatRefund(c *gin.Context) {
-	var info wechat.RetRefund
-	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO, OUT_REFUND_NO, REFUND_FEE, TOTAL_FEE, NOTIFY_URL); err == nil {
+	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO, OUT_REFUND_NO, REFUND_FEE, NOTIFY_URL); err == nil {
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
 		var retInfo RetRefund
-		if info, err = wxPay.Refund(mapData[TRADE_NO].(string), mapData[OUT_REFUND_NO].(string), mapData[NOTIFY_URL].(string),
-			int(mapData[TOTAL_FEE].(float64)), int(mapData[REFUND_FEE].(float64)), certFile, keyFile); err == nil {
-			json_lib.ObjectToObject(&retInfo, info)
-			fmt.Printf("%#v\n", info)
-			retInfo.ErrCode, retInfo.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
+		//total_fee可不传,默认取本地订单金额
+		totalFee, err := MoneyOf(mapData, TOTAL_FEE)
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		refundFee, err := ParseMoney(mapData[REFUND_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.RefundRequest{TradeNo: mapData[TRADE_NO].(string), OutRefundNo: mapData[OUT_REFUND_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), TotalFee: totalFee, RefundFee: refundFee}
+		if info, err := g.Refund(req); err == nil {
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.RetBase = baseOf(info.Result)
 			c.JSON(HTTP_SUCCESS, retInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
@@ -322,88 +460,136 @@ func WeChatRefund(c *gin.Context) {
 //支付结果异步通知验签
 func WeChatPaymentNotifyVerify(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, NOTIFY_INFO); err == nil {
-		if b, retInfo := wxVerifyPaymentNotify(mapData[NOTIFY_INFO].(string)); b {
-			c.JSON(HTTP_SUCCESS, retInfo)
-		} else {
-			gin_check.SimpleReturn(ERR_VERIFY_SIGN, MSG_VERIFY_SIGN, c)
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
 			return
 		}
+		info, err := g.VerifyNotify(mapData[NOTIFY_INFO].(string))
+		retInfo, ok := info.Raw.(RetPaymentNotifyInfo)
+		if err != nil || !ok {
+			if err == nil {
+				err = gateway.ErrVerifySign
+			}
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		retInfo.Duplicate = info.Duplicate
+		c.JSON(HTTP_SUCCESS, retInfo)
 	}
 }
 
 //退款订单异步通知解密
 func WeChatRefundNotifyDecode(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, NOTIFY_INFO); err == nil {
-		retInfo, err := wxDecodeRefundNotify(mapData[NOTIFY_INFO].(string))
-		if err != nil {
-			retInfo.ErrCode = -1
-			retInfo.ErrMsg = err.Error()
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
 		}
+		info, err := g.VerifyNotify(mapData[NOTIFY_INFO].(string))
+		retInfo, ok := info.Raw.(RetRefundNotifyInfo)
+		if err != nil || !ok {
+			if err == nil {
+				err = gateway.ErrVerifySign
+			}
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		retInfo.Duplicate = info.Duplicate
 		c.JSON(HTTP_SUCCESS, retInfo)
 	}
 }
 
 //退款订单查询
 func WeChatQueryRefund(c *gin.Context) {
-	var info wechat.RetQueryRefund
 	if _, mapData, err := gin_check.CheckPostParameter(c, OUT_REFUND_NO); err == nil {
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
 		var retInfo RetQueryRefund
-		if info, err = wxPay.QueryRefund(mapData[OUT_REFUND_NO].(string), EMPTY); err == nil {
-			json_lib.ObjectToObject(&retInfo, info)
-			retInfo.ErrCode, retInfo.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
+		if info, err := g.QueryRefund(EMPTY, mapData[OUT_REFUND_NO].(string)); err == nil {
+			json_lib.ObjectToObject(&retInfo, info.Raw)
+			retInfo.RetBase = baseOf(info.Result)
 			c.JSON(HTTP_SUCCESS, retInfo)
 		} else {
-			gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
 
+//撤销订单
 func WeChatReverse(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, "out_trade_no"); err == nil {
-		if resp, err := wxPay.Reverse(mapData["out_trade_no"].(string), "resource/apiclient_cert.pem", "resource/apiclient_key.pem"); err == nil {
-			c.JSON(HTTP_SUCCESS, resp)
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		if resp, err := g.Reverse(mapData["out_trade_no"].(string)); err == nil {
+			c.JSON(HTTP_SUCCESS, resp.Raw)
 		} else {
-			fmt.Println(err)
+			gateway.ReturnGatewayError(err, c)
 		}
 	}
 }
 
-//查询微信支付码支付订单状态
-func wxQueryMicroTrade(tradeNo string, notifyUrl string) {
-	var info wechat.RetQuery
-	for i := 0; i < 15; i++ {
-		info, _ = wxPay.QueryOrder(tradeNo)
-		if info.TradeStatus == weixin.SUCCESS {
-			//提交订单状态
-			var desc wechat.PaymentNotifyInfo
-			json_lib.ObjectToObject(&desc, info)
-			xmlBuffer, _ := xml.Marshal(desc)
-			http_lib.HttpSubmit(http_lib.POST, notifyUrl, string(xmlBuffer), nil)
-			break
-		}
-		time.Sleep(2 * time.Second)
+//微信H5支付,用于微信外的手机浏览器,clientIp必须是用户浏览器的IP.返回的mweb_url需在浏览器中打开,有效期5分钟.
+//可选参数scene_info,或wap_url和wap_name生成场景信息,return_url为支付后的跳转地址,timeout_express
+func WeChatH5Pay(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, CLIENT_IP, FEE); err == nil {
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		totalFee, err := ParseMoney(mapData[FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{TradeType: gateway.TRADE_H5, Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string),
+			NotifyUrl: mapData[NOTIFY_URL].(string), ClientIp: mapData[CLIENT_IP].(string), TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		req.ReturnUrl, _ = mapData[RETURN_URL].(string)
+		if req.SceneInfo, _ = mapData[SCENE_INFO].(string); req.SceneInfo == EMPTY {
+			wapUrl, _ := mapData[WAP_URL].(string)
+			wapName, _ := mapData[WAP_NAME].(string)
+			req.SceneInfo = H5SceneInfo(wapUrl, wapName)
+		}
+		if info, err := g.CreateOrder(req); err == nil {
+			c.JSON(HTTP_SUCCESS, info.Raw)
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
 	}
-	return
 }
 
-func wxDecodeRefundNotify(xmlStr string) (retInfo RetRefundNotifyInfo, err error) {
-	var info wechat.RefundNotifyInfo
-	var buff []byte
-	xml_lib.XmlToObject(xmlStr, &info)
-	buff, err = wechat.DecodeRefundData(info.ReqInfo, wxApiSecret)
-	fmt.Printf(info.ReqInfo)
-	xml_lib.XmlToObject(string(buff), &info.RefundEncryptInfo)
-	json_lib.ObjectToObject(&retInfo, info.RefundEncryptInfo)
-	return
+//关闭订单,订单支付失败或超时未支付时调用,关闭后不能再支付.下单后至少5分钟才能关闭
+func WeChatCloseOrder(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, TRADE_NO); err == nil {
+		_, g, ok := gatewayOf(mapData, c)
+		if !ok {
+			return
+		}
+		if info, err := g.Close(mapData[TRADE_NO].(string)); err == nil {
+			c.JSON(HTTP_SUCCESS, info.Raw)
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
+	}
 }
 
-func wxVerifyPaymentNotify(xmlStr string) (b bool, retInfo RetPaymentNotifyInfo) {
-	var info wechat.PaymentNotifyInfo
-	xml_lib.XmlToObject(xmlStr, &info)
-	fmt.Println(json_lib.ObjectToJson(info))
-	if b = wechat.VerifySign(info, info.Sign, wxApiSecret); b {
-		json_lib.ObjectToObject(&retInfo, info)
-		//retInfo.ErrCode, retInfo.ErrMsg = wechat.AnalysisWxReturn(info.RetBase, info.RetPublic)
+//下载微信对账单并保存,bill_type为ALL,SUCCESS,REFUND或资金账单FUNDFLOW_BASIC,FUNDFLOW_OPERATION,FUNDFLOW_FEES,
+//bill_date为yyyy-MM-dd或yyyyMMdd.资金账单需要商户证书
+func WeChatDownloadBill(c *gin.Context) {
+	if _, mapData, err := gin_check.CheckPostParameter(c, BILL_TYPE, BILL_DATE); err == nil {
+		if _, _, ok := gatewayOf(mapData, c); !ok {
+			return
+		}
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		billType, billDate := mapData[BILL_TYPE].(string), mapData[BILL_DATE].(string)
+		if bills, err := bill.Download(merchantId, gateway.WECHAT, billType, billDate); err == nil {
+			c.JSON(HTTP_SUCCESS, RetDownloadBill{BillType: billType, BillDate: billDate, Count: len(bills)})
+		} else {
+			gateway.ReturnGatewayError(err, c)
+		}
 	}
-	return
 }
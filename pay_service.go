@@ -2,16 +2,29 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"pay_service/module/alipay"
+	"pay_service/module/auth"
+	"pay_service/module/bill"
 	. "pay_service/module/comm"
+	"pay_service/module/gateway"
+	"pay_service/module/idempotent"
+	"pay_service/module/merchant"
+	"pay_service/module/notify"
+	"pay_service/module/poller"
+	"pay_service/module/reconcile"
+	"pay_service/module/store"
+	"pay_service/module/sweeper"
+	"pay_service/module/unify"
 	"pay_service/module/wechat"
 	"strings"
-	"utils/alipay"
-	"utils/data_conv/json_lib"
+	"time"
+	"utils/data_conv/number_lib"
 	"utils/data_conv/str_lib"
 	"utils/file"
 	"utils/gin_check"
@@ -23,35 +36,33 @@ const OAUTH2_PARAM = "appid=%s&redirect_uri=%s&response_type=code&scope=snsapi_b
 
 //配置文件字段
 const (
-	WECHAT        = "weChat"      //微信
-	ALIPAY        = "AliPay"      //支付宝
-	WX_APP_ID     = "wxAppId"     //微信公众号
-	WX_MCH_ID     = "wxMchId"     //微信商户号
-	WX_APP_SECRET = "wxAppSecret" //微信app密钥
-	WX_API_SECRET = "wxApiSecret" //微信api密钥
-	ALIPAY_APP_ID = "aliPayAppId" //支付宝AppId
+	STORE         = "store"        //订单存储
+	DB_PATH       = "dbPath"       //sqlite数据库路径
+	NOTIFY        = "notify"       //商户通知
+	NOTIFY_SECRET = "notifySecret" //商户通知签名密钥
+	CALLBACK_HOST = "callbackHost" //本服务接收渠道异步通知的外网地址,如https://pay.example.com
+	POLLER        = "poller"       //付款码订单轮询
+	AUTH          = "auth"         //调用方鉴权
+	AUTH_CLIENTS  = "clients"      //调用方列表,逗号分隔
+	AUTH_CLIENT   = "client_"      //调用方配置前缀,如[client_pos]
+	AUTH_PROXIES  = "proxies"      //反向代理地址,逗号分隔,只信任来自这些地址的X-Forwarded-For
+	RECONCILE     = "reconcile"    //自动对账
+	ORDER         = "order"        //订单
+	ORDER_TIMEOUT = "timeout"      //订单默认有效时间,如30m
 )
 
 //路径
 const (
 	CONF_PATH            = "conf/conf.txt"       //配置文件相对路径
+	DEFAULT_DB_PATH      = "data/pay_service.db" //默认sqlite数据库路径
 	WX_RELATIVE_PATH     = "/payService/weChat/" //微信接口相对路径
 	ALIPAY_RELATIVE_PATH = "/payService/AliPay/" //支付宝接口相对路径
+	V2_RELATIVE_PATH     = "/payService/v2/"     //统一支付接口相对路径
+	ADMIN_RELATIVE_PATH  = "/payService/admin/"  //管理接口相对路径
 )
 
 var service *gin.Engine
 
-//微信变量
-var (
-	wxAppId            = EMPTY //微信appId
-	wxMchId            = EMPTY //微信商户号
-	wxAppSecret        = EMPTY //微信app密钥
-	wxApiSecret        = EMPTY //微信api密钥
-	wxPaymentNotify    = EMPTY //回调地址,用于OAUTH2
-	wxMinProgramId     = EMPTY //小程序id
-	wxMinProgramSecret = EMPTY //小程序密钥
-)
-
 //此页面返回到微信浏览器,来执行访问微信鉴权接口
 const wxSkipPage = `<!DOCTYPE HTML>
 <html>
@@ -66,88 +77,207 @@ const wxSkipPage = `<!DOCTYPE HTML>
 </body>
 </html>`
 
-//支付宝公钥和私钥路径
-const (
-	ALIPAY_PUBLIC_KEY  = "resource/alipay_public.txt"  //支付宝平台公钥路径
-	ALIPAY_PRIVATE_KEY = "resource/alipay_private.txt" //支付商户私钥路径
-)
-
-//微信证书路径
-const (
-	certFile = "resource/apiclient_cert.pem" //微信证书路径
-	keyFile  = "resource/apiclient_key.pem"  //微信证书私钥路径
-)
-
-//支付宝变量
-var (
-	aliPayPublicKey  = EMPTY //支付宝商户私钥
-	aliPayPrivateKey = EMPTY //支付宝平台公钥
-	aliPayAppId      = EMPTY //支付宝appId
-)
+//渠道选择页面,微信和支付宝客户端外的浏览器由用户选择支付渠道,选择后带pay_channel重新提交统一支付
+const channelPage = `<!DOCTYPE HTML>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=0" />
+<title>选择支付方式</title>
+</head>
+<body>
+<button style="display:block;width:100%;margin:20px 0;padding:12px;" onclick="pay('wechat')">微信支付</button>
+<button style="display:block;width:100%;margin:20px 0;padding:12px;" onclick="pay('alipay')">支付宝支付</button>
+<script language="javascript">
+var params = 请求参数;
+function pay(channel) {
+	params.pay_channel = channel;
+	var xhr = new XMLHttpRequest();
+	xhr.open("POST", window.location.pathname);
+	xhr.setRequestHeader("Content-Type", "application/json");
+	xhr.onload = function () {
+		document.open();
+		document.write(xhr.responseText);
+		document.close();
+	};
+	xhr.send(JSON.stringify(params));
+}
+</script>
+</body>
+</html>`
 
 func main() {
+	//命令行子命令,执行后退出
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	gin.SetMode(gin.DebugMode)
 
 	service = gin.Default()
+	if err := service.SetTrustedProxies(readTrustedProxies()); err != nil {
+		fmt.Println("auth proxies error:", err)
+		os.Exit(1)
+	}
 	service.Use(routerGateway)
 	//微信支付接口
-	service.POST(WxRelativePath("wxGetPayCode"), wechat_payment.WeChatGetPayCode)
-	service.POST(WxRelativePath("wxMinProgramPay"), wechat_payment.WeChatMinProgramPay)
-	service.POST(WxRelativePath("wxAppPay"), wechat_payment.WeChatAppPayment)
+	service.POST(WxRelativePath("wxGetPayCode"), auth.Require(auth.SCOPE_PAY), wechat_payment.WeChatGetPayCode)
+	service.POST(WxRelativePath("wxMinProgramPay"), auth.Require(auth.SCOPE_PAY), wechat_payment.WeChatMinProgramPay)
+	service.POST(WxRelativePath("wxAppPay"), auth.Require(auth.SCOPE_PAY), wechat_payment.WeChatAppPayment)
 	service.GET(WxRelativePath("wxUnifyPay"), wechat_payment.WeChatUnifyPay)
-	service.POST(WxRelativePath("wxMicroPay"), wechat_payment.WeChatMicroPay)
-	service.POST(WxRelativePath("wxQueryTrade"), wechat_payment.WeChatQueryTrade)
-	service.POST(WxRelativePath("wxRefund"), wechat_payment.WeChatRefund)
-	service.POST(WxRelativePath("wxQueryRefund"), wechat_payment.WeChatQueryRefund)
-	service.POST(WxRelativePath("wxPaymentNotifyVerify"), wechat_payment.WeChatPaymentNotifyVerify)
-	service.POST(WxRelativePath("wxRefundNotifyDecode"), wechat_payment.WeChatRefundNotifyDecode)
-	service.POST(WxRelativePath("wxReverse"), wechat_payment.WeChatReverse)
+	service.POST(WxRelativePath("wxH5Pay"), auth.Require(auth.SCOPE_PAY), wechat_payment.WeChatH5Pay)
+	service.POST(WxRelativePath("wxMicroPay"), auth.Require(auth.SCOPE_PAY), idempotent.Check("wxMicroPay", TRADE_NO), wechat_payment.WeChatMicroPay)
+	service.POST(WxRelativePath("wxQueryTrade"), auth.Require(auth.SCOPE_QUERY), wechat_payment.WeChatQueryTrade)
+	service.POST(WxRelativePath("wxRefund"), auth.Require(auth.SCOPE_REFUND), idempotent.Check("wxRefund", OUT_REFUND_NO), wechat_payment.WeChatRefund)
+	service.POST(WxRelativePath("wxQueryRefund"), auth.Require(auth.SCOPE_QUERY), wechat_payment.WeChatQueryRefund)
+	service.POST(WxRelativePath("wxPaymentNotifyVerify"), auth.Require(auth.SCOPE_NOTIFY_VERIFY), wechat_payment.WeChatPaymentNotifyVerify)
+	service.POST(WxRelativePath("wxRefundNotifyDecode"), auth.Require(auth.SCOPE_NOTIFY_VERIFY), wechat_payment.WeChatRefundNotifyDecode)
+	service.POST(WxRelativePath("wxReverse"), auth.Require(auth.SCOPE_REFUND), wechat_payment.WeChatReverse)
+	service.POST(WxRelativePath("wxCloseOrder"), auth.Require(auth.SCOPE_PAY), wechat_payment.WeChatCloseOrder)
+	service.POST(WxRelativePath("wxDownloadBill"), auth.Require(auth.SCOPE_ADMIN), wechat_payment.WeChatDownloadBill)
 	//支付宝支付接口
-	service.POST(AliPayRelativePath("aliPayMicroPay"), ali_payment.AliPayMicroPay)
-	service.POST(AliPayRelativePath("aliPayRefund"), ali_payment.AliPayRefund)
-	service.POST(AliPayRelativePath("aliPayQueryRefund"), ali_payment.AliPayQueryRefund)
-	service.POST(AliPayRelativePath("AliPayVerifySign"), ali_payment.AliPayVerifySign)
+	service.POST(AliPayRelativePath("aliPayMicroPay"), auth.Require(auth.SCOPE_PAY), idempotent.Check("aliPayMicroPay", TRADE_NO), ali_payment.AliPayMicroPay)
+	service.POST(AliPayRelativePath("aliPayPreCreate"), auth.Require(auth.SCOPE_PAY), ali_payment.AliPayPreCreate)
+	service.POST(AliPayRelativePath("aliPayAppPay"), auth.Require(auth.SCOPE_PAY), ali_payment.AliPayAppPay)
+	service.POST(AliPayRelativePath("aliPayPagePay"), auth.Require(auth.SCOPE_PAY), ali_payment.AliPayPagePay)
+	service.POST(AliPayRelativePath("aliPayQueryTrade"), auth.Require(auth.SCOPE_QUERY), ali_payment.AliPayQueryTrade)
+	service.POST(AliPayRelativePath("aliPayCancel"), auth.Require(auth.SCOPE_REFUND), ali_payment.AliPayCancel)
+	service.POST(AliPayRelativePath("aliPayClose"), auth.Require(auth.SCOPE_PAY), ali_payment.AliPayClose)
+	service.POST(AliPayRelativePath("aliPayRefund"), auth.Require(auth.SCOPE_REFUND), idempotent.Check("aliPayRefund", OUT_REFUND_NO), ali_payment.AliPayRefund)
+	service.POST(AliPayRelativePath("aliPayQueryRefund"), auth.Require(auth.SCOPE_QUERY), ali_payment.AliPayQueryRefund)
+	service.POST(AliPayRelativePath("AliPayVerifySign"), auth.Require(auth.SCOPE_NOTIFY_VERIFY), ali_payment.AliPayVerifySign)
+	//统一支付接口
+	service.POST(V2RelativePath("orders"), auth.Require(auth.SCOPE_PAY), idempotent.Check("orders", OUT_TRADE_NO), unify_payment.CreateOrder)
+	service.GET(V2RelativePath("orders/:no"), auth.Require(auth.SCOPE_QUERY), unify_payment.QueryOrder)
+	service.POST(V2RelativePath("orders/:no/close"), auth.Require(auth.SCOPE_PAY), unify_payment.CloseOrder)
+	service.POST(V2RelativePath("orders/:no/reverse"), auth.Require(auth.SCOPE_REFUND), unify_payment.ReverseOrder)
+	service.POST(V2RelativePath("orders/:no/refunds"), auth.Require(auth.SCOPE_REFUND), idempotent.Check("refunds", OUT_REFUND_NO), unify_payment.Refund)
+	service.GET(V2RelativePath("orders/:no/refunds/:refund_no"), auth.Require(auth.SCOPE_QUERY), unify_payment.QueryRefund)
+	service.GET(V2RelativePath("errors"), unify_payment.ListErrors)
+	service.POST(AliPayRelativePath("aliPayDownloadBill"), auth.Require(auth.SCOPE_ADMIN), ali_payment.AliPayDownloadBill)
+	//渠道异步通知,由渠道签名验证,不需要调用方鉴权
+	service.POST(gateway.CALLBACK_PATH+":channel", notify.Callback)
+	service.POST(gateway.CALLBACK_PATH+":channel/:merchant", notify.Callback)
+	//管理接口
+	service.GET(AdminRelativePath("notifies"), auth.Require(auth.SCOPE_ADMIN), notify.ListNotifies)
+	service.POST(AdminRelativePath("notifies/:id/replay"), auth.Require(auth.SCOPE_ADMIN), notify.ReplayNotify)
+	service.POST(AdminRelativePath("reconcile"), auth.Require(auth.SCOPE_ADMIN), reconcile.RunReconcile)
+	service.POST(AdminRelativePath("reconcile/confirm"), auth.Require(auth.SCOPE_ADMIN), reconcile.ConfirmDiscrepancy)
 	//微信,支付宝扫二合一码支付
 	service.POST("/payService/unifyPayPage", unifyPayPage)
 
+	notify.Start()       //启动商户通知投递
+	poller.Start()       //启动付款码订单轮询
+	reconcile.Start()    //启动每日自动对账
+	sweeper.Start()      //启动过期订单关闭
 	service.Run(":8003") //启动服务
 }
 
-//统一支付
+//执行命令行子命令
+func runCommand(args []string) (err error) {
+	switch args[0] {
+	case "bill":
+		err = bill.RunCommand(args[1:])
+	case "reconcile":
+		err = reconcile.RunCommand(args[1:])
+	default:
+		err = fmt.Errorf("unknown command %s, usage: pay_service bill -channel alipay -type trade -date 2019-01-01 "+
+			"| pay_service reconcile -channel wechat -date 2019-01-01", args[0])
+	}
+	return
+}
+
+//统一支付.支付宝客户端内使用支付宝H5支付,微信客户端内使用公众号支付,其它浏览器使用微信H5支付,
+//商户同时开通两个渠道时先返回渠道选择页面,选择后带pay_channel参数重新提交
 func unifyPayPage(c *gin.Context) {
 	if _, mapData, err := gin_check.CheckPostParameter(c, BODY, TRADE_NO, NOTIFY_URL, TOTAL_FEE); err == nil {
+		merchantId, _ := mapData[MERCHANT_ID].(string)
+		m, ok := merchant.Get(merchantId)
+		if !ok {
+			gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+			return
+		}
+		totalFee, err := ParseMoney(mapData[TOTAL_FEE])
+		if err != nil {
+			gateway.ReturnGatewayError(err, c)
+			return
+		}
+		req := gateway.OrderRequest{Body: mapData[BODY].(string), TradeNo: mapData[TRADE_NO].(string), NotifyUrl: mapData[NOTIFY_URL].(string),
+			TotalFee: totalFee}
+		req.Timeout, _ = mapData[TIMEOUT].(string)
+		req.ReturnUrl, _ = mapData[RETURN_URL].(string)
+		payChannel, _ := mapData[PAY_CHANNEL].(string)
 		userAgent := c.GetHeader(USER_AGENT)
-		if strings.Contains(userAgent, "AlipayClient") {
-			var dealInfo alipay.DealBaseInfo
-			json_lib.ObjectToObject(&dealInfo, mapData)
-			dealInfo.Subject = dealInfo.Body
-			dealInfo.TotalFee = dealInfo.TotalFee / 100
-			dealInfo.NotifyUrl = mapData[NOTIFY_URL].(string)
-			if payPage, err := ali_payment.AliH5Payment(dealInfo); err == nil {
-				c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(payPage))
-			} else {
-				gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
+		wxGateway, hasWeChat := wechat_payment.Gateway(merchantId)
+		aliGateway, hasAliPay := ali_payment.Gateway(merchantId)
+		switch {
+		case strings.Contains(userAgent, "AlipayClient") || (payChannel == gateway.ALIPAY && hasAliPay):
+			if !hasAliPay {
+				gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
+				return
+			}
+			req.TradeType = gateway.TRADE_H5
+			payPage(c, aliGateway, req)
+		case strings.Contains(userAgent, "MicroMessenger") && hasWeChat:
+			//未配置微信支付时按下面的分支回落到支付宝H5支付
+			state, err := wechat_payment.NewPayState(merchantId, req.Body, req.TradeNo, req.NotifyUrl, req.TotalFee, req.Timeout)
+			if err != nil {
+				gateway.ReturnGatewayError(err, c)
+				return
+			}
+			//服务商模式下配置了子商户公众号时由子商户公众号授权
+			appId := m.WxAppId
+			if m.WxSubMchId != EMPTY && m.WxSubAppId != EMPTY {
+				appId = m.WxSubAppId
 			}
-		} else /*if strings.Contains(userAgent, "MQQBrowser") || (strings.Contains(userAgent, "AppleWebKit") && strings.Contains(userAgent, "iPhone")) */ {
-			param := fmt.Sprintf("%s,%s,%s,%v", mapData[BODY], mapData[TRADE_NO], str_lib.UrlToUrlEncode(mapData[NOTIFY_URL].(string)), mapData[TOTAL_FEE])
-			script := getOauth2Url(wxAppId, wxPaymentNotify, param)
-			fmt.Println(script, "==")
+			script := getOauth2Url(appId, m.WxPaymentNotify, state)
 			s := strings.Replace(wxSkipPage, "执行脚本", script, 1)
 			c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(s))
+		case hasWeChat && hasAliPay && payChannel != gateway.WECHAT:
+			//未指定渠道时由用户选择
+			params, _ := json.Marshal(mapData)
+			c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(strings.Replace(channelPage, "请求参数", string(params), 1)))
+		case hasWeChat:
+			//微信外的浏览器不能使用公众号支付,使用H5支付
+			req.TradeType = gateway.TRADE_H5
+			//H5支付要求上报用户真实IP,经反向代理时只信任SetTrustedProxies配置的代理转发的X-Forwarded-For
+			req.ClientIp = c.ClientIP()
+			wapUrl, _ := mapData[WAP_URL].(string)
+			if wapUrl == EMPTY {
+				wapUrl = c.GetHeader("Referer")
+			}
+			if wapUrl == EMPTY {
+				wapUrl = "https://" + c.Request.Host
+			}
+			wapName, _ := mapData[WAP_NAME].(string)
+			if wapName == EMPTY {
+				wapName = req.Body
+			}
+			req.SceneInfo = wechat_payment.H5SceneInfo(wapUrl, wapName)
+			payPage(c, wxGateway, req)
+		case hasAliPay:
+			req.TradeType = gateway.TRADE_H5
+			payPage(c, aliGateway, req)
+		default:
+			gateway.ReturnError(ERR_MERCHANT, MSG_MERCHANT+":"+merchantId, c)
 		}
-		//else if strings.Contains(userAgent, "AlipayClient") {
-		//	var dealInfo alipay.DealBaseInfo
-		//	json_lib.ObjectToObject(&dealInfo, mapData)
-		//	dealInfo.Subject = dealInfo.Body
-		//	dealInfo.TotalFee = dealInfo.TotalFee / 100
-		//	dealInfo.NotifyUrl = mapData[NOTIFY_URL].(string)
-		//	if payPage, err := ali_payment.AliH5Payment(dealInfo); err == nil {
-		//		c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(payPage))
-		//	} else {
-		//		gin_check.SimpleReturn(ERR_CALL_PARMENT, err.Error(), c)
-		//	}
-		//}
+	}
+}
+
+//下单并返回支付页面
+func payPage(c *gin.Context, g gateway.PaymentGateway, req gateway.OrderRequest) {
+	if ret, err := g.CreateOrder(req); err == nil {
+		if ret.ErrCode != 0 {
+			gateway.ReturnError(ret.ErrCode, ret.ErrMsg, c)
+			return
+		}
+		c.Data(HTTP_SUCCESS, TEXT_HTML, []byte(ret.PayPage))
+	} else {
+		gateway.ReturnGatewayError(err, c)
 	}
 }
 
@@ -158,19 +288,15 @@ func getOauth2Url(appId, redirectUri, param string) (url string) {
 	return
 }
 
-//读取资源文件
-func readResourceFile() (err error) {
-	var buff []byte
-	//支付宝公钥
-	buff, err = file.ReadFile(ALIPAY_PUBLIC_KEY)
-	if err == nil {
-		aliPayPublicKey = string(buff)
-	}
-	//支付宝私钥
-	buff, err = file.ReadFile(ALIPAY_PRIVATE_KEY)
-	if err == nil {
-		aliPayPrivateKey = string(buff)
-	}
+//统一支付相对路径组合
+func V2RelativePath(interfaceName string) (path string) {
+	path = V2_RELATIVE_PATH + interfaceName
+	return
+}
+
+//管理接口相对路径组合
+func AdminRelativePath(interfaceName string) (path string) {
+	path = ADMIN_RELATIVE_PATH + interfaceName
 	return
 }
 
@@ -187,24 +313,112 @@ func AliPayRelativePath(interfaceName string) (path string) {
 }
 
 func init() {
-	wxAppId = file.ReadConfig(WECHAT, WX_APP_ID, CONF_PATH)
-	wxMchId = file.ReadConfig(WECHAT, WX_MCH_ID, CONF_PATH)
-	wxAppSecret = file.ReadConfig(WECHAT, WX_APP_SECRET, CONF_PATH)
-	wxApiSecret = file.ReadConfig(WECHAT, WX_API_SECRET, CONF_PATH)
-	wxPaymentNotify = file.ReadConfig(WECHAT, "wxPaymentNotify", CONF_PATH)
-	wxMinProgramId = file.ReadConfig(WECHAT, "wxMinProgramId", CONF_PATH)
-	wxMinProgramSecret = file.ReadConfig(WECHAT, "wxMinProgramSecret", CONF_PATH)
-	aliPayAppId = file.ReadConfig(ALIPAY, ALIPAY_APP_ID, CONF_PATH)
-	if wxAppId == EMPTY || wxMchId == EMPTY || wxAppSecret == EMPTY || wxApiSecret == EMPTY {
-		fmt.Println("read config file fail")
-	}
-	err := readResourceFile()
+	dbPath := file.ReadConfig(STORE, DB_PATH, CONF_PATH)
+	if dbPath == EMPTY {
+		dbPath = DEFAULT_DB_PATH
+	}
+	//退款额度,通知校验,幂等和支付state都依赖订单存储,打不开时不启动
+	if s, err := store.OpenSqlite(dbPath); err == nil {
+		store.SetDefault(s)
+	} else {
+		fmt.Println("open order store error:", err)
+		os.Exit(1)
+	}
+	notify.Init(file.ReadConfig(NOTIFY, NOTIFY_SECRET, CONF_PATH))
+	gateway.SetCallbackHost(strings.TrimSpace(file.ReadConfig(NOTIFY, CALLBACK_HOST, CONF_PATH)))
+	poller.Init(readPollerConfig())
+	clients, err := readAuthClients()
 	if err != nil {
-		fmt.Println("load resource file error:", err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	auth.Init(clients)
+	reconcile.Init(readReconcileConfig())
+	if timeout := strings.TrimSpace(file.ReadConfig(ORDER, ORDER_TIMEOUT, CONF_PATH)); timeout != EMPTY {
+		if _, err := gateway.ExpireAt(timeout, time.Now()); err == nil {
+			gateway.SetDefaultTimeout(timeout)
+		} else {
+			fmt.Println("order timeout error:", timeout, err)
+		}
 	}
 
-	wechat_payment.Init(wxAppId, wxMchId, wxAppSecret, wxApiSecret, certFile, keyFile, wxMinProgramId, wxMinProgramSecret)
-	ali_payment.Init(aliPayAppId, aliPayPrivateKey, aliPayPublicKey)
+	//默认商户开通全部渠道,其它商户只开通已配置的渠道
+	for _, m := range merchant.Load(CONF_PATH) {
+		merchant.Register(m)
+		if m.Id == EMPTY || m.HasWeChat() {
+			wechat_payment.Init(m.Id, m.WxAppId, m.WxMchId, m.WxAppSecret, m.WxApiSecret, m.WxCertFile, m.WxKeyFile, m.WxMinProgramId,
+				m.WxMinProgramSecret, m.WxSubMchId, m.WxSubAppId, m.WxSubAppSecret)
+			g, _ := wechat_payment.Gateway(m.Id)
+			gateway.Register(m.Id, gateway.WECHAT, g)
+		}
+		if m.Id == EMPTY || m.HasAliPay() {
+			ali_payment.Init(m.Id, m.AliPayAppId, m.AliPayPrivateKey, m.AliPayPublicKey, m.AliPayAuthToken, m.AliPaySellerId)
+			g, _ := ali_payment.Gateway(m.Id)
+			gateway.Register(m.Id, gateway.ALIPAY, g)
+		}
+	}
+}
+
+//读取付款码订单轮询配置,单位为秒,未配置时使用默认值
+func readPollerConfig() (c poller.Config) {
+	number_lib.StrToInt(file.ReadConfig(POLLER, "interval", CONF_PATH), &c.Interval)
+	number_lib.StrToInt(file.ReadConfig(POLLER, "maxInterval", CONF_PATH), &c.MaxInterval)
+	number_lib.StrToFloat(file.ReadConfig(POLLER, "multiplier", CONF_PATH), &c.Multiplier)
+	number_lib.StrToInt(file.ReadConfig(POLLER, "timeout", CONF_PATH), &c.Timeout)
+	number_lib.StrToInt(file.ReadConfig(POLLER, "workers", CONF_PATH), &c.Workers)
+	return
+}
+
+//读取自动对账配置,[reconcile]time为每天执行时间,channels为对账渠道,reportDir为报告保存目录
+func readReconcileConfig() (c reconcile.Config) {
+	c.Time = strings.TrimSpace(file.ReadConfig(RECONCILE, "time", CONF_PATH))
+	c.ReportDir = strings.TrimSpace(file.ReadConfig(RECONCILE, "reportDir", CONF_PATH))
+	for _, channel := range strings.Split(file.ReadConfig(RECONCILE, "channels", CONF_PATH), ",") {
+		if channel = strings.TrimSpace(channel); channel != EMPTY {
+			c.Channels = append(c.Channels, channel)
+		}
+	}
+	return
+}
+
+//读取调用方配置,[auth]clients列出调用方,每个调用方在[client_调用方]中配置secret,scopes和allowIps.
+//调用方配置错误时返回错误,不启动服务
+func readAuthClients() (list []auth.Client, err error) {
+	for _, id := range strings.Split(file.ReadConfig(AUTH, AUTH_CLIENTS, CONF_PATH), ",") {
+		if id = strings.TrimSpace(id); id == EMPTY {
+			continue
+		}
+		section := AUTH_CLIENT + id
+		client := auth.Client{Id: id, Secret: file.ReadConfig(section, "secret", CONF_PATH)}
+		if client.Secret == EMPTY {
+			err = fmt.Errorf("auth client without secret: %s", id)
+			return
+		}
+		for _, scope := range strings.Split(file.ReadConfig(section, "scopes", CONF_PATH), ",") {
+			if scope = strings.TrimSpace(scope); scope != EMPTY {
+				client.Scopes = append(client.Scopes, scope)
+			}
+		}
+		if client.AllowIps, err = auth.ParseAllowIps(file.ReadConfig(section, "allowIps", CONF_PATH)); err != nil {
+			err = fmt.Errorf("auth client %s allowIps error: %v", id, err)
+			return
+		}
+		list = append(list, client)
+	}
+	if len(list) == 0 {
+		fmt.Println("warning: no auth client configured, authenticated interfaces reject all requests")
+	}
+	return
+}
+
+//读取反向代理地址,未配置时不信任X-Forwarded-For,客户端IP为连接地址
+func readTrustedProxies() (list []string) {
+	for _, proxy := range strings.Split(file.ReadConfig(AUTH, AUTH_PROXIES, CONF_PATH), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != EMPTY {
+			list = append(list, proxy)
+		}
+	}
+	return
 }
 
 //路由网关
@@ -213,9 +427,22 @@ func routerGateway(c *gin.Context) {
 	//调试输出
 	switch method {
 	case "POST", "PATCH", "PUT":
+		if notifyPath(c.Request.URL.Path) {
+			//渠道异步通知和通知验签接口的内容不输出
+			return
+		}
 		buffer, str, _ := http_lib.GetBody(c.Request)
 		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer(buffer))
 		str, _ = url.QueryUnescape(str)
 		fmt.Println("Input Parameter->", str)
 	}
 }
+
+//渠道异步通知回调和通知验签接口
+func notifyPath(path string) bool {
+	switch path {
+	case WxRelativePath("wxPaymentNotifyVerify"), WxRelativePath("wxRefundNotifyDecode"), AliPayRelativePath("AliPayVerifySign"):
+		return true
+	}
+	return strings.HasPrefix(path, gateway.CALLBACK_PATH)
+}